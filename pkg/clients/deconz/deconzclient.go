@@ -1,8 +1,8 @@
 package deconzclient
 
 import (
+	"context"
 	"fmt"
-	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -11,9 +11,12 @@ import (
 	"github.com/splattner/goucrt/pkg/integration"
 )
 
+// Merge attribute changes of lights and groups, e.g. brightness ramps, into fewer entity changes
+const entityChangeDebounce = 250 * time.Millisecond
+
 // Denon AVR Client Implementation
 type DeconzClient struct {
-	integration.Client
+	*integration.Client
 	deconz *deconz.Deconz
 
 	mapOnState map[bool]entities.LightEntityState
@@ -22,11 +25,7 @@ type DeconzClient struct {
 func NewDeconzClient(i *integration.Integration) *DeconzClient {
 	client := DeconzClient{}
 
-	client.IntegrationDriver = i
-	// Start without a connection
-	client.DeviceState = integration.DisconnectedDeviceState
-
-	client.Messages = make(chan string)
+	client.Client = integration.NewClient(i, &client)
 
 	ipaddr := integration.SetupDataSchemaSettings{
 		Id: "ipaddr",
@@ -45,9 +44,11 @@ func NewDeconzClient(i *integration.Integration) *DeconzClient {
 		Label: integration.LanguageText{
 			En: "Port used by your deCONZ CLient",
 		},
-		Field: integration.SettingTypeText{
-			Text: integration.SettingTypeTextDefinition{
-				Value: "8080",
+		Field: integration.SettingTypeNumber{
+			Number: integration.SettingTypeNumberDefinition{
+				Value: 8080,
+				Min:   1,
+				Max:   65535,
 			},
 		},
 	}
@@ -57,9 +58,11 @@ func NewDeconzClient(i *integration.Integration) *DeconzClient {
 		Label: integration.LanguageText{
 			En: "Websocket Port used by your deCONZ CLient",
 		},
-		Field: integration.SettingTypeText{
-			Text: integration.SettingTypeTextDefinition{
-				Value: "8081",
+		Field: integration.SettingTypeNumber{
+			Number: integration.SettingTypeNumberDefinition{
+				Value: 8081,
+				Min:   1,
+				Max:   65535,
 			},
 		},
 	}
@@ -85,11 +88,20 @@ func NewDeconzClient(i *integration.Integration) *DeconzClient {
 
 	client.IntegrationDriver.SetMetadata(&metadata)
 
-	// set the client specific functions
-	client.InitFunc = client.initDeconzClient
-	client.SetupFunc = client.deconzHandleSetup
-	client.ClientLoopFunc = client.deconzClientLoop
-	client.SetDriverUserDataFunc = client.handleSetDriverUserData
+	// Ask the user to unlock the gateway, then create a new API key
+	client.IntegrationDriver.SetSetupFlow(&integration.SetupFlow{
+		Steps: []integration.SetupStep{
+			integration.ConfirmationStep(integration.ConfirmationPage{
+				Title: integration.LanguageText{
+					En: "Gateway configuration",
+				},
+				Message1: integration.LanguageText{
+					En: "Please unlock your DeCONZ Gateway to create a new API Key",
+				},
+			}),
+			integration.ValidationStep(client.createAPIKey),
+		},
+	})
 
 	client.mapOnState = map[bool]entities.LightEntityState{
 		true:  entities.OnLightEntityState,
@@ -99,74 +111,65 @@ func NewDeconzClient(i *integration.Integration) *DeconzClient {
 	return &client
 }
 
-func (c *DeconzClient) handleSetDriverUserData(user_data map[string]string, confirm bool) {
+// Get a new API key from the unlocked gateway
+func (c *DeconzClient) createAPIKey(ctx context.Context, values integration.SetupData) error {
 
-	log.Debug("Deconz handle set driver user data")
+	ipaddr := values["ipaddr"]
 
-	// confirm seems to be set to false always, maybe just the presence of the field tells me,
-	// confirmation was sent?
-	if len(user_data) == 0 {
-		// Get a new Denon API Key
-
-		ipaddr := c.IntegrationDriver.SetupData["ipaddr"]
-		port, _ := strconv.Atoi(c.IntegrationDriver.SetupData["port"])
-		websocketport, _ := strconv.Atoi(c.IntegrationDriver.SetupData["websocketport"])
-
-		deconz := deconz.NewDeconz(ipaddr, port, websocketport, "")
-		apikey, err := deconz.GetNewAPIKey(c.IntegrationDriver.DriverId)
+	port, err := values.Int("port")
+	if err != nil {
+		return &integration.SetupError{Code: integration.OtherError, Err: err}
+	}
 
-		if err != nil {
-			log.WithError(err).Debug("Failed to get new api Key")
-			c.IntegrationDriver.SetDriverSetupState(integration.StopEvent, integration.ErrorState, integration.AuthErrorError, nil)
-			return
-		}
+	websocketport, err := values.Int("websocketport")
+	if err != nil {
+		return &integration.SetupError{Code: integration.OtherError, Err: err}
+	}
 
-		c.IntegrationDriver.SetupData["apikey"] = apikey
-		c.IntegrationDriver.PersistSetupData()
+	deconz := deconz.NewDeconz(ipaddr, port, websocketport, "")
+	apikey, err := deconz.GetNewAPIKey(c.IntegrationDriver.DriverId)
+	if err != nil {
+		return &integration.SetupError{Code: integration.AuthErrorError, Err: fmt.Errorf("failed to get new api key: %w", err)}
+	}
 
-		c.IntegrationDriver.SetDriverSetupState(integration.StopEvent, integration.OkState, "", nil)
+	values["apikey"] = apikey
 
-	}
+	return nil
 }
 
-func (c *DeconzClient) initDeconzClient() {
-
+func (c *DeconzClient) Init() error {
+	return nil
 }
 
-func (c *DeconzClient) deconzHandleSetup(setup_data integration.SetupData) {
-	//event_type: SETUP with state: SETUP is a progress event to keep the process running,
-	// If the setup process takes more than a few seconds,
-	// the integration should send driver_setup_change events with state: SETUP to the Remote Two
-	// to show a setup progress to the user and prevent an inactivity timeout.
-	//c.IntegrationDriver.SetDriverSetupState(integration.SetupEvent, integration.SetupState, "", nil)
-	time.Sleep(1 * time.Second)
+// The setup is done by the SetupFlow
+func (c *DeconzClient) Setup(ctx context.Context, setup_data integration.SetupData) error {
+	return nil
+}
 
-	var userAction = integration.RequireUserAction{
-		Confirmation: integration.ConfirmationPage{
-			Title: integration.LanguageText{
-				En: "Gateway configuration",
-			},
-			Message1: integration.LanguageText{
-				En: "Please unlock your DeCONZ Gateway to create a new API Key",
-			},
-		},
-	}
+// The input is handled by the SetupFlow
+func (c *DeconzClient) UserData(userdata map[string]string, confirm bool) error {
+	return nil
+}
 
-	// Start the setup with some require user data
-	c.IntegrationDriver.SetDriverSetupState(integration.SetupEvent, integration.WaitUserActionState, "", &userAction)
+func (c *DeconzClient) setupDeconz() {
 
-	// // Finish the setup
-	//c.IntegrationDriver.SetDriverSetupState(integration.StopEvent, integration.OkState, "", nil)
+	setupData := c.IntegrationDriver.GetSetupData()
 
-}
+	if setupData["apikey"] != "" {
 
-func (c *DeconzClient) setupDeconz() {
+		ipaddr := setupData["ipaddr"]
 
-	if c.IntegrationDriver.SetupData["apikey"] != "" {
+		port, err := setupData.Int("port")
+		if err != nil {
+			log.WithError(err).Error("Cannot setup DeCONZ Client, invalid setupData")
+			return
+		}
 
-		ipaddr := c.IntegrationDriver.SetupData["ipaddr"]
-		port, _ := strconv.Atoi(c.IntegrationDriver.SetupData["port"])
-		websocketport, _ := strconv.Atoi(c.IntegrationDriver.SetupData["websocketport"])
+		websocketport, err := setupData.Int("websocketport")
+		if err != nil {
+			log.WithError(err).Error("Cannot setup DeCONZ Client, invalid setupData")
+			return
+		}
 
 		log.WithFields(log.Fields{
 			"ipaddr":        ipaddr,
@@ -174,13 +177,13 @@ func (c *DeconzClient) setupDeconz() {
 			"websocketport": websocketport,
 		}).Debug("Create DeCONZ Client")
 
-		deconz := deconz.NewDeconz(ipaddr, port, websocketport, c.IntegrationDriver.SetupData["apikey"])
+		deconz := deconz.NewDeconz(ipaddr, port, websocketport, setupData["apikey"])
 		c.deconz = deconz
 	}
 
 }
 
-func (c *DeconzClient) configureDeconz() {
+func (c *DeconzClient) configureDeconz() error {
 
 	log.Debug("Configure DeCONZ")
 
@@ -188,7 +191,7 @@ func (c *DeconzClient) configureDeconz() {
 	c.deconz.SetDeviceRemoveHandler(c.handleRemoveDevice)
 
 	// TODO, enable groups as setup_data
-	c.deconz.StartDiscovery(true)
+	return c.deconz.StartDiscovery(true)
 
 }
 
@@ -244,6 +247,7 @@ func (c *DeconzClient) handleNewSensorDeviceDiscovered(device *deconz.DeconzDevi
 
 func (c *DeconzClient) handleNewLightDeviceDiscovered(device *deconz.DeconzDevice) {
 	light := entities.NewLightEntity(fmt.Sprintf("light%d", device.GetID()), entities.LanguageText{En: device.GetName()}, "")
+	light.SetDebounce(entityChangeDebounce)
 
 	// Add Features and initial values
 	light.AddFeature(entities.OnOffLightEntityFeatures)
@@ -268,48 +272,11 @@ func (c *DeconzClient) handleNewLightDeviceDiscovered(device *deconz.DeconzDevic
 	// Set initial attribute
 
 	// Add commands
-	light.AddCommand(entities.OnLightEntityCommand, func(entity entities.LightEntity, params map[string]interface{}) int {
-
-		// NO param set, so just turn on
-		if len(params) == 0 {
-			if err := device.TurnOn(); err != nil {
-				return 404
-			}
-		} else {
-
-			if params["brightness"] != nil {
-
-				if err := device.SetBrightness(float32(params["brightness"].(uint))); err != nil {
-					return 404
-				}
-			}
-
-			if params["hue"] != nil {
-				hue := params["hue"].(float64) / 360 * 65535
-				if err := device.SetHue(float32(hue)); err != nil {
-					return 404
-				}
-			}
-
-			if params["saturation"] != nil {
-				if err := device.SetSaturation(float32(params["saturation"].(uint))); err != nil {
-					return 404
-				}
-			}
-
-			if params["color_temperature"] != nil {
-
-				raw_ct := params["color_temperature"].(float64)
-				ct := raw_ct/100*(500-153) + 153
-
-				if err := device.SetColorTemp(float32(ct)); err != nil {
-					return 404
-				}
-			}
-		}
-
-		return 200
-	})
+	if err := entities.AddTypedCommand(light, entities.OnLightEntityCommand, func(onParams *entities.LightOnParams) error {
+		return c.handleLightOnCommand(device, onParams)
+	}); err != nil {
+		log.WithError(err).Error("Cannot add on command")
+	}
 
 	light.MapCommand(entities.OffLightEntityCommand, device.TurnOff)
 	light.MapCommand(entities.ToggleLightEntityCommand, device.Toggle)
@@ -368,8 +335,50 @@ func (c *DeconzClient) handleNewLightDeviceDiscovered(device *deconz.DeconzDevic
 	}
 }
 
+// Handle the on command of a light or group
+func (c *DeconzClient) handleLightOnCommand(device *deconz.DeconzDevice, onParams *entities.LightOnParams) error {
+
+	// NO param set, so just turn on
+	if onParams.IsEmpty() {
+		if err := device.TurnOn(); err != nil {
+			return entities.NewDeviceUnavailableError(err)
+		}
+	} else {
+
+		if onParams.Brightness != nil {
+			if err := device.SetBrightness(float32(*onParams.Brightness)); err != nil {
+				return entities.NewDeviceUnavailableError(err)
+			}
+		}
+
+		if onParams.Hue != nil {
+			hue := float64(*onParams.Hue) / 360 * 65535
+			if err := device.SetHue(float32(hue)); err != nil {
+				return entities.NewDeviceUnavailableError(err)
+			}
+		}
+
+		if onParams.Saturation != nil {
+			if err := device.SetSaturation(float32(*onParams.Saturation)); err != nil {
+				return entities.NewDeviceUnavailableError(err)
+			}
+		}
+
+		if onParams.ColorTemperature != nil {
+			ct := float64(*onParams.ColorTemperature)/100*(500-153) + 153
+
+			if err := device.SetColorTemp(float32(ct)); err != nil {
+				return entities.NewDeviceUnavailableError(err)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *DeconzClient) handleNewGroupDeviceDiscovered(device *deconz.DeconzDevice) {
 	group := entities.NewLightEntity(fmt.Sprintf("group%d", device.GetID()), entities.LanguageText{En: device.GetName()}, "")
+	group.SetDebounce(entityChangeDebounce)
 
 	// Add Features and initial values
 	group.AddFeature(entities.OnOffLightEntityFeatures)
@@ -397,66 +406,31 @@ func (c *DeconzClient) handleNewGroupDeviceDiscovered(device *deconz.DeconzDevic
 	}
 
 	// Commands
-	group.AddCommand(entities.OnLightEntityCommand, func(entity entities.LightEntity, params map[string]interface{}) int {
-
-		// NO param set, so just turn on
-		if len(params) == 0 {
-			if err := device.TurnOn(); err != nil {
-				return 404
-			}
-		} else {
-
-			if params["brightness"] != nil {
-				//bri, _ := strconv.ParseFloat(params["brightness"].(string), 32)
-				if err := device.SetBrightness(float32(params["brightness"].(float64))); err != nil {
-					return 404
-				}
-			}
-
-			if params["hue"] != nil {
-				hue := params["hue"].(float64) / 360 * 65535
-				if err := device.SetHue(float32(hue)); err != nil {
-					return 404
-				}
-			}
-
-			if params["saturation"] != nil {
-				if err := device.SetSaturation(float32(params["saturation"].(float64))); err != nil {
-					return 404
-				}
-			}
-
-			if params["color_temperature"] != nil {
-				raw_ct := params["color_temperature"].(float64)
-				ct := raw_ct/100*(500-153) + 153
-
-				if err := device.SetColorTemp(float32(ct)); err != nil {
-					return 404
-				}
-			}
-		}
-		return 200
-	})
+	if err := entities.AddTypedCommand(group, entities.OnLightEntityCommand, func(onParams *entities.LightOnParams) error {
+		return c.handleLightOnCommand(device, onParams)
+	}); err != nil {
+		log.WithError(err).Error("Cannot add on command")
+	}
 
-	group.AddCommand(entities.OffLightEntityCommand, func(entity entities.LightEntity, params map[string]interface{}) int {
+	group.AddCommand(entities.OffLightEntityCommand, func(entity entities.LightEntity, params map[string]interface{}) error {
 
 		if err := device.TurnOff(); err != nil {
-			return 404
+			return entities.NewDeviceUnavailableError(err)
 		}
-		return 200
+		return nil
 	})
 
-	group.AddCommand(entities.ToggleLightEntityCommand, func(entity entities.LightEntity, params map[string]interface{}) int {
+	group.AddCommand(entities.ToggleLightEntityCommand, func(entity entities.LightEntity, params map[string]interface{}) error {
 		if device.IsOn() {
 			if err := device.TurnOff(); err != nil {
-				return 404
+				return entities.NewDeviceUnavailableError(err)
 			}
 		} else {
 			if err := device.TurnOn(); err != nil {
-				return 404
+				return entities.NewDeviceUnavailableError(err)
 			}
 		}
-		return 200
+		return nil
 	})
 
 	device.SetHandleChangeStateFunc(func(state *deconz.DeconzState) {
@@ -556,63 +530,59 @@ func (c *DeconzClient) handleRemoveDevice(device *deconz.DeconzDevice) {
 
 }
 
-// Start the Denon Listen Loop
-// disconnect when finished
-func (c *DeconzClient) startDenonListenLoop() {
-	defer func() {
-		// disconnect and let RT make a new connection again
-		c.Messages <- "disconnect"
-	}()
-
-	c.deconz.StartandListenLoop()
-}
-
 // Callen on RT connect
-func (c *DeconzClient) deconzClientLoop() {
-
-	ticker := time.NewTicker(5 * time.Minute)
-
-	defer func() {
-		if c.deconz != nil {
-			c.deconz.Stop()
-		}
-		ticker.Stop()
-		c.SetDeviceState(integration.DisconnectedDeviceState)
-	}()
+func (c *DeconzClient) Connect(ctx context.Context) error {
 
 	if c.deconz == nil {
 		c.setupDeconz()
 	}
 
-	if c.deconz != nil {
-		c.configureDeconz()
-
-		go c.startDenonListenLoop()
+	if c.deconz == nil {
+		return nil
+	}
 
-	} else {
-		return
+	if err := c.configureDeconz(); err != nil {
+		return fmt.Errorf("cannot configure DeCONZ: %w", err)
 	}
 
-	// Handle connection to device this integration shall control
-	// Set Device state to connected when connection is established
-	c.SetDeviceState(integration.ConnectedDeviceState)
+	// The loop returns without error when Disconnect stopped it
+	connected := make(chan struct{})
+	listenErr := c.deconz.StartListenLoop(func() { close(connected) })
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
 
 	// Run Client Loop to handle entity changes from device
 	for {
 		select {
+		case <-connected:
+			// Set Device state to connected when the websocket connection is established
+			c.SetDeviceState(integration.ConnectedDeviceState)
+			connected = nil
+
 		case <-ticker.C:
 			// Run Discovery again
-			c.deconz.StartDiscovery(true)
-		case msg := <-c.Messages:
-
-			switch msg {
-			case "disconnect":
-				return
-			case "discovery":
-				// Run Discovery again
-				c.deconz.StartDiscovery(true)
+			if err := c.deconz.StartDiscovery(true); err != nil {
+				log.WithError(err).Error("Deconz discovery failed")
+			}
+		case err := <-listenErr:
+			if err != nil {
+				return fmt.Errorf("deconz websocket loop stopped: %w", err)
 			}
+			return nil
+		case <-ctx.Done():
+			return nil
 		}
 	}
 
 }
+
+func (c *DeconzClient) Disconnect() error {
+	if c.deconz != nil {
+		c.deconz.Stop()
+		// Setup again with the current setup data on the next connect
+		c.deconz = nil
+	}
+
+	return nil
+}
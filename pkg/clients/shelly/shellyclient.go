@@ -1,8 +1,8 @@
 package shellyclient
 
 import (
+	"context"
 	"fmt"
-	"strconv"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -14,18 +14,14 @@ import (
 
 // Shelly Implementation
 type ShellyClient struct {
-	integration.Client
+	*integration.Client
 	shelly *shelly.Shelly
 }
 
 func NewShellyClient(i *integration.Integration) *ShellyClient {
 	client := ShellyClient{}
 
-	client.IntegrationDriver = i
-	// Start without a connection
-	client.DeviceState = integration.DisconnectedDeviceState
-
-	client.Messages = make(chan string)
+	client.Client = integration.NewClient(i, &client)
 
 	ipaddr := integration.SetupDataSchemaSettings{
 		Id: "mqtt_ipaddr",
@@ -44,9 +40,11 @@ func NewShellyClient(i *integration.Integration) *ShellyClient {
 		Label: integration.LanguageText{
 			En: "MQTT Broker Port",
 		},
-		Field: integration.SettingTypeText{
-			Text: integration.SettingTypeTextDefinition{
-				Value: "1883",
+		Field: integration.SettingTypeNumber{
+			Number: integration.SettingTypeNumberDefinition{
+				Value: 1883,
+				Min:   1,
+				Max:   65535,
 			},
 		},
 	}
@@ -68,8 +66,8 @@ func NewShellyClient(i *integration.Integration) *ShellyClient {
 		Label: integration.LanguageText{
 			En: "MQTT Broker Password",
 		},
-		Field: integration.SettingTypeText{
-			Text: integration.SettingTypeTextDefinition{
+		Field: integration.SettingTypePassword{
+			Password: integration.SettingTypePasswordDefinition{
 				Value: "",
 			},
 		},
@@ -96,34 +94,39 @@ func NewShellyClient(i *integration.Integration) *ShellyClient {
 
 	client.IntegrationDriver.SetMetadata(&metadata)
 
-	// set the client specific functions
-	client.InitFunc = client.initShellyClient
-	client.SetupFunc = client.shellyHandleSetup
-	client.ClientLoopFunc = client.shellyClientLoop
-	//client.setDriverUserDataFunc = client.handleSetDriverUserData
-
 	return &client
 }
 
-func (c *ShellyClient) initShellyClient() {
-
+func (c *ShellyClient) Init() error {
+	return nil
 }
 
-func (c *ShellyClient) shellyHandleSetup(setup_data integration.SetupData) {
+func (c *ShellyClient) Setup(ctx context.Context, setup_data integration.SetupData) error {
 	// Finish the setup
 	// Nothing to configure
 	// Setup Data already persistet by integration Driver
-	c.IntegrationDriver.SetDriverSetupState(integration.StopEvent, integration.OkState, "", nil)
+	return nil
+}
+
+// No user input is requested during setup
+func (c *ShellyClient) UserData(userdata map[string]string, confirm bool) error {
+	return nil
 }
 
-func (c *ShellyClient) setupShelly() {
+func (c *ShellyClient) setupShelly(connectionLost chan<- error) {
 
 	if c.shelly == nil {
 
-		if c.IntegrationDriver.SetupData["mqtt_ipaddr"] != "" {
+		setupData := c.IntegrationDriver.GetSetupData()
 
-			ipaddr := c.IntegrationDriver.SetupData["mqtt_ipaddr"]
-			port, _ := strconv.Atoi(c.IntegrationDriver.SetupData["mqtt_port"])
+		if setupData["mqtt_ipaddr"] != "" {
+
+			ipaddr := setupData["mqtt_ipaddr"]
+			port, err := setupData.Int("mqtt_port")
+			if err != nil {
+				log.WithError(err).Error("Cannot setup Shelly Client, invalid setupData")
+				return
+			}
 			mqttBroker := fmt.Sprintf("tcp://%s:%d", ipaddr, port)
 
 			log.WithFields(log.Fields{
@@ -138,9 +141,17 @@ func (c *ShellyClient) setupShelly() {
 			opts.SetPingTimeout(1 * time.Second)
 			opts.SetProtocolVersion(3)
 			opts.SetOrderMatters(false)
-			if c.IntegrationDriver.SetupData["mqtt_username"] != "" && c.IntegrationDriver.SetupData["mqtt_password"] != "" {
-				opts.SetUsername(c.IntegrationDriver.SetupData["mqtt_username"])
-				opts.SetPassword(c.IntegrationDriver.SetupData["mqtt_password"])
+			// Reconnects are handled by the client with backoff and a resync of the entity states
+			opts.SetAutoReconnect(false)
+			opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+				select {
+				case connectionLost <- err:
+				default:
+				}
+			})
+			if setupData["mqtt_username"] != "" && setupData["mqtt_password"] != "" {
+				opts.SetUsername(setupData["mqtt_username"])
+				opts.SetPassword(setupData["mqtt_password"])
 			}
 
 			mqttClient := mqtt.NewClient(opts)
@@ -153,12 +164,12 @@ func (c *ShellyClient) setupShelly() {
 
 }
 
-func (c *ShellyClient) startShelly() {
+func (c *ShellyClient) startShelly() error {
 
 	log.Debug("Start and connect Shelly")
 
 	if err := c.shelly.Start(); err != nil {
-		c.SetDeviceState(integration.ErrorDeviceState)
+		return err
 	}
 
 	// Handle connection to device this integration shall control
@@ -167,6 +178,7 @@ func (c *ShellyClient) startShelly() {
 
 	c.shelly.StartDiscovery()
 
+	return nil
 }
 
 func (c *ShellyClient) handleNewDeviceDiscovered(device *shelly.ShellyDevice) {
@@ -217,35 +229,39 @@ func (c *ShellyClient) handleNewDeviceDiscovered(device *shelly.ShellyDevice) {
 // }
 
 // Callen on RT connect
-func (c *ShellyClient) shellyClientLoop() {
+func (c *ShellyClient) Connect(ctx context.Context) error {
 
-	defer func() {
-		c.shelly.StopDiscovery()
-		c.shelly.Stop()
-		c.SetDeviceState(integration.DisconnectedDeviceState)
-	}()
+	connectionLost := make(chan error, 1)
 
 	if c.shelly == nil {
-		c.setupShelly()
-	} else {
-		return
+		c.setupShelly(connectionLost)
 	}
 
-	if c.shelly != nil {
-		c.startShelly()
-	} else {
-		return
+	if c.shelly == nil {
+		return nil
 	}
 
-	// Run Client Loop to handle entity changes from device
-	for {
-		msg := <-c.Messages
+	if err := c.startShelly(); err != nil {
+		return fmt.Errorf("cannot start Shelly: %w", err)
+	}
 
-		switch msg {
-		case "disconnect":
-			return
-		}
+	// Run until disconnected or the connection to the broker is lost, entity changes are handled by the MQTT callbacks
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-connectionLost:
+		return fmt.Errorf("lost connection to MQTT broker: %w", err)
+	}
 
+}
+
+func (c *ShellyClient) Disconnect() error {
+	if c.shelly != nil {
+		c.shelly.StopDiscovery()
+		c.shelly.Stop()
+		// Setup again with the current setup data on the next connect
+		c.shelly = nil
 	}
 
+	return nil
 }
@@ -1,8 +1,8 @@
 package tasmotaclient
 
 import (
+	"context"
 	"fmt"
-	"strconv"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -12,9 +12,12 @@ import (
 	"github.com/splattner/goucrt/pkg/tasmota"
 )
 
+// Merge attribute changes of lights, e.g. telemetry bursts, into fewer entity changes
+const entityChangeDebounce = 250 * time.Millisecond
+
 // Tasmota Implementation
 type TasmotaClient struct {
-	integration.Client
+	*integration.Client
 	tasmota *tasmota.Tasmota
 
 	mapOnState map[string]entities.LightEntityState
@@ -23,11 +26,7 @@ type TasmotaClient struct {
 func NewTasmotaClient(i *integration.Integration) *TasmotaClient {
 	tasmota := TasmotaClient{}
 
-	tasmota.IntegrationDriver = i
-	// Start without a connection
-	tasmota.DeviceState = integration.DisconnectedDeviceState
-
-	tasmota.Messages = make(chan string)
+	tasmota.Client = integration.NewClient(i, &tasmota)
 
 	ipaddr := integration.SetupDataSchemaSettings{
 		Id: "mqtt_ipaddr",
@@ -46,9 +45,11 @@ func NewTasmotaClient(i *integration.Integration) *TasmotaClient {
 		Label: integration.LanguageText{
 			En: "MQTT Broker Port",
 		},
-		Field: integration.SettingTypeText{
-			Text: integration.SettingTypeTextDefinition{
-				Value: "1883",
+		Field: integration.SettingTypeNumber{
+			Number: integration.SettingTypeNumberDefinition{
+				Value: 1883,
+				Min:   1,
+				Max:   65535,
 			},
 		},
 	}
@@ -70,8 +71,8 @@ func NewTasmotaClient(i *integration.Integration) *TasmotaClient {
 		Label: integration.LanguageText{
 			En: "MQTT Broker Password",
 		},
-		Field: integration.SettingTypeText{
-			Text: integration.SettingTypeTextDefinition{
+		Field: integration.SettingTypePassword{
+			Password: integration.SettingTypePasswordDefinition{
 				Value: "",
 			},
 		},
@@ -98,12 +99,6 @@ func NewTasmotaClient(i *integration.Integration) *TasmotaClient {
 
 	tasmota.IntegrationDriver.SetMetadata(&metadata)
 
-	// set the client specific functions
-	tasmota.InitFunc = tasmota.initTasmotaClient
-	tasmota.SetupFunc = tasmota.tasmotaHandleSetup
-	tasmota.ClientLoopFunc = tasmota.tasmotaClientLoop
-	//client.setDriverUserDataFunc = client.handleSetDriverUserData
-
 	tasmota.mapOnState = map[string]entities.LightEntityState{
 		"ON":  entities.OnLightEntityState,
 		"OFF": entities.OffLightEntityState,
@@ -112,25 +107,36 @@ func NewTasmotaClient(i *integration.Integration) *TasmotaClient {
 	return &tasmota
 }
 
-func (c *TasmotaClient) initTasmotaClient() {
-
+func (c *TasmotaClient) Init() error {
+	return nil
 }
 
-func (c *TasmotaClient) tasmotaHandleSetup(setup_data integration.SetupData) {
+func (c *TasmotaClient) Setup(ctx context.Context, setup_data integration.SetupData) error {
 	// Finish the setup
 	// Nothing to configure
 	// Setup Data already persistet by integration Driver
-	c.IntegrationDriver.SetDriverSetupState(integration.StopEvent, integration.OkState, "", nil)
+	return nil
+}
+
+// No user input is requested during setup
+func (c *TasmotaClient) UserData(userdata map[string]string, confirm bool) error {
+	return nil
 }
 
-func (c *TasmotaClient) setupTasmota() {
+func (c *TasmotaClient) setupTasmota(connectionLost chan<- error) {
 
 	if c.tasmota == nil {
 
-		if c.IntegrationDriver.SetupData["mqtt_ipaddr"] != "" {
+		setupData := c.IntegrationDriver.GetSetupData()
+
+		if setupData["mqtt_ipaddr"] != "" {
 
-			ipaddr := c.IntegrationDriver.SetupData["mqtt_ipaddr"]
-			port, _ := strconv.Atoi(c.IntegrationDriver.SetupData["mqtt_port"])
+			ipaddr := setupData["mqtt_ipaddr"]
+			port, err := setupData.Int("mqtt_port")
+			if err != nil {
+				log.WithError(err).Error("Cannot setup Tasmota Client, invalid setupData")
+				return
+			}
 			mqttBroker := fmt.Sprintf("tcp://%s:%d", ipaddr, port)
 
 			log.WithFields(log.Fields{
@@ -145,9 +151,17 @@ func (c *TasmotaClient) setupTasmota() {
 			opts.SetPingTimeout(1 * time.Second)
 			opts.SetProtocolVersion(3)
 			opts.SetOrderMatters(false)
-			if c.IntegrationDriver.SetupData["mqtt_username"] != "" && c.IntegrationDriver.SetupData["mqtt_password"] != "" {
-				opts.SetUsername(c.IntegrationDriver.SetupData["mqtt_username"])
-				opts.SetPassword(c.IntegrationDriver.SetupData["mqtt_password"])
+			// Reconnects are handled by the client with backoff and a resync of the entity states
+			opts.SetAutoReconnect(false)
+			opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+				select {
+				case connectionLost <- err:
+				default:
+				}
+			})
+			if setupData["mqtt_username"] != "" && setupData["mqtt_password"] != "" {
+				opts.SetUsername(setupData["mqtt_username"])
+				opts.SetPassword(setupData["mqtt_password"])
 			}
 
 			mqttClient := mqtt.NewClient(opts)
@@ -161,12 +175,12 @@ func (c *TasmotaClient) setupTasmota() {
 
 }
 
-func (c *TasmotaClient) startTasmota() {
+func (c *TasmotaClient) startTasmota() error {
 
 	log.Debug("Start and connect Tamota")
 
 	if err := c.tasmota.Start(); err != nil {
-		c.SetDeviceState(integration.ErrorDeviceState)
+		return err
 	}
 
 	// Handle connection to device this integration shall control
@@ -175,6 +189,7 @@ func (c *TasmotaClient) startTasmota() {
 
 	c.tasmota.StartDiscovery()
 
+	return nil
 }
 
 func (c *TasmotaClient) handleNewDeviceDiscovered(device *tasmota.TasmotaDevice) {
@@ -184,7 +199,7 @@ func (c *TasmotaClient) handleNewDeviceDiscovered(device *tasmota.TasmotaDevice)
 		"MAC Address": device.MACAddress,
 	}).Debug("New Tasmota Device discovered")
 
-	var tasmotaDevice interface{}
+	var tasmotaDevice entities.EntityInterface
 
 	switch device.LightSubtype {
 	case 0:
@@ -221,6 +236,7 @@ func (c *TasmotaClient) handleNewDeviceDiscovered(device *tasmota.TasmotaDevice)
 	case 4:
 		// RGBW
 		lightEntity_rgb := entities.NewLightEntity(device.Topic, entities.LanguageText{En: "Tasmota " + device.FriendlyName[0]}, "")
+		lightEntity_rgb.SetDebounce(entityChangeDebounce)
 
 		lightEntity_rgb.SubscribeCallbackFunc = device.Subscribe
 		lightEntity_rgb.UnsubscribeCallbackFunc = device.Unsubscribe
@@ -231,42 +247,42 @@ func (c *TasmotaClient) handleNewDeviceDiscovered(device *tasmota.TasmotaDevice)
 		lightEntity_rgb.AddFeature(entities.ColorLightEntityFeatures)
 
 		// Add commands
-		lightEntity_rgb.AddCommand(entities.OnLightEntityCommand, func(entity entities.LightEntity, params map[string]interface{}) int {
+		if err := entities.AddTypedCommand(lightEntity_rgb, entities.OnLightEntityCommand, func(onParams *entities.LightOnParams) error {
 
 			// NO param set, so just turn on
-			if len(params) == 0 {
+			if onParams.IsEmpty() {
 				if err := device.TurnOn(); err != nil {
-					return 404
+					return entities.NewDeviceUnavailableError(err)
 				}
 			} else {
-				if params["saturation"] != nil && params["hue"] != nil {
+				if onParams.Saturation != nil && onParams.Hue != nil {
 
-					hue := float32(params["hue"].(float64))
-					sat := float32(params["saturation"].(float64) / 255 * 100)
+					hue := float32(*onParams.Hue)
+					sat := float32(float64(*onParams.Saturation) / 255 * 100)
 
 					// Color Light
 					if err := device.SetHue(hue); err != nil {
-						return 404
+						return entities.NewDeviceUnavailableError(err)
 					}
 					if err := device.SetSaturation(sat); err != nil {
-						return 404
+						return entities.NewDeviceUnavailableError(err)
 					}
 
 				}
 
-				if params["brightness"] != nil {
-					bri := int(params["brightness"].(float64) / 255 * 100)
+				if onParams.Brightness != nil {
+					bri := int(float64(*onParams.Brightness) / 255 * 100)
 					if bri > 0 && device.LocalState.White == 0 {
 						// Set Brightness if not in White mode
 						if err := device.SetBrightness(bri); err != nil {
-							return 404
+							return entities.NewDeviceUnavailableError(err)
 						}
 					} else {
 
 						// When in color mode, and bri is 0, set/turn on white mode
 						// Setting white to 0 turns off the white mode and return to color mode
 						if err := device.SetWhite(bri); err != nil {
-							return 404
+							return entities.NewDeviceUnavailableError(err)
 						}
 					}
 
@@ -274,8 +290,10 @@ func (c *TasmotaClient) handleNewDeviceDiscovered(device *tasmota.TasmotaDevice)
 
 			}
 
-			return 200
-		})
+			return nil
+		}); err != nil {
+			log.WithError(err).Error("Cannot add on command")
+		}
 
 		lightEntity_rgb.MapCommand(entities.OffLightEntityCommand, device.TurnOff)
 		lightEntity_rgb.MapCommand(entities.ToggleLightEntityCommand, device.Toggle)
@@ -334,38 +352,39 @@ func (c *TasmotaClient) handleNewDeviceDiscovered(device *tasmota.TasmotaDevice)
 // }
 
 // Callen on RT connect
-func (c *TasmotaClient) tasmotaClientLoop() {
+func (c *TasmotaClient) Connect(ctx context.Context) error {
 
-	ticker := time.NewTicker(5 * time.Minute)
+	connectionLost := make(chan error, 1)
 
-	defer func() {
-		if c.tasmota != nil {
-			c.tasmota.StopDiscovery()
-			c.tasmota.Stop()
-		}
-		ticker.Stop()
-		c.SetDeviceState(integration.DisconnectedDeviceState)
-	}()
+	if c.tasmota == nil {
+		c.setupTasmota(connectionLost)
+	}
 
 	if c.tasmota == nil {
-		c.setupTasmota()
+		return nil
 	}
 
-	if c.tasmota != nil {
-		c.startTasmota()
-	} else {
-		return
+	if err := c.startTasmota(); err != nil {
+		return fmt.Errorf("cannot start Tasmota: %w", err)
 	}
 
-	// Run Client Loop to handle entity changes from device
-	for {
-		msg := <-c.Messages
+	// Run until disconnected or the connection to the broker is lost, entity changes are handled by the MQTT callbacks
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-connectionLost:
+		return fmt.Errorf("lost connection to MQTT broker: %w", err)
+	}
 
-		switch msg {
-		case "disconnect":
-			return
-		}
+}
 
+func (c *TasmotaClient) Disconnect() error {
+	if c.tasmota != nil {
+		c.tasmota.StopDiscovery()
+		c.tasmota.Stop()
+		// Setup again with the current setup data on the next connect
+		c.tasmota = nil
 	}
 
+	return nil
 }
@@ -0,0 +1,96 @@
+package multi
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	deconzclient "github.com/splattner/goucrt/pkg/clients/deconz"
+	shellyclient "github.com/splattner/goucrt/pkg/clients/shelly"
+	tasmotaclient "github.com/splattner/goucrt/pkg/clients/tasmota"
+	"github.com/splattner/goucrt/pkg/cmd"
+	"github.com/splattner/goucrt/pkg/integration"
+)
+
+func NewCommand(rootCmd *cobra.Command) *cobra.Command {
+
+	var command = &cobra.Command{
+		Use:   "multi",
+		Short: "Start several Integrations in one driver",
+		Long:  "DeCONZ, Shelly and Tasmota Integrations for a Unfolded Circle Remote Two behind one websocket endpoint",
+		Run: func(c *cobra.Command, args []string) {
+
+			log.SetOutput(os.Stdout)
+
+			debug := viper.GetBool("debug")
+			if debug {
+				log.SetLevel(log.DebugLevel)
+			} else {
+				log.SetLevel(log.InfoLevel)
+			}
+
+			var config integration.Config
+			if err := viper.Unmarshal(&config); err != nil {
+				log.WithError(err).Error("Cannot unmarshal config with viper")
+			}
+
+			i, err := integration.NewIntegration(config)
+			cmd.CheckError(err)
+
+			// Each backend gets its own client, entity ids are prefixed with the backend name
+			for _, name := range viper.GetStringSlice("backends") {
+				backend := i.AddBackend(name)
+
+				switch name {
+				case "deconz":
+					cmd.CheckError(deconzclient.NewDeconzClient(backend).InitClient())
+				case "shelly":
+					cmd.CheckError(shellyclient.NewShellyClient(backend).InitClient())
+				case "tasmota":
+					cmd.CheckError(tasmotaclient.NewTasmotaClient(backend).InitClient())
+				default:
+					cmd.Exit("Unknown backend %s, use deconz, shelly or tasmota", name)
+				}
+			}
+
+			metadata := integration.DriverMetadata{
+				DriverId: "multi",
+				Developer: integration.Developer{
+					Name: "Sebastian Plattner",
+				},
+				Name: integration.LanguageText{
+					En: "DeCONZ, Shelly and Tasmota",
+				},
+				Version: "0.2.0",
+				SetupDataSchema: i.BackendsSetupDataSchema(integration.LanguageText{
+					En: "Configuration",
+					De: "Konfiguration",
+				}),
+			}
+
+			i.SetMetadata(&metadata)
+
+			// Stop the integration gracefully on SIGINT and SIGTERM
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			cmd.CheckError(i.Run(ctx))
+
+		},
+	}
+
+	command.Flags().StringSlice("backends", []string{"deconz", "shelly", "tasmota"}, "Backends hosted by this driver")
+	if err := viper.BindPFlag("backends", command.Flags().Lookup("backends")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("backends", "UC_BACKENDS"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	return command
+}
@@ -0,0 +1,99 @@
+package replay
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/splattner/goucrt/pkg/cmd"
+	"github.com/splattner/goucrt/pkg/integration"
+	"github.com/splattner/goucrt/pkg/integration/remotetest"
+)
+
+func NewCommand(rootCmd *cobra.Command) *cobra.Command {
+
+	var command = &cobra.Command{
+		Use:   "replay <file>",
+		Short: "Replay a recorded Remote Two session against a running driver",
+		Long:  "Play back the Remote Two side of the connections in a record file against a running driver and report the responses and events that differ from the recording",
+		Args:  cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+
+			log.SetOutput(os.Stdout)
+
+			debug := viper.GetBool("debug")
+			if debug {
+				log.SetLevel(log.DebugLevel)
+			} else {
+				log.SetLevel(log.InfoLevel)
+			}
+
+			var config integration.Config
+			if err := viper.Unmarshal(&config); err != nil {
+				log.WithError(err).Error("Cannot unmarshal config with viper")
+			}
+
+			file, err := os.Open(args[0])
+			cmd.CheckError(err)
+			defer file.Close()
+
+			frames, err := integration.ReadRecording(file)
+			cmd.CheckError(err)
+
+			url := viper.GetString("url")
+			if url == "" {
+				url = fmt.Sprintf("ws://localhost:%d%s", config.ListenPort, config.WebsocketPath)
+			}
+
+			connections := remotetest.Connections(frames)
+			if conn := viper.GetString("connection"); conn != "" {
+				connections = []string{conn}
+			}
+
+			differences := 0
+			for _, conn := range connections {
+				log.WithFields(log.Fields{"Connection": conn, "URL": url}).Info("Replay connection")
+
+				remote, err := remotetest.Dial(url, config)
+				cmd.CheckError(err)
+
+				remote.Timeout = viper.GetDuration("timeout")
+
+				diffs, err := remote.Replay(remotetest.ConnectionFrames(frames, conn))
+				remote.Close()
+				cmd.CheckError(err)
+
+				for _, d := range diffs {
+					fmt.Printf("connection %s, %s\n", conn, d)
+				}
+				differences += len(diffs)
+			}
+
+			if differences > 0 {
+				cmd.Exit("%d messages differ from the recording", differences)
+			}
+
+			log.Info("Replay matches the recording")
+		},
+	}
+
+	command.Flags().String("url", "", "Websocket URL of the driver (default ws://localhost:<listenPort><websocketPath>)")
+	if err := viper.BindPFlag("url", command.Flags().Lookup("url")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+
+	command.Flags().String("connection", "", "Only replay the recorded connection with this id (default all connections)")
+	if err := viper.BindPFlag("connection", command.Flags().Lookup("connection")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+
+	command.Flags().Duration("timeout", remotetest.DefaultTimeout, "Time to wait for each recorded response or event")
+	if err := viper.BindPFlag("timeout", command.Flags().Lookup("timeout")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+
+	return command
+}
@@ -1,7 +1,10 @@
 package shelly
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 
@@ -39,9 +42,13 @@ func NewCommand(rootCmd *cobra.Command) *cobra.Command {
 
 			myclient := shellyclient.NewShellyClient(i)
 
-			myclient.InitClient()
+			cmd.CheckError(myclient.InitClient())
 
-			cmd.CheckError(i.Run())
+			// Stop the integration gracefully on SIGINT and SIGTERM
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			cmd.CheckError(i.Run(ctx))
 
 		},
 	}
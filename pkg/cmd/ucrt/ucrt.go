@@ -4,6 +4,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/splattner/goucrt/pkg/cmd/deconz"
+	"github.com/splattner/goucrt/pkg/cmd/multi"
+	"github.com/splattner/goucrt/pkg/cmd/replay"
 	"github.com/splattner/goucrt/pkg/cmd/shelly"
 	"github.com/splattner/goucrt/pkg/cmd/tasmota"
 
@@ -82,6 +84,93 @@ func NewCommand(name string) *cobra.Command {
 		log.WithError(err).Error(("Cannot BindEnv"))
 	}
 
+	rootCmd.PersistentFlags().String("authMethod", "", "Require authentication of the Remote Two with a token, either HEADER or MESSAGE based")
+	if err := viper.BindPFlag("authMethod", rootCmd.PersistentFlags().Lookup("authMethod")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("authMethod", "UC_AUTH_METHOD"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	rootCmd.PersistentFlags().String("authTokenFile", "", "File with the token the Remote Two must use to authenticate")
+	if err := viper.BindPFlag("authTokenFile", rootCmd.PersistentFlags().Lookup("authTokenFile")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("authTokenFile", "UC_AUTH_TOKEN_FILE"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	// No flag for the auth token, it would be visible in the process list
+	if err := viper.BindEnv("authToken", "UC_AUTH_TOKEN"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	rootCmd.PersistentFlags().Int("queueSize", 64, "Number of outbound messages queued per Remote Two connection")
+	if err := viper.BindPFlag("queueSize", rootCmd.PersistentFlags().Lookup("queueSize")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("queueSize", "UC_QUEUE_SIZE"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	rootCmd.PersistentFlags().String("queuePolicy", "coalesce", "What happens when the outbound queue is full: block, dropOldest or coalesce")
+	if err := viper.BindPFlag("queuePolicy", rootCmd.PersistentFlags().Lookup("queuePolicy")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("queuePolicy", "UC_QUEUE_POLICY"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	rootCmd.PersistentFlags().Bool("persistEntityState", false, "Persist the last known entity states in the configuration directory and restore them on restart")
+	if err := viper.BindPFlag("persistEntityState", rootCmd.PersistentFlags().Lookup("persistEntityState")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("persistEntityState", "UC_PERSIST_ENTITY_STATE"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	rootCmd.PersistentFlags().Bool("validateMessages", false, "Validate all websocket messages against the integration API schema and log mismatches")
+	if err := viper.BindPFlag("validateMessages", rootCmd.PersistentFlags().Lookup("validateMessages")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("validateMessages", "UC_VALIDATE_MESSAGES"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	rootCmd.PersistentFlags().String("recordFile", "", "Record all websocket frames with timestamp and connection id to this JSONL file")
+	if err := viper.BindPFlag("recordFile", rootCmd.PersistentFlags().Lookup("recordFile")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("recordFile", "UC_RECORD_FILE"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	rootCmd.PersistentFlags().Bool("adminAPI", false, "Enable the admin API to inspect entities and invoke commands, requires UC_ADMIN_TOKEN")
+	if err := viper.BindPFlag("adminAPI", rootCmd.PersistentFlags().Lookup("adminAPI")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("adminAPI", "UC_ADMIN_API"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	// No flag for the admin token, it would be visible in the process list
+	if err := viper.BindEnv("adminToken", "UC_ADMIN_TOKEN"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	rootCmd.PersistentFlags().String("secretsKeyFile", "", "File with the key to encrypt secrets of the setup data on disk")
+	if err := viper.BindPFlag("secretsKeyFile", rootCmd.PersistentFlags().Lookup("secretsKeyFile")); err != nil {
+		log.WithError(err).Error(("Cannot bindPFplag"))
+	}
+	if err := viper.BindEnv("secretsKeyFile", "UC_SECRETS_KEY_FILE"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
+	// No flag for the key itself, it would be visible in the process list
+	if err := viper.BindEnv("secretsKey", "UC_SECRETS_KEY"); err != nil {
+		log.WithError(err).Error(("Cannot BindEnv"))
+	}
+
 	rootCmd.PersistentFlags().Bool("debug", false, "Enable debug log level")
 	if err := viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug")); err != nil {
 		log.WithError(err).Error(("Cannot bindPFplag"))
@@ -99,6 +188,8 @@ func NewCommand(name string) *cobra.Command {
 		deconz.NewCommand(rootCmd),
 		shelly.NewCommand(rootCmd),
 		tasmota.NewCommand(rootCmd),
+		multi.NewCommand(rootCmd),
+		replay.NewCommand(rootCmd),
 	)
 
 	return rootCmd
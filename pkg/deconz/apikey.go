@@ -33,7 +33,7 @@ func (d *Deconz) GetNewAPIKey(devicetype string) (string, error) {
 
 	req, err := http.NewRequest("POST", url, bodyReader)
 	if err != nil {
-		log.WithError(err).Fatal("impossible to build request")
+		log.WithError(err).Error("impossible to build request")
 		return "", err
 	}
 
@@ -41,7 +41,7 @@ func (d *Deconz) GetNewAPIKey(devicetype string) (string, error) {
 	client := http.Client{Timeout: 10 * time.Second}
 	res, err := client.Do(req)
 	if err != nil {
-		log.WithError(err).Fatal("Failed to send the request")
+		log.WithError(err).Error("Failed to send the request")
 		return "", err
 	}
 
@@ -50,7 +50,7 @@ func (d *Deconz) GetNewAPIKey(devicetype string) (string, error) {
 	statusCode := res.StatusCode
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Fatalf("impossible to read all body of response: %s", err)
+		log.WithError(err).Error("impossible to read all body of response")
 		return "", err
 	}
 
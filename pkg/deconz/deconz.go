@@ -1,7 +1,9 @@
 package deconz
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -15,7 +17,9 @@ type Deconz struct {
 	// Array with all lights, groups, sensors
 	allDeconzDevices []*DeconzDevice
 
-	controlChannel chan string
+	// Cancels the running websocket listen loop
+	cancelListen context.CancelFunc
+	listenMutex  sync.Mutex
 
 	handleDeviceDiscoveredFunc func(*DeconzDevice)
 	handleDeviceRemoveFunc     func(*DeconzDevice)
@@ -30,8 +34,6 @@ func NewDeconz(host string, port int, websocketport int, apikey string) *Deconz
 	deconz.websocketport = websocketport
 	deconz.apikey = apikey
 
-	deconz.controlChannel = make(chan string)
-
 	return &deconz
 }
 
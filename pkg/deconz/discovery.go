@@ -1,18 +1,19 @@
 package deconz
 
 import (
+	"fmt"
+
 	log "github.com/sirupsen/logrus"
 )
 
 // Get All Lights, all Groupd, all Sensors
 // Add them to the available devices
-func (d *Deconz) StartDiscovery(enableGroups bool) {
+func (d *Deconz) StartDiscovery(enableGroups bool) error {
 
 	log.WithField("DeCONZ Host", d.host).Info("Starting Deconz device discovery")
 
 	if d.apikey == "" {
-		log.Fatal("API Key is not set, you first need to aquire a API Key")
-		return
+		return fmt.Errorf("API Key is not set, you first need to aquire a API Key")
 	}
 
 	// Lights
@@ -54,6 +55,8 @@ func (d *Deconz) StartDiscovery(enableGroups bool) {
 	d.removeDevice(allSensors)
 
 	log.Info("Deconz, Device Discovery finished")
+
+	return nil
 }
 
 // Handle a new discovered group
@@ -1,6 +1,7 @@
 package deconz
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -27,44 +28,85 @@ const (
 
 // Stop the listen Loop
 func (d *Deconz) Stop() {
+	d.listenMutex.Lock()
+	defer d.listenMutex.Unlock()
 
-	if d.controlChannel != nil {
-		d.controlChannel <- "stop"
+	if d.cancelListen != nil {
+		d.cancelListen()
+		d.cancelListen = nil
 	}
 
 }
 
-// Connect to DeCONZ Websocket and start listening for events
-func (d *Deconz) StartandListenLoop() {
+// Connect to DeCONZ Websocket and listen for events in the background
+// connected is called once the websocket connection is established
+// The returned channel receives the error when the loop stopped, nil when stopped with Stop
+func (d *Deconz) StartListenLoop(connected func()) <-chan error {
 
 	log.Info("Deconz, Starting Deconz Websocket Loop")
 
-	ticker := time.NewTicker(pingPeriod)
+	// Set before the loop starts, so a Stop right after this call stops the loop
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d.listenMutex.Lock()
+	d.cancelListen = cancel
+	d.listenMutex.Unlock()
+
+	listenErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		listenErr <- d.listenLoop(ctx, connected)
+	}()
+
+	return listenErr
+}
+
+// Returns when the context is cancelled or the websocket connection is lost
+func (d *Deconz) listenLoop(ctx context.Context, connected func()) error {
 
 	socketUrl := fmt.Sprintf("ws://%s:%d", d.host, d.websocketport)
 	log.WithField("SocketURL", socketUrl).Debug("Deconz,Trying to connect to Deconz Websocket")
-	ws, _, err := websocket.DefaultDialer.Dial(socketUrl, nil)
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, socketUrl, nil)
 	if err != nil {
-		log.Fatal("Deconz, Error connecting to Websocket Server:", err)
+		// Stopped while connecting
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("error connecting to deconz websocket server: %w", err)
 	}
 	log.Debugln("Deconz, Connected to Deconz websocket")
 
+	if connected != nil {
+		connected()
+	}
+
+	ticker := time.NewTicker(pingPeriod)
+
 	defer func() {
 		log.WithField("RemoteAddr", ws.RemoteAddr().String()).Info("Closing Websocket")
 		ws.Close()
 		ticker.Stop()
 	}()
 
-	go d.websocketReceiveHandler(ws)
+	readerDone := make(chan struct{})
+	go d.websocketReceiveHandler(ws, readerDone)
 
 	// Our main loop for the client
 	// We send our relevant packets here
 	log.Debugln("Deconz, Starting Deconz Websocket client main loop")
 	for {
 		select {
-		case <-d.controlChannel:
+		case <-ctx.Done():
+			log.Debug("Deconz, Stop Websocket loop")
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			if err := ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait)); err != nil {
+				log.WithError(err).Debug("Cannot send close message")
+			}
+			return nil
+
+		case <-readerDone:
 			log.Debug("Closing write loop as read loop closed")
-			return
+			return fmt.Errorf("deconz websocket connection closed")
 
 		case <-ticker.C:
 			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
@@ -72,15 +114,14 @@ func (d *Deconz) StartandListenLoop() {
 			}
 			log.WithField("RemoteAddr", ws.RemoteAddr().String()).Debug("Deconz, Send Ping Message")
 			if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.WithField("RemoteAddr", ws.RemoteAddr().String()).Info("Could not send Ping message")
-				return
+				return fmt.Errorf("could not send ping message: %w", err)
 			}
 		}
 	}
 }
 
 // Read from Websocket and process events
-func (d *Deconz) websocketReceiveHandler(ws *websocket.Conn) {
+func (d *Deconz) websocketReceiveHandler(ws *websocket.Conn, done chan struct{}) {
 
 	log.Info("Deconz, Starting Deconz Websocket receive handler")
 
@@ -98,8 +139,8 @@ func (d *Deconz) websocketReceiveHandler(ws *websocket.Conn) {
 	defer func() {
 		log.WithField("RemoteAddr", ws.RemoteAddr().String()).Info("Closing Websocket, not able to read message anymore")
 		ws.Close()
-		// Notify Write looü
-		d.controlChannel <- ws.RemoteAddr().String()
+		// Notify Write loop
+		close(done)
 	}()
 
 	for {
@@ -0,0 +1,106 @@
+package deconz
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Start a websocket server that keeps connections open until the test ends
+func newTestWebsocketServer(t *testing.T) (string, int) {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Cannot parse server address: %v", err)
+	}
+	p, _ := strconv.Atoi(port)
+
+	return host, p
+}
+
+func waitListenErr(t *testing.T, listenErr <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-listenErr:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen loop did not stop")
+		return nil
+	}
+}
+
+func TestStopRightAfterStartStopsTheListenLoop(t *testing.T) {
+	host, port := newTestWebsocketServer(t)
+	d := NewDeconz(host, 0, port, "")
+
+	listenErr := d.StartListenLoop(nil)
+	d.Stop()
+
+	if err := waitListenErr(t, listenErr); err != nil {
+		t.Errorf("Expected no error when stopped, got %v", err)
+	}
+}
+
+func TestConnectedIsCalledAfterTheDial(t *testing.T) {
+	host, port := newTestWebsocketServer(t)
+	d := NewDeconz(host, 0, port, "")
+
+	connected := make(chan struct{})
+	listenErr := d.StartListenLoop(func() { close(connected) })
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connected not called")
+	}
+
+	d.Stop()
+	if err := waitListenErr(t, listenErr); err != nil {
+		t.Errorf("Expected no error when stopped, got %v", err)
+	}
+}
+
+func TestConnectedIsNotCalledWhenTheDialFails(t *testing.T) {
+	// Nothing listens on the port of a closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	d := NewDeconz("127.0.0.1", 0, port, "")
+
+	called := false
+	listenErr := d.StartListenLoop(func() { called = true })
+
+	if err := waitListenErr(t, listenErr); err == nil {
+		t.Error("Expected a dial error")
+	}
+	if called {
+		t.Error("Connected called although the dial failed")
+	}
+}
@@ -1,5 +1,7 @@
 package entities
 
+import "fmt"
+
 type ButtonEntityState EntityState
 type ButtonEntityFeatures EntityFeature
 type ButtonEntityAttribute EntityAttribute
@@ -23,7 +25,7 @@ const (
 
 type ButtonEntity struct {
 	Entity
-	Commands map[ButtonEntityCommand]func(ButtonEntity) int `json:"-"`
+	Commands map[ButtonEntityCommand]func(ButtonEntity) error `json:"-"`
 }
 
 func NewButtonEntity(id string, name LanguageText, area string) *ButtonEntity {
@@ -35,8 +37,8 @@ func NewButtonEntity(id string, name LanguageText, area string) *ButtonEntity {
 
 	buttonEntity.EntityType.Type = "button"
 
-	buttonEntity.Commands = make(map[ButtonEntityCommand]func(ButtonEntity) int)
-	buttonEntity.Attributes = make(map[string]interface{})
+	buttonEntity.Commands = make(map[ButtonEntityCommand]func(ButtonEntity) error)
+	buttonEntity.initAttributes()
 
 	// PressButtonEntityyFeatures is always present even if not specified
 	// https://github.com/unfoldedcircle/core-api/blob/main/doc/entities/entity_button.md
@@ -47,13 +49,19 @@ func NewButtonEntity(id string, name LanguageText, area string) *ButtonEntity {
 	return &buttonEntity
 }
 
-func (e *ButtonEntity) UpdateEntity(newEntity ButtonEntity) error {
+func (e *ButtonEntity) UpdateEntity(entity EntityInterface) error {
+
+	newEntity, ok := entity.(*ButtonEntity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, entity)
+	}
 
 	e.Name = newEntity.Name
 	e.Area = newEntity.Area
 	e.Commands = newEntity.Commands
+	e.typedCommands = newEntity.typedCommands
 	e.Features = newEntity.Features
-	e.Attributes = newEntity.Attributes
+	e.replaceAttributes(newEntity.GetAttribute())
 
 	return nil
 }
@@ -65,29 +73,26 @@ func (e *ButtonEntity) AddFeature(feature ButtonEntityFeatures) {
 }
 
 // Register a function for the Entity command
-func (e *ButtonEntity) AddCommand(command ButtonEntityCommand, function func(ButtonEntity) int) {
+func (e *ButtonEntity) AddCommand(command ButtonEntityCommand, function func(ButtonEntity) error) {
 	e.Commands[command] = function
 }
 
 // Map a Light EntityCommand to a function call without params
 func (e *ButtonEntity) MapCommand(command ButtonEntityCommand, f func() error) {
 
-	e.AddCommand(command, func(entity ButtonEntity) int {
-
-		if err := f(); err != nil {
-			return 404
-		}
-		return 200
+	e.AddCommand(command, func(entity ButtonEntity) error {
+		return f()
 	})
 }
 
 // Call the registred function for this entity_command
-func (e *ButtonEntity) HandleCommand(cmd_id string) int {
+// A button has no command parameters, params are ignored
+func (e *ButtonEntity) HandleCommand(cmd_id string, params map[string]interface{}) error {
 
 	if e.Commands[ButtonEntityCommand(cmd_id)] != nil {
 		return e.Commands[ButtonEntityCommand(cmd_id)](*e)
 	}
 
-	return 404
+	return unknownCommandError(cmd_id)
 
 }
@@ -1,5 +1,7 @@
 package entities
 
+import "fmt"
+
 type ClimateEntityState EntityState
 type ClimateEntityFeatures EntityFeature
 type ClimateEntityAttributes EntityAttribute
@@ -44,7 +46,7 @@ const (
 
 type ClimateEntity struct {
 	Entity
-	Commands map[ClimateEntityCommand]func(ClimateEntity, map[string]interface{}) int `json:"-"`
+	Commands map[ClimateEntityCommand]func(ClimateEntity, map[string]interface{}) error `json:"-"`
 }
 
 func NewClimateEntity(id string, name LanguageText, area string) *ClimateEntity {
@@ -56,19 +58,25 @@ func NewClimateEntity(id string, name LanguageText, area string) *ClimateEntity
 
 	climateEntity.EntityType.Type = "climate"
 
-	climateEntity.Commands = make(map[ClimateEntityCommand]func(ClimateEntity, map[string]interface{}) int)
-	climateEntity.Attributes = make(map[string]interface{})
+	climateEntity.Commands = make(map[ClimateEntityCommand]func(ClimateEntity, map[string]interface{}) error)
+	climateEntity.initAttributes()
 
 	return &climateEntity
 }
 
-func (e *ClimateEntity) UpdateEntity(newEntity ClimateEntity) error {
+func (e *ClimateEntity) UpdateEntity(entity EntityInterface) error {
+
+	newEntity, ok := entity.(*ClimateEntity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, entity)
+	}
 
 	e.Name = newEntity.Name
 	e.Area = newEntity.Area
 	e.Commands = newEntity.Commands
+	e.typedCommands = newEntity.typedCommands
 	e.Features = newEntity.Features
-	e.Attributes = newEntity.Attributes
+	e.replaceAttributes(newEntity.GetAttribute())
 
 	return nil
 }
@@ -94,16 +102,16 @@ func (e *ClimateEntity) AddFeature(feature ClimateEntityFeatures) {
 }
 
 // Register a function for the Entity command
-func (e *ClimateEntity) AddCommand(command ClimateEntityCommand, function func(ClimateEntity, map[string]interface{}) int) {
+func (e *ClimateEntity) AddCommand(command ClimateEntityCommand, function func(ClimateEntity, map[string]interface{}) error) {
 	e.Commands[command] = function
 
 }
 
 // Call the registred function for this entity_command
-func (e *ClimateEntity) HandleCommand(cmd_id string, params map[string]interface{}) int {
+func (e *ClimateEntity) HandleCommand(cmd_id string, params map[string]interface{}) error {
 	if e.Commands[ClimateEntityCommand(cmd_id)] != nil {
 		return e.Commands[ClimateEntityCommand(cmd_id)](*e, params)
 	}
 
-	return 404
+	return unknownCommandError(cmd_id)
 }
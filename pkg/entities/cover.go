@@ -1,5 +1,7 @@
 package entities
 
+import "fmt"
+
 type CoverEntityState EntityState
 type CoverEntityFeatures EntityFeature
 type CoverEntityAttributes EntityAttribute
@@ -41,7 +43,7 @@ const (
 
 type CoverEntity struct {
 	Entity
-	Commands map[CoverEntityCommand]func(CoverEntity, map[string]interface{}) int `json:"-"`
+	Commands map[CoverEntityCommand]func(CoverEntity, map[string]interface{}) error `json:"-"`
 }
 
 func NewCoverEntity(id string, name LanguageText, area string) *CoverEntity {
@@ -53,19 +55,25 @@ func NewCoverEntity(id string, name LanguageText, area string) *CoverEntity {
 
 	coverEntity.EntityType.Type = "cover"
 
-	coverEntity.Commands = make(map[CoverEntityCommand]func(CoverEntity, map[string]interface{}) int)
-	coverEntity.Attributes = make(map[string]interface{})
+	coverEntity.Commands = make(map[CoverEntityCommand]func(CoverEntity, map[string]interface{}) error)
+	coverEntity.initAttributes()
 
 	return &coverEntity
 }
 
-func (e *CoverEntity) UpdateEntity(newEntity CoverEntity) error {
+func (e *CoverEntity) UpdateEntity(entity EntityInterface) error {
+
+	newEntity, ok := entity.(*CoverEntity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, entity)
+	}
 
 	e.Name = newEntity.Name
 	e.Area = newEntity.Area
 	e.Commands = newEntity.Commands
+	e.typedCommands = newEntity.typedCommands
 	e.Features = newEntity.Features
-	e.Attributes = newEntity.Attributes
+	e.replaceAttributes(newEntity.GetAttribute())
 
 	return nil
 
@@ -100,16 +108,16 @@ func (e *CoverEntity) AddFeature(feature CoverEntityFeatures) {
 }
 
 // Register a function for the Entity command
-func (e *CoverEntity) AddCommand(command CoverEntityCommand, function func(CoverEntity, map[string]interface{}) int) {
+func (e *CoverEntity) AddCommand(command CoverEntityCommand, function func(CoverEntity, map[string]interface{}) error) {
 	e.Commands[command] = function
 
 }
 
 // Call the registred function for this entity_command
-func (e *CoverEntity) HandleCommand(cmd_id string, params map[string]interface{}) int {
+func (e *CoverEntity) HandleCommand(cmd_id string, params map[string]interface{}) error {
 	if e.Commands[CoverEntityCommand(cmd_id)] != nil {
 		return e.Commands[CoverEntityCommand(cmd_id)](*e, params)
 	}
 
-	return 404
+	return unknownCommandError(cmd_id)
 }
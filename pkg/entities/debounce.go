@@ -0,0 +1,48 @@
+package entities
+
+import (
+	"sync"
+	"time"
+)
+
+// Merges attribute changes and passes them on once the delay passed since the first change
+type debouncer struct {
+	mu         sync.Mutex
+	delay      time.Duration
+	timer      *time.Timer
+	attributes map[string]interface{}
+}
+
+func newDebouncer(delay time.Duration) *debouncer {
+	return &debouncer{
+		delay: delay,
+	}
+}
+
+// Merge changed attributes, f is called with all merged attributes after the delay
+func (d *debouncer) add(attributes map[string]interface{}, f func(map[string]interface{})) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.attributes == nil {
+		d.attributes = make(map[string]interface{})
+	}
+
+	for k, v := range attributes {
+		d.attributes[k] = v
+	}
+
+	if d.timer != nil {
+		return
+	}
+
+	d.timer = time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		merged := d.attributes
+		d.attributes = nil
+		d.timer = nil
+		d.mu.Unlock()
+
+		f(merged)
+	})
+}
@@ -1,6 +1,12 @@
 package entities
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -15,20 +21,45 @@ const (
 	UnkownEntityState      EntityState = "UNKNOWN"
 )
 
+// Common interface implemented by all Remote Two entities
+// Custom entity types can embed Entity and override HandleCommand / UpdateEntity
+// to be usable by the integration
+type EntityInterface interface {
+	GetId() string
+	SetId(id string)
+	GetDeviceId() string
+	GetEntityType() EntityType
+	GetAttribute() map[string]interface{}
+	GetEntityState() *EntityStateData
+	SetHandleEntityChangeFunc(func(EntityInterface, *map[string]interface{}))
+	CallSubscribeCallback()
+	CallUnsubscribeCallback()
+	HandleCommand(cmd_id string, params map[string]interface{}) error
+	HandleDecodedCommand(cmd_id string, params map[string]interface{}, decoded CommandParams) (bool, error)
+	UpdateEntity(newEntity EntityInterface) error
+	RestoreAttributes(attributes map[string]interface{})
+	StaleAttributes() []string
+}
+
 // Generic Remote Two Entity
 // See https://github.com/unfoldedcircle/core-api/blob/main/doc/entities/README.md for details
 type Entity struct {
 	Id string `json:"entity_id"`
 	EntityType
-	DeviceId                string                                     `json:"device_id,omitempty"`
-	Features                []interface{}                              `json:"features"`
-	Name                    LanguageText                               `json:"name"`
-	Area                    string                                     `json:"area,omitempty"`
-	DeviceClass             string                                     `json:"-"`
-	Attributes              map[string]interface{}                     `json:"-"`
-	handleEntityChangeFunc  func(interface{}, *map[string]interface{}) `json:"-"`
-	SubscribeCallbackFunc   func()                                     `json:"-"`
-	UnsubscribeCallbackFunc func()                                     `json:"-"`
+	DeviceId                string                 `json:"device_id,omitempty"`
+	Features                []interface{}          `json:"features"`
+	Name                    LanguageText           `json:"name"`
+	Area                    string                 `json:"area,omitempty"`
+	DeviceClass             string                 `json:"-"`
+	Attributes              map[string]interface{} `json:"-"`
+	attributesMutex         *sync.RWMutex
+	staleAttributes         map[string]bool
+	setAttributes           map[string]bool
+	debouncer               *debouncer
+	typedCommands           map[string]func(CommandParams) error
+	handleEntityChangeFunc  func(EntityInterface, *map[string]interface{}) `json:"-"`
+	SubscribeCallbackFunc   func()                                         `json:"-"`
+	UnsubscribeCallbackFunc func()                                         `json:"-"`
 }
 
 type EntityType struct {
@@ -42,6 +73,26 @@ type EntityStateData struct {
 	Attributes map[string]interface{} `json:"attributes"`
 }
 
+// Return the ID of the entity
+func (e *Entity) GetId() string {
+	return e.Id
+}
+
+// Change the ID of the entity, e.g. to namespace it before it is added to the integration
+func (e *Entity) SetId(id string) {
+	e.Id = id
+}
+
+// Return the DeviceId of the entity
+func (e *Entity) GetDeviceId() string {
+	return e.DeviceId
+}
+
+// Return the EntityType of the entity
+func (e *Entity) GetEntityType() EntityType {
+	return e.EntityType
+}
+
 func (e *Entity) HasFeature(feature interface{}) bool {
 	for _, f := range e.Features {
 		if f == feature {
@@ -51,12 +102,162 @@ func (e *Entity) HasFeature(feature interface{}) bool {
 	return false
 }
 
+// Guards the mutex initialisation of entities not created by a constructor
+var attributesMutexInit sync.Mutex
+
+// Return the mutex guarding the Attributes of this entity
+func (e *Entity) attributesLock() *sync.RWMutex {
+	attributesMutexInit.Lock()
+	defer attributesMutexInit.Unlock()
+
+	if e.attributesMutex == nil {
+		e.attributesMutex = &sync.RWMutex{}
+	}
+
+	return e.attributesMutex
+}
+
+// Initialize the Attributes of a new entity
+func (e *Entity) initAttributes() {
+	e.attributesMutex = &sync.RWMutex{}
+	e.Attributes = make(map[string]interface{})
+}
+
+// Return a snapshot of the current attributes
 func (e *Entity) GetAttribute() map[string]interface{} {
-	return e.Attributes
+	mu := e.attributesLock()
+	mu.RLock()
+	defer mu.RUnlock()
+
+	attributes := make(map[string]interface{}, len(e.Attributes))
+	for k, v := range e.Attributes {
+		attributes[k] = v
+	}
+
+	return attributes
+}
+
+// Check if an attribute is available
+func (e *Entity) hasAttribute(name string) bool {
+	mu := e.attributesLock()
+	mu.RLock()
+	defer mu.RUnlock()
+
+	_, ok := e.Attributes[name]
+
+	return ok
+}
+
+// Update an attribute if its available
+// This does not emit a entity change event
+func (e *Entity) updateAttribute(name string, value interface{}) {
+	mu := e.attributesLock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := e.Attributes[name]; ok {
+		e.Attributes[name] = value
+		e.markAttributeSet(name)
+	}
+}
+
+// Remember that the driver set the value of an attribute, restored values must not overwrite it
+// Must be called with the attributes lock held
+func (e *Entity) markAttributeSet(name string) {
+	if e.setAttributes == nil {
+		e.setAttributes = make(map[string]bool)
+	}
+	e.setAttributes[name] = true
+	delete(e.staleAttributes, name)
+}
+
+// Replace all attributes with a copy of the given attributes
+func (e *Entity) replaceAttributes(attributes map[string]interface{}) {
+	mu := e.attributesLock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	e.Attributes = make(map[string]interface{}, len(attributes))
+	for k, v := range attributes {
+		e.Attributes[k] = v
+	}
+}
+
+// Restore the last known values of available attributes, e.g. after a restart
+// Attributes the driver already set with SetAttributes or UpdateAttribute keep their value
+// Restored attributes are stale until they are set again with SetAttributes
+// The stale flag is internal, the Remote Two gets restored values like any other value
+// This does not emit a entity change event
+func (e *Entity) RestoreAttributes(attributes map[string]interface{}) {
+	mu := e.attributesLock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	for k, v := range attributes {
+		current, ok := e.Attributes[k]
+		if !ok || e.setAttributes[k] {
+			continue
+		}
+
+		if e.staleAttributes == nil {
+			e.staleAttributes = make(map[string]bool)
+		}
+
+		e.Attributes[k] = restoredValue(current, v)
+		e.staleAttributes[k] = true
+	}
+}
+
+// Return the attributes with a restored value not yet confirmed by the device
+func (e *Entity) StaleAttributes() []string {
+	mu := e.attributesLock()
+	mu.RLock()
+	defer mu.RUnlock()
+
+	stale := make([]string, 0, len(e.staleAttributes))
+	for k := range e.staleAttributes {
+		stale = append(stale, k)
+	}
+	sort.Strings(stale)
+
+	return stale
+}
+
+// Convert a restored value to the type of the current value
+// Persisted values lose their type, e.g. numbers are restored as float64
+func restoredValue(current interface{}, restored interface{}) interface{} {
+	cv := reflect.ValueOf(current)
+	rv := reflect.ValueOf(restored)
+	if !cv.IsValid() || !rv.IsValid() {
+		return restored
+	}
+
+	if (rv.Kind() == cv.Kind() || (isNumber(rv.Kind()) && isNumber(cv.Kind()))) && rv.CanConvert(cv.Type()) {
+		return rv.Convert(cv.Type()).Interface()
+	}
+
+	return restored
+}
+
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
 }
 
 // Add an attribute if not already available
 func (e *Entity) AddAttribute(name string, value interface{}) {
+	mu := e.attributesLock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	if e.Attributes == nil {
+		e.Attributes = make(map[string]interface{})
+	}
 
 	if _, ok := e.Attributes[name]; !ok {
 		log.WithFields(log.Fields{
@@ -74,7 +275,7 @@ func (e *Entity) GetEntityState() *EntityStateData {
 		DeviceId:   e.DeviceId,
 		EntityType: e.EntityType,
 		EntityId:   e.Id,
-		Attributes: e.Attributes,
+		Attributes: e.GetAttribute(),
 	}
 
 	return &entityState
@@ -83,7 +284,11 @@ func (e *Entity) GetEntityState() *EntityStateData {
 // Register the function that is called when a Attribute change
 // This normally is set by the integration when the entity is added
 // To send entity_change events to Remote two
-func (e *Entity) SetHandleEntityChangeFunc(f func(interface{}, *map[string]interface{})) {
+func (e *Entity) SetHandleEntityChangeFunc(f func(EntityInterface, *map[string]interface{})) {
+	mu := e.attributesLock()
+	mu.Lock()
+	defer mu.Unlock()
+
 	e.handleEntityChangeFunc = f
 }
 
@@ -97,6 +302,85 @@ func (e *Entity) SetUnsubscribeCallbackFunc(f func()) {
 	e.UnsubscribeCallbackFunc = f
 }
 
+// Call the function registred for when RT subscribes to this entity
+func (e *Entity) CallSubscribeCallback() {
+	if e.SubscribeCallbackFunc != nil {
+		e.SubscribeCallbackFunc()
+	}
+}
+
+// Call the function registred for when RT unsubscribes from this entity
+func (e *Entity) CallUnsubscribeCallback() {
+	if e.UnsubscribeCallbackFunc != nil {
+		e.UnsubscribeCallbackFunc()
+	}
+}
+
+// A generic entity has no commands
+// Entity types with commands override this function
+func (e *Entity) HandleCommand(cmd_id string, params map[string]interface{}) error {
+	return unknownCommandError(cmd_id)
+}
+
+// Call the function registered with AddTypedCommand for this entity_command
+// Returns false if no typed function is registered, the command is then handled by HandleCommand
+func (e *Entity) HandleDecodedCommand(cmd_id string, params map[string]interface{}, decoded CommandParams) (bool, error) {
+	f, ok := e.typedCommands[cmd_id]
+	if !ok || decoded == nil {
+		return false, nil
+	}
+
+	return true, f(decoded)
+}
+
+func (e *Entity) addTypedCommand(cmd_id string, f func(CommandParams) error) {
+	if e.typedCommands == nil {
+		e.typedCommands = make(map[string]func(CommandParams) error)
+	}
+	e.typedCommands[cmd_id] = f
+}
+
+// Entities that accept functions with typed params for their commands
+type typedCommandEntity interface {
+	GetEntityType() EntityType
+	addTypedCommand(cmd_id string, f func(CommandParams) error)
+}
+
+// Register a function for an entity command that gets the decoded and validated params
+// P is the params type of the command, see DecodeCommandParams
+// A typed function takes precedence over a function registered with AddCommand
+func AddTypedCommand[C ~string, P CommandParams](e typedCommandEntity, command C, f func(P) error) error {
+	newParams, ok := commandParams[e.GetEntityType().Type][string(command)]
+	if !ok {
+		return fmt.Errorf("command %s of %s entities has no params", command, e.GetEntityType().Type)
+	}
+	if _, ok := newParams().(P); !ok {
+		return fmt.Errorf("params of command %s are of type %T", command, newParams())
+	}
+
+	e.addTypedCommand(string(command), func(p CommandParams) error {
+		return f(p.(P))
+	})
+
+	return nil
+}
+
+// Update the generic fields of the entity with those of a new entity
+func (e *Entity) UpdateEntity(newEntity EntityInterface) error {
+	n, ok := newEntity.(*Entity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, newEntity)
+	}
+
+	e.Name = n.Name
+	e.Area = n.Area
+	e.Features = n.Features
+	e.typedCommands = n.typedCommands
+	e.replaceAttributes(n.GetAttribute())
+
+	return nil
+}
+
 // Set one attribute for the Entity
 func (e *Entity) SetAttribute(attribute MediaPlayerEntityAttributes, value interface{}) {
 
@@ -106,18 +390,70 @@ func (e *Entity) SetAttribute(attribute MediaPlayerEntityAttributes, value inter
 }
 
 // Set attributes for the Entity and then call the EntityChange Function
+// Only attributes whose value actually changed are passed on, nothing is sent if no attribute changed
+// With a debounce delay set, changes are merged and passed on once the delay passed
 func (e *Entity) SetAttributes(attributes map[string]interface{}) {
 
+	mu := e.attributesLock()
+	mu.Lock()
+	changed := make(map[string]interface{})
+	for k, v := range attributes {
+		// The device confirmed the value
+		e.markAttributeSet(k)
+
+		if current, ok := e.Attributes[k]; ok && reflect.DeepEqual(current, v) {
+			continue
+		}
+		e.Attributes[k] = v
+		changed[k] = v
+	}
+	handleEntityChangeFunc := e.handleEntityChangeFunc
+	debouncer := e.debouncer
+	mu.Unlock()
+
+	if len(changed) == 0 {
+		log.WithField("entity_id", e.Id).Trace("No attribute changed")
+		return
+	}
+
 	log.WithFields(log.Fields{
 		"entity_id":  e.Id,
-		"attributes": attributes}).Info("Handle attribute change")
+		"attributes": changed}).Info("Handle attribute change")
 
-	for k, v := range attributes {
-		e.Attributes[k] = v
+	if debouncer != nil {
+		debouncer.add(changed, e.handleDebouncedChange)
+		return
 	}
 
 	// Handle the entity Change
-	if e.handleEntityChangeFunc != nil {
-		e.handleEntityChangeFunc(e, &attributes)
+	if handleEntityChangeFunc != nil {
+		handleEntityChangeFunc(e, &changed)
+	}
+}
+
+// Merge attribute changes for the given delay before the EntityChange Function is called
+// Useful for chatty sources, e.g. brightness ramps. A delay of 0 disables debouncing
+func (e *Entity) SetDebounce(delay time.Duration) {
+	mu := e.attributesLock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	if delay <= 0 {
+		e.debouncer = nil
+		return
+	}
+
+	e.debouncer = newDebouncer(delay)
+}
+
+// Call the EntityChange Function with the merged changes of the debounce delay
+func (e *Entity) handleDebouncedChange(changed map[string]interface{}) {
+	mu := e.attributesLock()
+	mu.RLock()
+	handleEntityChangeFunc := e.handleEntityChangeFunc
+	mu.RUnlock()
+
+	if handleEntityChangeFunc != nil {
+		handleEntityChangeFunc(e, &changed)
 	}
 }
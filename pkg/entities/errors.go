@@ -0,0 +1,78 @@
+package entities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Error returned by a command function
+// The Code is used as response code of the entity_command request
+type CommandError struct {
+	Code int
+	Err  error
+}
+
+func (e *CommandError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("command failed with code %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// The command params are invalid
+func NewBadRequestError(err error) error {
+	return &CommandError{Code: 400, Err: err}
+}
+
+// The command or the device does not exist
+func NewNotFoundError(err error) error {
+	return &CommandError{Code: 404, Err: err}
+}
+
+// The device cannot be reached
+func NewDeviceUnavailableError(err error) error {
+	return &CommandError{Code: 503, Err: err}
+}
+
+// The device did not respond in time
+func NewTimeoutError(err error) error {
+	return &CommandError{Code: 408, Err: err}
+}
+
+// Any other error while executing the command
+func NewInternalError(err error) error {
+	return &CommandError{Code: 500, Err: err}
+}
+
+// Return the response code for the error of a command function
+// Errors that are not a CommandError are internal errors
+func CommandErrorCode(err error) int {
+	if err == nil {
+		return 200
+	}
+
+	var commandErr *CommandError
+	if errors.As(err, &commandErr) {
+		return commandErr.Code
+	}
+
+	var paramsErr *ParamsError
+	if errors.As(err, &paramsErr) {
+		return 400
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 408
+	}
+
+	return 500
+}
+
+func unknownCommandError(cmd_id string) error {
+	return NewNotFoundError(fmt.Errorf("unknown command %s", cmd_id))
+}
@@ -1,6 +1,8 @@
 package entities
 
 import (
+	"fmt"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,7 +42,7 @@ const (
 
 type LightEntity struct {
 	Entity
-	Commands map[LightEntityCommand]func(LightEntity, map[string]interface{}) int `json:"-"`
+	Commands map[LightEntityCommand]func(LightEntity, map[string]interface{}) error `json:"-"`
 }
 
 func NewLightEntity(id string, name LanguageText, area string) *LightEntity {
@@ -57,19 +59,25 @@ func NewLightEntity(id string, name LanguageText, area string) *LightEntity {
 
 	lightEntity.EntityType.Type = "light"
 
-	lightEntity.Commands = make(map[LightEntityCommand]func(LightEntity, map[string]interface{}) int)
-	lightEntity.Attributes = make(map[string]interface{})
+	lightEntity.Commands = make(map[LightEntityCommand]func(LightEntity, map[string]interface{}) error)
+	lightEntity.initAttributes()
 
 	return &lightEntity
 }
 
-func (e *LightEntity) UpdateEntity(newEntity LightEntity) error {
+func (e *LightEntity) UpdateEntity(entity EntityInterface) error {
+
+	newEntity, ok := entity.(*LightEntity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, entity)
+	}
 
 	e.Name = newEntity.Name
 	e.Area = newEntity.Area
 	e.Commands = newEntity.Commands
+	e.typedCommands = newEntity.typedCommands
 	e.Features = newEntity.Features
-	e.Attributes = newEntity.Attributes
+	e.replaceAttributes(newEntity.GetAttribute())
 
 	return nil
 }
@@ -99,7 +107,7 @@ func (e *LightEntity) AddFeature(feature LightEntityFeatures) {
 }
 
 // Register a function for the Entity command
-func (e *LightEntity) AddCommand(command LightEntityCommand, function func(LightEntity, map[string]interface{}) int) {
+func (e *LightEntity) AddCommand(command LightEntityCommand, function func(LightEntity, map[string]interface{}) error) {
 	e.Commands[command] = function
 
 }
@@ -107,47 +115,34 @@ func (e *LightEntity) AddCommand(command LightEntityCommand, function func(Light
 // Map a Light EntityCommand to a function call with params
 func (e *LightEntity) MapCommandWithParams(command LightEntityCommand, f func(map[string]interface{}) error) {
 
-	e.AddCommand(command, func(entity LightEntity, params map[string]interface{}) int {
-
-		if err := f(params); err != nil {
-			return 404
-		}
-		return 200
+	e.AddCommand(command, func(entity LightEntity, params map[string]interface{}) error {
+		return f(params)
 	})
 }
 
 // Map a Light EntityCommand to a function call without params
 func (e *LightEntity) MapCommand(command LightEntityCommand, f func() error) {
 
-	e.AddCommand(command, func(entity LightEntity, params map[string]interface{}) int {
-
-		if err := f(); err != nil {
-			return 404
-		}
-		return 200
+	e.AddCommand(command, func(entity LightEntity, params map[string]interface{}) error {
+		return f()
 	})
 }
 
 // Call the registred function for this entity_command
-func (e *LightEntity) HandleCommand(cmd_id string, params map[string]interface{}) int {
+func (e *LightEntity) HandleCommand(cmd_id string, params map[string]interface{}) error {
 	if e.Commands[LightEntityCommand(cmd_id)] != nil {
 		return e.Commands[LightEntityCommand(cmd_id)](*e, params)
 	}
 
-	return 404
+	return unknownCommandError(cmd_id)
 }
 
 // Check if an Attribute is available
 func (e *LightEntity) HasAttribute(attribute LightEntityAttributes) bool {
-	_, ok := e.Attributes[string(attribute)]
-
-	return ok
+	return e.hasAttribute(string(attribute))
 }
 
 // Update an Attribute if its available
 func (e *LightEntity) UpdateAttribute(attribute LightEntityAttributes, value interface{}) {
-
-	if e.HasAttribute(attribute) {
-		e.Attributes[string(attribute)] = value
-	}
+	e.updateAttribute(string(attribute), value)
 }
@@ -1,6 +1,9 @@
 package entities
 
-import "slices"
+import (
+	"fmt"
+	"slices"
+)
 
 type MediaPlayerEntityState EntityState
 type MediaPlayerEntityFeatures EntityFeature
@@ -155,8 +158,8 @@ const (
 type MediaPlayerEntity struct {
 	Entity
 	DeviceClass MediaPlayerDeviceClass
-	Commands    map[MediaPlayerEntityCommand]func(MediaPlayerEntity, map[string]interface{}) int `json:"-"`
-	Options     map[MediaPlayerEntityOption]interface{}                                          `json:"options"`
+	Commands    map[MediaPlayerEntityCommand]func(MediaPlayerEntity, map[string]interface{}) error `json:"-"`
+	Options     map[MediaPlayerEntityOption]interface{}                                            `json:"options"`
 }
 
 func NewMediaPlayerEntity(id string, name LanguageText, area string, deviceClass MediaPlayerDeviceClass) *MediaPlayerEntity {
@@ -169,21 +172,27 @@ func NewMediaPlayerEntity(id string, name LanguageText, area string, deviceClass
 
 	mediaPlayerEntity.EntityType.Type = "media_player"
 
-	mediaPlayerEntity.Commands = make(map[MediaPlayerEntityCommand]func(MediaPlayerEntity, map[string]interface{}) int)
-	mediaPlayerEntity.Attributes = make(map[string]interface{})
+	mediaPlayerEntity.Commands = make(map[MediaPlayerEntityCommand]func(MediaPlayerEntity, map[string]interface{}) error)
+	mediaPlayerEntity.initAttributes()
 
 	mediaPlayerEntity.Options = make(map[MediaPlayerEntityOption]interface{})
 
 	return &mediaPlayerEntity
 }
 
-func (e *MediaPlayerEntity) UpdateEntity(newEntity MediaPlayerEntity) error {
+func (e *MediaPlayerEntity) UpdateEntity(entity EntityInterface) error {
+
+	newEntity, ok := entity.(*MediaPlayerEntity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, entity)
+	}
 
 	e.Name = newEntity.Name
 	e.Area = newEntity.Area
 	e.Commands = newEntity.Commands
+	e.typedCommands = newEntity.typedCommands
 	e.Features = newEntity.Features
-	e.Attributes = newEntity.Attributes
+	e.replaceAttributes(newEntity.GetAttribute())
 
 	return nil
 }
@@ -289,7 +298,7 @@ func (e *MediaPlayerEntity) AddFeature(feature MediaPlayerEntityFeatures) {
 }
 
 // Register a function for the Entity command
-func (e *MediaPlayerEntity) AddCommand(command MediaPlayerEntityCommand, function func(MediaPlayerEntity, map[string]interface{}) int) {
+func (e *MediaPlayerEntity) AddCommand(command MediaPlayerEntityCommand, function func(MediaPlayerEntity, map[string]interface{}) error) {
 	e.Commands[command] = function
 
 }
@@ -297,29 +306,21 @@ func (e *MediaPlayerEntity) AddCommand(command MediaPlayerEntityCommand, functio
 // Map a Light EntityCommand to a function call with params
 func (e *MediaPlayerEntity) MapCommandWithParams(command MediaPlayerEntityCommand, f func(map[string]interface{}) error) {
 
-	e.AddCommand(command, func(entity MediaPlayerEntity, params map[string]interface{}) int {
-
-		if err := f(params); err != nil {
-			return 404
-		}
-		return 200
+	e.AddCommand(command, func(entity MediaPlayerEntity, params map[string]interface{}) error {
+		return f(params)
 	})
 }
 
 // Map a Light EntityCommand to a function call without params
 func (e *MediaPlayerEntity) MapCommand(command MediaPlayerEntityCommand, f func() error) {
 
-	e.AddCommand(command, func(entity MediaPlayerEntity, params map[string]interface{}) int {
-
-		if err := f(); err != nil {
-			return 404
-		}
-		return 200
+	e.AddCommand(command, func(entity MediaPlayerEntity, params map[string]interface{}) error {
+		return f()
 	})
 }
 
 // Call the registred function for this entity_command
-func (e *MediaPlayerEntity) HandleCommand(cmd_id string, params map[string]interface{}) int {
+func (e *MediaPlayerEntity) HandleCommand(cmd_id string, params map[string]interface{}) error {
 	if e.Commands[MediaPlayerEntityCommand(cmd_id)] != nil {
 		return e.Commands[MediaPlayerEntityCommand(cmd_id)](*e, params)
 	}
@@ -333,7 +334,7 @@ func (e *MediaPlayerEntity) HandleCommand(cmd_id string, params map[string]inter
 		}
 	}
 
-	return 404
+	return unknownCommandError(cmd_id)
 }
 
 // Add an option to the MediaPlayer Entity
@@ -0,0 +1,425 @@
+package entities
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Typed parameters of an entity_command
+// See https://github.com/unfoldedcircle/core-api/tree/main/doc/entities for the parameters of each command
+type CommandParams interface {
+	// Check the decoded values, e.g. ranges
+	Validate() error
+}
+
+// Invalid parameters of an entity_command
+type ParamsError struct {
+	Param  string
+	Reason string
+}
+
+func (e *ParamsError) Error() string {
+	if e.Param == "" {
+		return fmt.Sprintf("invalid params: %s", e.Reason)
+	}
+	return fmt.Sprintf("invalid param %s: %s", e.Param, e.Reason)
+}
+
+// Params of the light on command
+type LightOnParams struct {
+	Brightness       *int `json:"brightness,omitempty"`
+	Hue              *int `json:"hue,omitempty"`
+	Saturation       *int `json:"saturation,omitempty"`
+	ColorTemperature *int `json:"color_temperature,omitempty"`
+}
+
+// True if no param is set, the light is just turned on
+func (p *LightOnParams) IsEmpty() bool {
+	return p.Brightness == nil && p.Hue == nil && p.Saturation == nil && p.ColorTemperature == nil
+}
+
+func (p *LightOnParams) Validate() error {
+	if err := checkRange("brightness", p.Brightness, 0, 255); err != nil {
+		return err
+	}
+	if err := checkRange("hue", p.Hue, 0, 360); err != nil {
+		return err
+	}
+	if err := checkRange("saturation", p.Saturation, 0, 255); err != nil {
+		return err
+	}
+	return checkRange("color_temperature", p.ColorTemperature, 0, 100)
+}
+
+// Params of the cover position command
+type CoverPositionParams struct {
+	Position *int `json:"position"`
+}
+
+func (p *CoverPositionParams) Validate() error {
+	if p.Position == nil {
+		return &ParamsError{Param: "position", Reason: "missing"}
+	}
+	return checkRange("position", p.Position, 0, 100)
+}
+
+// Params of the cover tilt command
+type CoverTiltParams struct {
+	Tilt *int `json:"tilt_position"`
+}
+
+func (p *CoverTiltParams) Validate() error {
+	if p.Tilt == nil {
+		return &ParamsError{Param: "tilt_position", Reason: "missing"}
+	}
+	return checkRange("tilt_position", p.Tilt, 0, 100)
+}
+
+// HVAC modes of a climate entity
+var climateHVACModes = []string{"OFF", "HEAT", "COOL", "HEAT_COOL", "FAN", "AUTO"}
+
+// Params of the climate hvac_mode command
+type ClimateHVACModeParams struct {
+	HVACMode    string   `json:"hvac_mode"`
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+func (p *ClimateHVACModeParams) Validate() error {
+	for _, mode := range climateHVACModes {
+		if strings.EqualFold(mode, p.HVACMode) {
+			return nil
+		}
+	}
+	return &ParamsError{Param: "hvac_mode", Reason: fmt.Sprintf("must be one of %s", strings.Join(climateHVACModes, ", "))}
+}
+
+// Params of the climate target_temperature command
+type ClimateTargetTemperatureParams struct {
+	Temperature *float64 `json:"temperature"`
+}
+
+func (p *ClimateTargetTemperatureParams) Validate() error {
+	if p.Temperature == nil {
+		return &ParamsError{Param: "temperature", Reason: "missing"}
+	}
+	return nil
+}
+
+// Params of the climate target_temperature_range command
+type ClimateTargetTemperatureRangeParams struct {
+	TargetTemperatureHigh *float64 `json:"target_temperature_high"`
+	TargetTemperatureLow  *float64 `json:"target_temperature_low"`
+}
+
+func (p *ClimateTargetTemperatureRangeParams) Validate() error {
+	if p.TargetTemperatureHigh == nil {
+		return &ParamsError{Param: "target_temperature_high", Reason: "missing"}
+	}
+	if p.TargetTemperatureLow == nil {
+		return &ParamsError{Param: "target_temperature_low", Reason: "missing"}
+	}
+	if *p.TargetTemperatureLow > *p.TargetTemperatureHigh {
+		return &ParamsError{Param: "target_temperature_low", Reason: "must not be greater than target_temperature_high"}
+	}
+	return nil
+}
+
+// Params of the climate fan_mode command
+type ClimateFanModeParams struct {
+	FanMode string `json:"fan_mode"`
+}
+
+func (p *ClimateFanModeParams) Validate() error {
+	if p.FanMode == "" {
+		return &ParamsError{Param: "fan_mode", Reason: "missing"}
+	}
+	return nil
+}
+
+// Params of the media player volume command
+type MediaPlayerVolumeParams struct {
+	Volume *int `json:"volume"`
+}
+
+func (p *MediaPlayerVolumeParams) Validate() error {
+	if p.Volume == nil {
+		return &ParamsError{Param: "volume", Reason: "missing"}
+	}
+	return checkRange("volume", p.Volume, 0, 100)
+}
+
+// Params of the media player seek command
+type MediaPlayerSeekParams struct {
+	MediaPosition *int `json:"media_position"`
+}
+
+func (p *MediaPlayerSeekParams) Validate() error {
+	if p.MediaPosition == nil {
+		return &ParamsError{Param: "media_position", Reason: "missing"}
+	}
+	if *p.MediaPosition < 0 {
+		return &ParamsError{Param: "media_position", Reason: "must not be negative"}
+	}
+	return nil
+}
+
+// Repeat modes of a media player
+var mediaPlayerRepeatModes = []string{"OFF", "ALL", "ONE"}
+
+// Params of the media player repeat command
+type MediaPlayerRepeatParams struct {
+	Repeat string `json:"repeat"`
+}
+
+func (p *MediaPlayerRepeatParams) Validate() error {
+	for _, mode := range mediaPlayerRepeatModes {
+		if strings.EqualFold(mode, p.Repeat) {
+			return nil
+		}
+	}
+	return &ParamsError{Param: "repeat", Reason: fmt.Sprintf("must be one of %s", strings.Join(mediaPlayerRepeatModes, ", "))}
+}
+
+// Params of the media player shuffle command
+type MediaPlayerShuffleParams struct {
+	Shuffle *bool `json:"shuffle"`
+}
+
+func (p *MediaPlayerShuffleParams) Validate() error {
+	if p.Shuffle == nil {
+		return &ParamsError{Param: "shuffle", Reason: "missing"}
+	}
+	return nil
+}
+
+// Params of the media player select_source command
+type MediaPlayerSelectSourceParams struct {
+	Source string `json:"source"`
+}
+
+func (p *MediaPlayerSelectSourceParams) Validate() error {
+	if p.Source == "" {
+		return &ParamsError{Param: "source", Reason: "missing"}
+	}
+	return nil
+}
+
+// Params of the media player select_sound_mode command
+type MediaPlayerSelectSoundModeParams struct {
+	Mode string `json:"mode"`
+}
+
+func (p *MediaPlayerSelectSoundModeParams) Validate() error {
+	if p.Mode == "" {
+		return &ParamsError{Param: "mode", Reason: "missing"}
+	}
+	return nil
+}
+
+const (
+	// Maximum repeat count of remote commands
+	maxRemoteRepeat = 20
+	// Maximum delay and hold time of remote commands in ms
+	maxRemoteDelay = 60000
+)
+
+// Params of the remote send_cmd command
+type RemoteSendCmdParams struct {
+	Command string `json:"command"`
+	Repeat  *int   `json:"repeat,omitempty"`
+	Delay   *int   `json:"delay,omitempty"`
+	Hold    *int   `json:"hold,omitempty"`
+}
+
+func (p *RemoteSendCmdParams) Validate() error {
+	if p.Command == "" {
+		return &ParamsError{Param: "command", Reason: "missing"}
+	}
+	return validateRemoteTiming(p.Repeat, p.Delay, p.Hold)
+}
+
+// Number of times the command is sent, 1 if not set
+func (p *RemoteSendCmdParams) RepeatCount() int {
+	if p.Repeat == nil {
+		return 1
+	}
+	return *p.Repeat
+}
+
+// Delay between repeated commands in ms, 0 if not set
+func (p *RemoteSendCmdParams) DelayMs() int {
+	if p.Delay == nil {
+		return 0
+	}
+	return *p.Delay
+}
+
+// Params of the remote send_cmd_sequence command
+type RemoteSendCmdSequenceParams struct {
+	Sequence []string `json:"sequence"`
+	Repeat   *int     `json:"repeat,omitempty"`
+	Delay    *int     `json:"delay,omitempty"`
+	Hold     *int     `json:"hold,omitempty"`
+}
+
+func (p *RemoteSendCmdSequenceParams) Validate() error {
+	if len(p.Sequence) == 0 {
+		return &ParamsError{Param: "sequence", Reason: "missing"}
+	}
+	for _, command := range p.Sequence {
+		if command == "" {
+			return &ParamsError{Param: "sequence", Reason: "must not contain empty commands"}
+		}
+	}
+	return validateRemoteTiming(p.Repeat, p.Delay, p.Hold)
+}
+
+// Number of times each command is sent, 1 if not set
+func (p *RemoteSendCmdSequenceParams) RepeatCount() int {
+	if p.Repeat == nil {
+		return 1
+	}
+	return *p.Repeat
+}
+
+// Delay between commands in ms, 0 if not set
+func (p *RemoteSendCmdSequenceParams) DelayMs() int {
+	if p.Delay == nil {
+		return 0
+	}
+	return *p.Delay
+}
+
+func validateRemoteTiming(repeat *int, delay *int, hold *int) error {
+	if err := checkRange("repeat", repeat, 1, maxRemoteRepeat); err != nil {
+		return err
+	}
+	if err := checkRange("delay", delay, 0, maxRemoteDelay); err != nil {
+		return err
+	}
+	return checkRange("hold", hold, 0, maxRemoteDelay)
+}
+
+func checkRange(param string, value *int, min int, max int) error {
+	if value == nil {
+		return nil
+	}
+	if *value < min || *value > max {
+		return &ParamsError{Param: param, Reason: fmt.Sprintf("must be between %d and %d", min, max)}
+	}
+	return nil
+}
+
+// Params types of the entity commands by entity type and command
+// Commands without params are not listed
+var commandParams = map[string]map[string]func() CommandParams{
+	"light": {
+		string(OnLightEntityCommand): func() CommandParams { return &LightOnParams{} },
+	},
+	"cover": {
+		string(PositionCoverEntityCommand): func() CommandParams { return &CoverPositionParams{} },
+		string(TiltCoverEntityCommand):     func() CommandParams { return &CoverTiltParams{} },
+	},
+	"climate": {
+		string(HVACModeClimateEntityCommand):               func() CommandParams { return &ClimateHVACModeParams{} },
+		string(TargetTemperatureClimateEntityCommand):      func() CommandParams { return &ClimateTargetTemperatureParams{} },
+		string(TargetTemperatureRangeClimateEntityCommand): func() CommandParams { return &ClimateTargetTemperatureRangeParams{} },
+		string(FanModeClimateEntityCommand):                func() CommandParams { return &ClimateFanModeParams{} },
+	},
+	"media_player": {
+		string(VolumeMediaPlayerEntityCommand):          func() CommandParams { return &MediaPlayerVolumeParams{} },
+		string(SeekMediaPlayerEntityCommand):            func() CommandParams { return &MediaPlayerSeekParams{} },
+		string(RepeatMediaPlayerEntityCommand):          func() CommandParams { return &MediaPlayerRepeatParams{} },
+		string(ShuffleMediaPlayerEntityCommand):         func() CommandParams { return &MediaPlayerShuffleParams{} },
+		string(SelectSourcMediaPlayerEntityCommand):     func() CommandParams { return &MediaPlayerSelectSourceParams{} },
+		string(SelectSoundModeMediaPlayerEntityCommand): func() CommandParams { return &MediaPlayerSelectSoundModeParams{} },
+	},
+	"remote": {
+		string(SendCmdRemoteEntityCommand):         func() CommandParams { return &RemoteSendCmdParams{} },
+		string(SendCmdSequenceRemoteEntityCommand): func() CommandParams { return &RemoteSendCmdSequenceParams{} },
+	},
+}
+
+// Decode the raw params of an entity_command into typed params and validate them
+// Fractional numbers of int params are rounded, e.g. a brightness of 12.5 becomes 13
+// Returns a ParamsError if the params are invalid
+func DecodeParams(params map[string]interface{}, p CommandParams) error {
+	data, err := json.Marshal(roundIntParams(params, p))
+	if err != nil {
+		return &ParamsError{Reason: err.Error()}
+	}
+
+	if err := json.Unmarshal(data, p); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return &ParamsError{Param: typeErr.Field, Reason: fmt.Sprintf("must be of type %s", typeErr.Type)}
+		}
+		return &ParamsError{Reason: err.Error()}
+	}
+
+	return p.Validate()
+}
+
+// Return a copy of params with fractional numbers of int params of p rounded
+func roundIntParams(params map[string]interface{}, p CommandParams) map[string]interface{} {
+	t := reflect.TypeOf(p)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return params
+	}
+
+	var rounded map[string]interface{}
+	for n := 0; n < t.NumField(); n++ {
+		field := t.Field(n)
+
+		kind := field.Type.Kind()
+		if kind == reflect.Pointer {
+			kind = field.Type.Elem().Kind()
+		}
+		if kind != reflect.Int {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		value, ok := params[name].(float64)
+		if !ok || value == math.Trunc(value) {
+			continue
+		}
+
+		if rounded == nil {
+			rounded = make(map[string]interface{}, len(params))
+			for k, v := range params {
+				rounded[k] = v
+			}
+		}
+		rounded[name] = math.Round(value)
+	}
+
+	if rounded == nil {
+		return params
+	}
+
+	return rounded
+}
+
+// Decode and validate the params of an entity command
+// Returns nil params if the command has no params
+func DecodeCommandParams(entityType string, cmd_id string, params map[string]interface{}) (CommandParams, error) {
+	newParams, ok := commandParams[entityType][cmd_id]
+	if !ok {
+		return nil, nil
+	}
+
+	p := newParams()
+	if err := DecodeParams(params, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
@@ -0,0 +1,75 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeParamsRoundsFractionalInts(t *testing.T) {
+	var p LightOnParams
+	if err := DecodeParams(map[string]interface{}{"brightness": 12.5, "hue": 20.4}, &p); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if *p.Brightness != 13 || *p.Hue != 20 {
+		t.Errorf("Expected brightness 13 and hue 20, got %d and %d", *p.Brightness, *p.Hue)
+	}
+}
+
+func TestDecodeParamsRejectsInvalidParams(t *testing.T) {
+	for _, params := range []map[string]interface{}{
+		{"brightness": "bright"},
+		{"brightness": 300},
+		{"hue": -1.2},
+	} {
+		var p LightOnParams
+		err := DecodeParams(params, &p)
+
+		var paramsErr *ParamsError
+		if !errors.As(err, &paramsErr) {
+			t.Errorf("Expected a ParamsError for %v, got %v", params, err)
+		}
+	}
+}
+
+func TestAddTypedCommand(t *testing.T) {
+	light := NewLightEntity("light", LanguageText{En: "Light"}, "")
+
+	var received *LightOnParams
+	if err := AddTypedCommand(light, OnLightEntityCommand, func(p *LightOnParams) error {
+		received = p
+		return nil
+	}); err != nil {
+		t.Fatalf("Cannot add typed command: %v", err)
+	}
+
+	params := map[string]interface{}{"brightness": 100.0}
+	decoded, err := DecodeCommandParams("light", "on", params)
+	if err != nil {
+		t.Fatalf("Cannot decode params: %v", err)
+	}
+
+	handled, err := light.HandleDecodedCommand("on", params, decoded)
+	if !handled || err != nil {
+		t.Fatalf("Expected the typed command to handle on, got %v and %v", handled, err)
+	}
+	if received == nil || *received.Brightness != 100 {
+		t.Errorf("Expected brightness 100, got %+v", received)
+	}
+
+	if handled, _ := light.HandleDecodedCommand("off", nil, nil); handled {
+		t.Error("Expected off to be left to HandleCommand")
+	}
+}
+
+func TestAddTypedCommandChecksParamsType(t *testing.T) {
+	light := NewLightEntity("light", LanguageText{En: "Light"}, "")
+
+	if err := AddTypedCommand(light, OffLightEntityCommand, func(p *LightOnParams) error { return nil }); err == nil {
+		t.Error("Expected an error for a command without params")
+	}
+
+	if err := AddTypedCommand(light, OnLightEntityCommand, func(p *CoverPositionParams) error { return nil }); err == nil {
+		t.Error("Expected an error for params of another command")
+	}
+}
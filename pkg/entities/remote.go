@@ -1,8 +1,11 @@
 package entities
 
 import (
+	"fmt"
 	"slices"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type RemoteEntityState EntityState
@@ -41,8 +44,8 @@ const (
 
 type RemoteEntity struct {
 	Entity
-	Commands map[RemoteEntityCommand]func(RemoteEntity, map[string]interface{}) int `json:"-"`
-	Options  map[RemoteEntityOption]interface{}                                     `json:"options"`
+	Commands map[RemoteEntityCommand]func(RemoteEntity, map[string]interface{}) error `json:"-"`
+	Options  map[RemoteEntityOption]interface{}                                       `json:"options"`
 }
 
 func NewRemoteEntity(id string, name LanguageText, area string) *RemoteEntity {
@@ -54,8 +57,8 @@ func NewRemoteEntity(id string, name LanguageText, area string) *RemoteEntity {
 
 	remoteEntity.EntityType.Type = "remote"
 
-	remoteEntity.Commands = make(map[RemoteEntityCommand]func(RemoteEntity, map[string]interface{}) int)
-	remoteEntity.Attributes = make(map[string]interface{})
+	remoteEntity.Commands = make(map[RemoteEntityCommand]func(RemoteEntity, map[string]interface{}) error)
+	remoteEntity.initAttributes()
 
 	// SendCmdRemoteEntityFeatures is always present even if not specified
 	// https://github.com/unfoldedcircle/core-api/blob/main/doc/entities/entity_remote.md
@@ -66,13 +69,19 @@ func NewRemoteEntity(id string, name LanguageText, area string) *RemoteEntity {
 	return &remoteEntity
 }
 
-func (e *RemoteEntity) UpdateEntity(newEntity RemoteEntity) error {
+func (e *RemoteEntity) UpdateEntity(entity EntityInterface) error {
+
+	newEntity, ok := entity.(*RemoteEntity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, entity)
+	}
 
 	e.Name = newEntity.Name
 	e.Area = newEntity.Area
 	e.Commands = newEntity.Commands
+	e.typedCommands = newEntity.typedCommands
 	e.Features = newEntity.Features
-	e.Attributes = newEntity.Attributes
+	e.replaceAttributes(newEntity.GetAttribute())
 
 	return nil
 }
@@ -92,90 +101,109 @@ func (e RemoteEntity) AddFeature(feature RemoteEntityFeatures) {
 }
 
 // Register a function for the Entity command
-func (e *RemoteEntity) AddCommand(command RemoteEntityCommand, function func(RemoteEntity, map[string]interface{}) int) {
+func (e *RemoteEntity) AddCommand(command RemoteEntityCommand, function func(RemoteEntity, map[string]interface{}) error) {
 	e.Commands[command] = function
 
 }
 
 // Call the registred function for this entity_command
-func (e *RemoteEntity) HandleCommand(cmd_id string, params map[string]interface{}) int {
+func (e *RemoteEntity) HandleCommand(cmd_id string, params map[string]interface{}) error {
 	if e.Commands[RemoteEntityCommand(cmd_id)] != nil {
 		return e.Commands[RemoteEntityCommand(cmd_id)](*e, params)
 	}
 
-	// When simple_commands are enabled and the command exists, call the registered function if one is set
-	if e.Options[SimpleCommandsRemoteEntityOption] != nil {
+	decoded, err := DecodeCommandParams(e.EntityType.Type, cmd_id, params)
+	if err != nil {
+		return NewBadRequestError(err)
+	}
 
-		switch RemoteEntityCommand(cmd_id) {
-		case SendCmdRemoteEntityCommand:
-			command := params["command"].(string)
-			delay := 0
-			repeat := 1
+	if handled, err := e.handleSimpleCommand(params, decoded); handled {
+		return err
+	}
 
-			if e.Commands[RemoteEntityCommand(command)] != nil && slices.Contains(e.Options[SimpleCommandsRemoteEntityOption].([]string), command) {
-				go func() {
-					if params["repeat"] != nil {
-						repeat = int(params["repeat"].(float64))
-					}
+	return unknownCommandError(cmd_id)
+}
 
-					if params["delay"] != nil {
-						delay = int(params["delay"].(float64))
-					}
+// Call the typed or registred function for this entity_command with the already decoded params
+func (e *RemoteEntity) HandleDecodedCommand(cmd_id string, params map[string]interface{}, decoded CommandParams) (bool, error) {
+	if handled, err := e.Entity.HandleDecodedCommand(cmd_id, params, decoded); handled {
+		return true, err
+	}
 
-					for i := 0; i < repeat; i++ {
-						e.Commands[RemoteEntityCommand(command)](*e, params)
-						time.Sleep(time.Duration(delay) * time.Millisecond)
-					}
-				}()
+	if e.Commands[RemoteEntityCommand(cmd_id)] != nil {
+		return false, nil
+	}
 
-				return 200
-			}
+	return e.handleSimpleCommand(params, decoded)
+}
 
-		case SendCmdSequenceRemoteEntityCommand:
-			commandSeq := params["sequence"].([]interface{})
-			delay := 0
-			repeat := 1
+// When simple_commands are enabled and the command exists, call the registered function if one is set
+// Returns false if the command is no simple command
+func (e *RemoteEntity) handleSimpleCommand(params map[string]interface{}, decoded CommandParams) (bool, error) {
+	if e.Options[SimpleCommandsRemoteEntityOption] == nil {
+		return false, nil
+	}
 
-			if params["repeat"] != nil {
-				repeat = int(params["repeat"].(float64))
-			}
+	simpleCommands, _ := e.Options[SimpleCommandsRemoteEntityOption].([]string)
 
-			if params["delay"] != nil {
-				delay = int(params["delay"].(float64))
+	switch p := decoded.(type) {
+	case *RemoteSendCmdParams:
+		command := p.Command
+		if e.Commands[RemoteEntityCommand(command)] == nil || !slices.Contains(simpleCommands, command) {
+			return false, nil
+		}
+
+		go func() {
+			defer e.recoverCommand(command)
+
+			for i := 0; i < p.RepeatCount(); i++ {
+				if err := e.Commands[RemoteEntityCommand(command)](*e, params); err != nil {
+					log.WithError(err).WithFields(log.Fields{"entity_id": e.Id, "command": command}).Error("Remote command failed")
+				}
+				time.Sleep(time.Duration(p.DelayMs()) * time.Millisecond)
 			}
+		}()
 
-			go func() {
-				for _, command := range commandSeq {
-					if e.Commands[RemoteEntityCommand(command.(string))] != nil && slices.Contains(e.Options[SimpleCommandsRemoteEntityOption].([]string), command.(string)) {
-						for i := 0; i < repeat; i++ {
-							e.Commands[RemoteEntityCommand(command.(string))](*e, params)
-							time.Sleep(time.Duration(delay) * time.Millisecond)
+		return true, nil
+
+	case *RemoteSendCmdSequenceParams:
+		go func() {
+			defer e.recoverCommand(string(SendCmdSequenceRemoteEntityCommand))
+
+			for _, command := range p.Sequence {
+				if e.Commands[RemoteEntityCommand(command)] != nil && slices.Contains(simpleCommands, command) {
+					for i := 0; i < p.RepeatCount(); i++ {
+						if err := e.Commands[RemoteEntityCommand(command)](*e, params); err != nil {
+							log.WithError(err).WithFields(log.Fields{"entity_id": e.Id, "command": command}).Error("Remote command failed")
 						}
+						time.Sleep(time.Duration(p.DelayMs()) * time.Millisecond)
 					}
-
 				}
-			}()
 
-			return 200
-		}
+			}
+		}()
+
+		return true, nil
 	}
 
-	return 404
+	return false, nil
+}
+
+// Log a panic of a command sent in the background, the response was already sent
+func (e *RemoteEntity) recoverCommand(command string) {
+	if r := recover(); r != nil {
+		log.WithFields(log.Fields{"entity_id": e.Id, "command": command, "panic": r}).Error("Recovered from panic in remote command")
+	}
 }
 
 // Check if an Attribute is available
 func (e *RemoteEntity) HasAttribute(attribute RemoteEntityAttributes) bool {
-	_, ok := e.Attributes[string(attribute)]
-
-	return ok
+	return e.hasAttribute(string(attribute))
 }
 
 // Update an Attribute if its available
 func (e *RemoteEntity) UpdateAttribute(attribute RemoteEntityAttributes, value interface{}) {
-
-	if e.HasAttribute(attribute) {
-		e.Attributes[string(attribute)] = value
-	}
+	e.updateAttribute(string(attribute), value)
 }
 
 // Add an option to the Remote Entity
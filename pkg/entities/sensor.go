@@ -1,5 +1,7 @@
 package entities
 
+import "fmt"
+
 type SensorEntityState EntityState
 type SensorEntityFeatures EntityFeature
 type SensorEntityAttributes EntityAttribute
@@ -43,7 +45,7 @@ func NewSensorEntity(id string, name LanguageText, area string, deviceClass Sens
 
 	sensorEntity.EntityType.Type = "sensor"
 
-	sensorEntity.Attributes = make(map[string]interface{})
+	sensorEntity.initAttributes()
 
 	sensorEntity.AddAttribute("state", OnSensorEntityState)
 	sensorEntity.AddAttribute("value", 0)
@@ -70,11 +72,16 @@ func NewSensorEntity(id string, name LanguageText, area string, deviceClass Sens
 	return &sensorEntity
 }
 
-func (e *SensorEntity) UpdateEntity(newEntity SensorEntity) error {
+func (e *SensorEntity) UpdateEntity(entity EntityInterface) error {
+
+	newEntity, ok := entity.(*SensorEntity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, entity)
+	}
 
 	e.Name = newEntity.Name
 	e.Area = newEntity.Area
-	e.Attributes["unit"] = newEntity.Attributes["unit"]
+	e.updateAttribute("unit", newEntity.GetAttribute()["unit"])
 
 	return nil
 }
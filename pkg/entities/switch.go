@@ -1,5 +1,7 @@
 package entities
 
+import "fmt"
+
 type SwitchEntityState EntityState
 type SwitchEntityFeatures EntityFeature
 type SwitchEntityAttributes EntityAttribute
@@ -27,7 +29,7 @@ const (
 
 type SwitchsEntity struct {
 	Entity
-	Commands map[SwitchEntityCommand]func(SwitchsEntity, map[string]interface{}) int `json:"-"`
+	Commands map[SwitchEntityCommand]func(SwitchsEntity, map[string]interface{}) error `json:"-"`
 }
 
 func NewSwitchEntity(id string, name LanguageText, area string) *SwitchsEntity {
@@ -39,19 +41,25 @@ func NewSwitchEntity(id string, name LanguageText, area string) *SwitchsEntity {
 
 	switchEntity.EntityType.Type = "switch"
 
-	switchEntity.Commands = make(map[SwitchEntityCommand]func(SwitchsEntity, map[string]interface{}) int)
-	switchEntity.Attributes = make(map[string]interface{})
+	switchEntity.Commands = make(map[SwitchEntityCommand]func(SwitchsEntity, map[string]interface{}) error)
+	switchEntity.initAttributes()
 
 	return &switchEntity
 }
 
-func (e *SwitchsEntity) UpdateEntity(newEntity SwitchsEntity) error {
+func (e *SwitchsEntity) UpdateEntity(entity EntityInterface) error {
+
+	newEntity, ok := entity.(*SwitchsEntity)
+	if !ok {
+		return fmt.Errorf("cannot update entity %s with an entity of type %T", e.Id, entity)
+	}
 
 	e.Name = newEntity.Name
 	e.Area = newEntity.Area
 	e.Commands = newEntity.Commands
+	e.typedCommands = newEntity.typedCommands
 	e.Features = newEntity.Features
-	e.Attributes = newEntity.Attributes
+	e.replaceAttributes(newEntity.GetAttribute())
 
 	return nil
 }
@@ -71,39 +79,31 @@ func (e *SwitchsEntity) AddFeature(feature SwitchEntityFeatures) {
 }
 
 // Register a function for the Entity command
-func (e *SwitchsEntity) AddCommand(command SwitchEntityCommand, function func(SwitchsEntity, map[string]interface{}) int) {
+func (e *SwitchsEntity) AddCommand(command SwitchEntityCommand, function func(SwitchsEntity, map[string]interface{}) error) {
 	e.Commands[command] = function
 
 }
 
 func (e *SwitchsEntity) MapCommandWithParams(command SwitchEntityCommand, f func(map[string]interface{}) error) {
 
-	e.AddCommand(command, func(entity SwitchsEntity, params map[string]interface{}) int {
-
-		if err := f(params); err != nil {
-			return 404
-		}
-		return 200
+	e.AddCommand(command, func(entity SwitchsEntity, params map[string]interface{}) error {
+		return f(params)
 	})
 }
 
 func (e *SwitchsEntity) MapCommand(command SwitchEntityCommand, f func() error) {
 
-	e.AddCommand(command, func(entity SwitchsEntity, params map[string]interface{}) int {
-
-		if err := f(); err != nil {
-			return 404
-		}
-		return 200
+	e.AddCommand(command, func(entity SwitchsEntity, params map[string]interface{}) error {
+		return f()
 	})
 
 }
 
 // Call the registred function for this entity_command
-func (e *SwitchsEntity) HandleCommand(cmd_id string, params map[string]interface{}) int {
+func (e *SwitchsEntity) HandleCommand(cmd_id string, params map[string]interface{}) error {
 	if e.Commands[SwitchEntityCommand(cmd_id)] != nil {
 		return e.Commands[SwitchEntityCommand(cmd_id)](*e, params)
 	}
 
-	return 404
+	return unknownCommandError(cmd_id)
 }
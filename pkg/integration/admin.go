@@ -0,0 +1,320 @@
+package integration
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/splattner/goucrt/pkg/entities"
+)
+
+// Path prefix of the admin API on the HTTP server of the integration
+const adminPath = "/admin/"
+
+const (
+	// Number of entity_change events buffered per event stream, further events are dropped until the client caught up
+	adminEventBuffer = 64
+
+	// Send a comment on idle event streams so proxies keep the connection open
+	adminKeepAlive = 30 * time.Second
+)
+
+// Check the admin API config, the admin API requires a token
+func (c *Config) validateAdmin() error {
+	if c.AdminAPI && c.AdminToken == "" {
+		return fmt.Errorf("admin API requires an admin token")
+	}
+
+	return nil
+}
+
+// An entity as listed by the admin API
+type adminEntity struct {
+	// Definition of the entity as sent in available_entities
+	Entity     entities.EntityInterface `json:"entity"`
+	Attributes map[string]interface{}   `json:"attributes"`
+	// Restored attributes the device did not yet confirm
+	StaleAttributes []string `json:"stale_attributes,omitempty"`
+	Subscribed      bool     `json:"subscribed"`
+}
+
+// Subscriptions of a Remote Two connection as listed by the admin API
+type adminSession struct {
+	Session    string   `json:"session"`
+	RemoteAddr string   `json:"remote_addr"`
+	Standby    bool     `json:"standby"`
+	EntityIds  []string `json:"entity_ids"`
+}
+
+type adminSubscriptions struct {
+	// Entities subscribed by any Remote Two
+	EntityIds []string       `json:"entity_ids"`
+	Sessions  []adminSession `json:"sessions"`
+}
+
+type adminSetupData struct {
+	State     DriverSetupState `json:"state,omitempty"`
+	SetupData SetupData        `json:"setup_data"`
+}
+
+type adminCommandResponse struct {
+	Code    int                `json:"code"`
+	MsgData *ErrorResponseData `json:"msg_data,omitempty"`
+}
+
+// Streams of entity_change events of the admin API
+type adminEvents struct {
+	streams map[chan []byte]struct{}
+	closed  bool
+	mutex   sync.Mutex
+}
+
+func newAdminEvents() *adminEvents {
+	return &adminEvents{streams: make(map[chan []byte]struct{})}
+}
+
+// Open a new event stream, the channel is closed when the integration shuts down
+func (e *adminEvents) subscribe() chan []byte {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	stream := make(chan []byte, adminEventBuffer)
+	if e.closed {
+		close(stream)
+		return stream
+	}
+
+	e.streams[stream] = struct{}{}
+
+	return stream
+}
+
+func (e *adminEvents) unsubscribe(stream chan []byte) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, ok := e.streams[stream]; ok {
+		delete(e.streams, stream)
+		close(stream)
+	}
+}
+
+// Send an event to all streams without waiting for slow clients
+func (e *adminEvents) publish(msg []byte) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for stream := range e.streams {
+		select {
+		case stream <- msg:
+		default:
+			log.Debug("Admin event stream full, dropped entity_change event")
+		}
+	}
+}
+
+// Close all streams so the handlers return and the server can shut down
+func (e *adminEvents) close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.closed = true
+	for stream := range e.streams {
+		delete(e.streams, stream)
+		close(stream)
+	}
+}
+
+// Send an entity_change event to the event streams of the admin API
+// Backends publish to the streams of the hosting integration
+func (i *Integration) publishAdminEvent(event *EntityChangeEvent) {
+	if i.parent != nil {
+		i.parent.publishAdminEvent(event)
+		return
+	}
+
+	if i.adminEvents == nil {
+		return
+	}
+
+	msg, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Error("Cannot marshal entity_change event")
+		return
+	}
+
+	i.adminEvents.publish(msg)
+}
+
+// Register the admin API handlers on the mux of the HTTP server
+func (i *Integration) handleAdmin(mux *http.ServeMux, server *http.Server) {
+	log.WithField("Path", adminPath).Info("Admin API enabled")
+
+	server.RegisterOnShutdown(i.adminEvents.close)
+
+	mux.HandleFunc(adminPath, i.adminAuth(i.adminEndpoint))
+}
+
+// Only let requests with the admin token as bearer token pass
+func (i *Integration) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(i.Config.AdminToken)) != 1 {
+			log.WithField("RemoteAddr", r.RemoteAddr).Info("Admin API request with invalid token")
+
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid admin token")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (i *Integration) adminEndpoint(w http.ResponseWriter, r *http.Request) {
+	route := strings.TrimPrefix(r.URL.Path, adminPath)
+
+	method := http.MethodGet
+	if route == "entity_command" {
+		method = http.MethodPost
+	}
+
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAdminError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", fmt.Sprintf("use %s", method))
+		return
+	}
+
+	switch route {
+	case "entities":
+		writeAdminJSON(w, http.StatusOK, i.adminEntities())
+	case "subscriptions":
+		writeAdminJSON(w, http.StatusOK, i.adminSubscriptions())
+	case "setup_data":
+		writeAdminJSON(w, http.StatusOK, adminSetupData{State: i.GetSetupState(), SetupData: i.RedactedSetupData()})
+	case "entity_command":
+		i.adminEntityCommand(w, r)
+	case "events":
+		i.adminEventStream(w, r)
+	default:
+		writeAdminError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("unknown admin endpoint %s", r.URL.Path))
+	}
+}
+
+// Return all entities with their current attributes
+func (i *Integration) adminEntities() []adminEntity {
+	list := i.Entities.List()
+	result := make([]adminEntity, 0, len(list))
+
+	for _, e := range list {
+		result = append(result, adminEntity{
+			Entity:          e,
+			Attributes:      e.GetAttribute(),
+			StaleAttributes: e.StaleAttributes(),
+			Subscribed:      i.isSubscribed(e),
+		})
+	}
+
+	return result
+}
+
+// Return the subscribed entities of all Remote Two connections
+func (i *Integration) adminSubscriptions() adminSubscriptions {
+	result := adminSubscriptions{EntityIds: i.SubscribedEntities(), Sessions: []adminSession{}}
+
+	for _, s := range i.getSessions() {
+		result.Sessions = append(result.Sessions, adminSession{
+			Session:    s.id,
+			RemoteAddr: s.remoteAddr,
+			Standby:    s.InStandBy(),
+			EntityIds:  s.subscriptions.List(),
+		})
+	}
+
+	return result
+}
+
+// Invoke an entity command like an entity_command request of a Remote Two
+// The body is the msg_data of the request, the HTTP status is the code of the response
+func (i *Integration) adminEntityCommand(w http.ResponseWriter, r *http.Request) {
+	req := EntityCommandReq{CommonReq: CommonReq{Kind: "req", Msg: "entity_command"}}
+
+	if err := json.NewDecoder(r.Body).Decode(&req.MsgData); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "BAD_REQUEST", fmt.Sprintf("invalid command: %v", err))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"entity_id": req.MsgData.EntityId,
+		"command":   req.MsgData.CmdId,
+		"params":    req.MsgData.Params}).Info("Entity command from admin API")
+
+	res := i.handleEntityCommandRequest(&req)
+
+	writeAdminJSON(w, res.Code, adminCommandResponse{Code: res.Code, MsgData: res.MsgData})
+}
+
+// Stream all entity_change events as server-sent events until the client disconnects
+func (i *Integration) adminEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAdminError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "streaming not supported")
+		return
+	}
+
+	stream := i.adminEvents.subscribe()
+	defer i.adminEvents.unsubscribe(stream)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	log.WithField("RemoteAddr", r.RemoteAddr).Debug("Admin event stream opened")
+
+	keepAlive := time.NewTicker(adminKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.WithField("RemoteAddr", r.RemoteAddr).Debug("Admin event stream closed")
+			return
+
+		case msg, ok := <-stream:
+			if !ok {
+				return
+			}
+
+			if _, err := fmt.Fprintf(w, "event: entity_change\ndata: %s\n\n", msg); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Debug("Cannot write admin API response")
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, errorCode string, message string) {
+	writeAdminJSON(w, code, ErrorResponseData{Code: errorCode, Message: message})
+}
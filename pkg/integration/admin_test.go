@@ -0,0 +1,234 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/splattner/goucrt/pkg/entities"
+)
+
+const testAdminToken = "admin-token"
+
+// Start the admin API of an integration with a dimmable light
+func newAdminTestServer(t *testing.T) (*Integration, *entities.LightEntity, *httptest.Server) {
+	t.Helper()
+
+	i := newTestIntegration(t, Config{AdminAPI: true, AdminToken: testAdminToken})
+
+	light := entities.NewLightEntity("light", entities.LanguageText{En: "Light"}, "")
+	light.AddFeature(entities.OnOffLightEntityFeatures)
+	light.AddFeature(entities.DimLightEntityFeatures)
+	light.MapCommand(entities.OnLightEntityCommand, func() error { return nil })
+	light.MapCommand(entities.ToggleLightEntityCommand, func() error {
+		return entities.NewDeviceUnavailableError(fmt.Errorf("light not reachable"))
+	})
+	if err := i.AddEntity(light); err != nil {
+		t.Fatalf("Cannot add entity: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	server := &http.Server{Handler: mux}
+	i.handleAdmin(mux, server)
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		// Let the event streams return
+		i.adminEvents.close()
+		ts.Close()
+	})
+
+	return i, light, ts
+}
+
+func adminRequest(t *testing.T, ts *httptest.Server, method string, path string, token string, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Cannot create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Cannot send request: %v", err)
+	}
+
+	return res
+}
+
+func decodeAdminResponse(t *testing.T, res *http.Response, v interface{}) {
+	t.Helper()
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("Cannot decode response: %v", err)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	_, _, ts := newAdminTestServer(t)
+
+	for _, token := range []string{"", "wrong"} {
+		for _, path := range []string{"entities", "setup_data", "events"} {
+			res := adminRequest(t, ts, http.MethodGet, adminPath+path, token, "")
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("Expected 401 for %s with token %q, got %d", path, token, res.StatusCode)
+			}
+			if res.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("Expected a Bearer challenge for %s with token %q", path, token)
+			}
+		}
+
+		res := adminRequest(t, ts, http.MethodPost, adminPath+"entity_command", token, `{"entity_id":"light","cmd_id":"on"}`)
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for entity_command with token %q, got %d", token, res.StatusCode)
+		}
+	}
+
+	res := adminRequest(t, ts, http.MethodGet, adminPath+"entities", testAdminToken, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 with the admin token, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminSetupDataIsRedacted(t *testing.T) {
+	i, _, ts := newAdminTestServer(t)
+
+	i.Metadata.SetupDataSchema = SetupDataSchema{Settings: []SetupDataSchemaSettings{
+		{Id: "gateway_secret", Field: SettingTypePassword{}},
+	}}
+	i.SetSetupData(SetupData{"ipaddr": "10.0.0.1", "apikey": "key", "gateway_secret": "secret"})
+
+	res := adminRequest(t, ts, http.MethodGet, adminPath+"setup_data", testAdminToken, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.StatusCode)
+	}
+
+	setupData := adminSetupData{}
+	decodeAdminResponse(t, res, &setupData)
+
+	expected := SetupData{"ipaddr": "10.0.0.1", "apikey": redactedValue, "gateway_secret": redactedValue}
+	if fmt.Sprint(setupData.SetupData) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, setupData.SetupData)
+	}
+}
+
+func TestAdminEntityCommand(t *testing.T) {
+	_, _, ts := newAdminTestServer(t)
+
+	for _, c := range []struct {
+		body      string
+		code      int
+		errorCode string
+	}{
+		{`{"entity_id":"light","cmd_id":"on"}`, 200, ""},
+		{`{"entity_id":"light","cmd_id":"on","params":{"brightness":300}}`, 400, "BAD_REQUEST"},
+		{`{"entity_id":"light"`, 400, "BAD_REQUEST"},
+		{`{"entity_id":"unknown","cmd_id":"on"}`, 404, "NOT_FOUND"},
+		{`{"entity_id":"light","cmd_id":"blink"}`, 404, "NOT_FOUND"},
+		{`{"entity_id":"light","cmd_id":"toggle"}`, 503, "SERVICE_UNAVAILABLE"},
+	} {
+		res := adminRequest(t, ts, http.MethodPost, adminPath+"entity_command", testAdminToken, c.body)
+		if res.StatusCode != c.code {
+			t.Errorf("Expected status %d for %s, got %d", c.code, c.body, res.StatusCode)
+		}
+
+		if c.errorCode == "" {
+			res.Body.Close()
+			continue
+		}
+
+		// The decode error is answered without a command response
+		var errorCode string
+		if strings.HasSuffix(c.body, "}") {
+			response := adminCommandResponse{}
+			decodeAdminResponse(t, res, &response)
+			if response.MsgData != nil {
+				errorCode = response.MsgData.Code
+			}
+		} else {
+			response := ErrorResponseData{}
+			decodeAdminResponse(t, res, &response)
+			errorCode = response.Code
+		}
+
+		if errorCode != c.errorCode {
+			t.Errorf("Expected error code %s for %s, got %s", c.errorCode, c.body, errorCode)
+		}
+	}
+
+	res := adminRequest(t, ts, http.MethodGet, adminPath+"entity_command", testAdminToken, "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET entity_command, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminEventStream(t *testing.T) {
+	_, light, ts := newAdminTestServer(t)
+
+	res := adminRequest(t, ts, http.MethodGet, adminPath+"events", testAdminToken, "")
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", res.StatusCode)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %s", contentType)
+	}
+
+	// The stream is subscribed once the headers were sent
+	light.SetAttributes(map[string]interface{}{"brightness": 42})
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	var received []string
+	for len(received) < 2 {
+		select {
+		case line := <-lines:
+			if line != "" {
+				received = append(received, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No entity_change event, received %v", received)
+		}
+	}
+
+	if received[0] != "event: entity_change" {
+		t.Errorf("Expected an entity_change event, got %s", received[0])
+	}
+
+	data, ok := strings.CutPrefix(received[1], "data: ")
+	if !ok {
+		t.Fatalf("Expected the event data, got %s", received[1])
+	}
+
+	event := EntityChangeEvent{}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatalf("Cannot unmarshal event: %v", err)
+	}
+	if event.MsgData.EntityId != "light" || event.MsgData.Attributes["brightness"] != 42.0 {
+		t.Errorf("Unexpected event %s", data)
+	}
+}
@@ -7,7 +7,7 @@ import (
 )
 
 // Start Advertising the integration with mDNS
-func (i *Integration) startAdvertising() {
+func (i *Integration) startAdvertising() error {
 	log.Info("Start advertising UC Integration with mDNS")
 
 	txt := []string{
@@ -19,10 +19,12 @@ func (i *Integration) startAdvertising() {
 
 	server, err := zeroconf.Register(i.Metadata.DriverId, "_uc-integration._tcp", "local.", i.Config.ListenPort, txt, nil)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	i.mdns = server
+
+	return nil
 }
 
 // Stop mDNS advertisement
@@ -30,5 +32,6 @@ func (i *Integration) stopAdvertising() {
 	if i.mdns != nil {
 		log.Info("Stop advertising UC Integration")
 		i.mdns.Shutdown()
+		i.mdns = nil
 	}
 }
@@ -0,0 +1,192 @@
+// Package apischema validates websocket messages of the integration API against the JSON schemas of the
+// Unfolded Circle integration API in schemas/, to find drift between the message structs and the spec
+package apischema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+//go:generate ./schemas/upstream/fetch.sh
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// Schema file with the message schemas in $defs as <kind>_<msg>
+const schemaFile = "integration-api.json"
+
+// Returned for messages without a schema, e.g. messages that are not part of the integration API
+var ErrUnknownMessage = errors.New("no schema for message")
+
+// A field of a message that does not conform to the schema
+type Mismatch struct {
+	// JSON pointer of the field within the message, / for the message itself
+	Path    string
+	Message string
+}
+
+func (m Mismatch) String() string {
+	return m.Path + ": " + m.Message
+}
+
+// A message that does not conform to its schema
+type ValidationError struct {
+	Kind       string
+	Msg        string
+	Mismatches []Mismatch
+}
+
+func (e *ValidationError) Error() string {
+	mismatches := make([]string, 0, len(e.Mismatches))
+	for _, m := range e.Mismatches {
+		mismatches = append(mismatches, m.String())
+	}
+
+	return fmt.Sprintf("%s %s does not conform to the integration API: %s", e.Kind, e.Msg, strings.Join(mismatches, "; "))
+}
+
+var (
+	schemas     map[string]*jsonschema.Schema
+	schemasErr  error
+	schemasOnce sync.Once
+)
+
+// Compile the message schemas once
+func loadSchemas() (map[string]*jsonschema.Schema, error) {
+	schemasOnce.Do(func() {
+		raw, err := schemaFiles.ReadFile("schemas/" + schemaFile)
+		if err != nil {
+			schemasErr = err
+			return
+		}
+
+		defs := struct {
+			Defs map[string]json.RawMessage `json:"$defs"`
+		}{}
+		if err := json.Unmarshal(raw, &defs); err != nil {
+			schemasErr = fmt.Errorf("cannot read %s: %w", schemaFile, err)
+			return
+		}
+
+		compiler := jsonschema.NewCompiler()
+		compiler.Draft = jsonschema.Draft2020
+		if err := compiler.AddResource(schemaFile, bytes.NewReader(raw)); err != nil {
+			schemasErr = fmt.Errorf("cannot add %s: %w", schemaFile, err)
+			return
+		}
+
+		compiled := make(map[string]*jsonschema.Schema)
+		for name := range defs.Defs {
+			// Only message schemas, not the shared definitions
+			if !strings.Contains(name, "_") {
+				continue
+			}
+
+			schema, err := compiler.Compile(schemaFile + "#/$defs/" + name)
+			if err != nil {
+				schemasErr = fmt.Errorf("cannot compile schema of %s: %w", name, err)
+				return
+			}
+
+			compiled[name] = schema
+		}
+
+		schemas = compiled
+	})
+
+	return schemas, schemasErr
+}
+
+// Return the messages with a schema as <kind>_<msg>
+func Messages() ([]string, error) {
+	schemas, err := loadSchemas()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Validate a message sent or received over the websocket
+// Returns a *ValidationError with the mismatching fields, or ErrUnknownMessage if there is no schema for the message
+func Validate(message []byte) error {
+	schemas, err := loadSchemas()
+	if err != nil {
+		return err
+	}
+
+	header := struct {
+		Kind string `json:"kind"`
+		Msg  string `json:"msg"`
+	}{}
+	if err := json.Unmarshal(message, &header); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+
+	schema, ok := schemas[header.Kind+"_"+header.Msg]
+	if !ok {
+		return fmt.Errorf("%w %s %s", ErrUnknownMessage, header.Kind, header.Msg)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+
+	if err := schema.Validate(v); err != nil {
+		var validationErr *jsonschema.ValidationError
+		if !errors.As(err, &validationErr) {
+			return err
+		}
+
+		return &ValidationError{Kind: header.Kind, Msg: header.Msg, Mismatches: mismatches(validationErr)}
+	}
+
+	return nil
+}
+
+// Return the mismatches of the innermost validation errors, the outer errors only group them
+func mismatches(err *jsonschema.ValidationError) []Mismatch {
+	var result []Mismatch
+	seen := make(map[Mismatch]bool)
+
+	for _, e := range err.BasicOutput().Errors {
+		if e.Error == "" || strings.HasPrefix(e.Error, "doesn't validate with") {
+			continue
+		}
+
+		path := e.InstanceLocation
+		if path == "" {
+			path = "/"
+		}
+
+		m := Mismatch{Path: path, Message: e.Error}
+		if !seen[m] {
+			seen[m] = true
+			result = append(result, m)
+		}
+	}
+
+	if len(result) == 0 {
+		result = append(result, Mismatch{Path: "/", Message: err.Message})
+	}
+
+	return result
+}
@@ -0,0 +1,319 @@
+package apischema_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/splattner/goucrt/pkg/entities"
+	"github.com/splattner/goucrt/pkg/integration"
+	"github.com/splattner/goucrt/pkg/integration/apischema"
+)
+
+// A driver defined entity type, not known to the Remote Two
+type vacuumEntity struct {
+	entities.Entity
+}
+
+func newVacuumEntity() *vacuumEntity {
+	return &vacuumEntity{entities.Entity{
+		Id:         "vacuum",
+		EntityType: entities.EntityType{Type: "vacuum"},
+		Name:       entities.LanguageText{En: "Vacuum"},
+		Features:   []interface{}{"start", "dock"},
+	}}
+}
+
+func newLightEntity() *entities.LightEntity {
+	light := entities.NewLightEntity("light", entities.LanguageText{En: "Light"}, "")
+	light.AddFeature(entities.OnOffLightEntityFeatures)
+	light.AddFeature(entities.DimLightEntityFeatures)
+
+	return light
+}
+
+func req(msg string) integration.CommonReq {
+	return integration.CommonReq{Kind: "req", Id: 1, Msg: msg}
+}
+
+func resp(msg string, code int) integration.CommonResp {
+	return integration.CommonResp{Kind: "resp", Id: 1, Msg: msg, Code: code}
+}
+
+func event(msg string, cat string) integration.CommonEvent {
+	return integration.CommonEvent{Kind: "event", Msg: msg, Cat: cat, Ts: "2024-01-02T03:04:05Z"}
+}
+
+var setupSettings = []integration.SetupDataSchemaSettings{
+	{Id: "port", Label: integration.LanguageText{En: "Port"}, Field: integration.SettingTypeNumber{Number: integration.SettingTypeNumberDefinition{Value: 80, Min: 1, Max: 65535}}},
+	{Id: "host", Label: integration.LanguageText{En: "Host"}, Field: integration.SettingTypeText{Text: integration.SettingTypeTextDefinition{Value: "localhost"}}},
+	{Id: "notes", Label: integration.LanguageText{En: "Notes"}, Field: integration.SettingTypeTextArea{}},
+	{Id: "apikey", Label: integration.LanguageText{En: "API key"}, Field: integration.SettingTypePassword{}},
+	{Id: "tls", Label: integration.LanguageText{En: "TLS"}, Field: integration.SettingTypeCheckbox{}},
+	{Id: "mode", Label: integration.LanguageText{En: "Mode"}, Field: integration.SettingTypeDropdown{Dropdown: integration.SettingTypeDropdowDefinition{
+		Value: "a",
+		Items: []integration.SettingTypeDropdowItemsDefinition{{Id: "a", Label: integration.LanguageText{En: "A"}}},
+	}}},
+	{Id: "info", Label: integration.LanguageText{En: "Info"}, Field: integration.SettingTypeLabel{Label: integration.SettingTypeLabelDefinition{Value: integration.LanguageText{En: "Info"}}}},
+}
+
+var driverVersion = integration.DriverVersionData{Name: "Test", Version: integration.Version{Api: integration.API_VERSION, Driver: "0.0.1"}}
+
+// Messages as built by the integration and the remotetest harness, by <kind>_<msg>
+var messages = map[string][]interface{}{
+	"req_auth":                {integration.AuthRequestMessage{CommonReq: req("auth"), MsgData: integration.AuthRequestData{Token: "token"}}},
+	"req_get_driver_version":  {integration.DriverVersionReq{CommonReq: req("get_driver_version")}},
+	"req_get_driver_metadata": {integration.DriverMetadataReq{CommonReq: req("get_driver_metadata")}},
+	"req_get_device_state":    {integration.DeviceStateMessageReq{CommonReq: req("get_device_state"), MsgData: integration.DeviceId{DeviceId: "device"}}},
+	"req_get_available_entities": {
+		integration.AvailableEntityMessageReq{CommonReq: req("get_available_entities")},
+		integration.AvailableEntityMessageReq{CommonReq: req("get_available_entities"), MsgData: integration.AvailableEntityMessageData{
+			Filter: integration.AvailableEntityFilter{DeviceId: integration.DeviceId{DeviceId: "device"}, EntityType: entities.EntityType{Type: "vacuum"}},
+		}},
+	},
+	"req_subscribe_events": {
+		integration.SubscribeEventMessageReq{CommonReq: req("subscribe_events")},
+		integration.SubscribeEventMessageReq{CommonReq: req("subscribe_events"), MsgData: integration.SubscribeEventMessageData{EntityIds: []string{"light", "vacuum"}}},
+	},
+	"req_unsubscribe_events": {
+		integration.UnubscribeEventMessageReq{CommonReq: req("unsubscribe_events")},
+		integration.UnubscribeEventMessageReq{CommonReq: req("unsubscribe_events"), MsgData: integration.SubscribeEventMessageData{EntityIds: []string{"light"}}},
+	},
+	"req_get_entity_states": {integration.GetEntityStatesMessageReq{CommonReq: req("get_entity_states")}},
+	"req_entity_command": {
+		integration.EntityCommandReq{CommonReq: req("entity_command"), MsgData: integration.EntityCommandData{EntityId: "light", CmdId: "on", Params: map[string]interface{}{"brightness": 100}}},
+		integration.EntityCommandReq{CommonReq: req("entity_command"), MsgData: integration.EntityCommandData{EntityId: "vacuum", CmdId: "start"}},
+	},
+	"req_setup_driver": {
+		integration.SetupDriverMessageReq{CommonReq: req("setup_driver"), MsgData: integration.SetupDataValue{Reconfigure: true, Value: integration.SetupData{"port": "8080"}}},
+	},
+	"req_set_driver_user_data": {
+		integration.SetDriverUserDataRequest{CommonReq: req("set_driver_user_data"), MsgData: integration.SetDriverUserData{InputValues: map[string]string{"port": "8080"}}},
+		integration.SetDriverUserDataRequest{CommonReq: req("set_driver_user_data"), MsgData: integration.SetDriverUserData{Confirm: true}},
+	},
+
+	"resp_authentication": {
+		integration.AuthenticationResponse{CommonResp: resp("authentication", 200), MsgData: driverVersion},
+		integration.AuthenticationResponse{CommonResp: resp("authentication", 401), MsgData: driverVersion},
+	},
+	"resp_driver_version": {integration.ResponseMessage{CommonResp: resp("driver_version", 200), MsgData: driverVersion}},
+	"resp_driver_metadata": {integration.DriverMetadataReponse{CommonResp: resp("driver_metadata", 200), MsgData: integration.DriverMetadata{
+		DriverId:    "test",
+		Name:        integration.LanguageText{En: "Test"},
+		AuthMethod:  integration.MessageAuthMethod,
+		Version:     "0.0.1",
+		Description: integration.LanguageText{En: "Test driver"},
+		Developer:   integration.Developer{Name: "Test"},
+		SetupDataSchema: integration.SetupDataSchema{
+			Title:    integration.LanguageText{En: "Setup"},
+			Settings: setupSettings,
+		},
+	}}},
+	"resp_available_entities": {
+		integration.AvailableEntityMessage{CommonResp: resp("available_entities", 200), MsgData: integration.AvailableEntityData{
+			Filter:            integration.AvailableEntityFilter{EntityType: entities.EntityType{Type: "vacuum"}},
+			AvailableEntities: []interface{}{newVacuumEntity()},
+		}},
+		integration.AvailableEntityNoFilterMessage{CommonResp: resp("available_entities", 200), MsgData: integration.AvailableEntityNoFilterData{
+			AvailableEntities: []interface{}{newLightEntity(), newVacuumEntity()},
+		}},
+	},
+	"resp_entity_states": {
+		integration.GetEntityStatesMessage{CommonResp: resp("entity_states", 200), MsgData: []entities.EntityStateData{
+			*newLightEntity().GetEntityState(),
+			*newVacuumEntity().GetEntityState(),
+		}},
+		integration.GetEntityStatesMessage{CommonResp: resp("entity_states", 200)},
+	},
+	"resp_result": {
+		integration.ResponseMessage{CommonResp: resp("result", 200)},
+		integration.EntityCommandResponse{CommonResp: resp("result", 200)},
+		integration.EntityCommandResponse{CommonResp: resp("result", 404), MsgData: &integration.ErrorResponseData{Code: "NOT_FOUND", Message: "unknown entity"}},
+	},
+
+	"event_auth_required": {integration.AuthRequiredEvent{CommonEvent: event("auth_required", "DEVICE"), MsgData: driverVersion}},
+	"event_device_state":  {integration.DeviceStateEventMessage{CommonEvent: event("device_state", "DEVICE"), MsgData: integration.DeviceState{State: "CONNECTED"}}},
+	"event_entity_change": {
+		integration.EntityChangeEvent{CommonEvent: event("entity_change", "ENTITY"), MsgData: integration.EntityChangeData{
+			EntityType: "light", EntityId: "light", Attributes: map[string]interface{}{"brightness": 100},
+		}},
+		integration.EntityChangeEvent{CommonEvent: event("entity_change", "ENTITY"), MsgData: integration.EntityChangeData{
+			EntityType: "vacuum", EntityId: "vacuum", Attributes: map[string]interface{}{"state": "CLEANING"},
+		}},
+	},
+	"event_entity_available": {
+		integration.EntityAvailableEvent{CommonEvent: event("entity_available", "ENTITY"), MsgData: newLightEntity()},
+		integration.EntityAvailableEvent{CommonEvent: event("entity_available", "ENTITY"), MsgData: newVacuumEntity()},
+	},
+	"event_entity_removed": {
+		integration.EntityRemovedEvent{CommonEvent: event("entity_removed", "ENTITY"), MsgData: integration.EntityRemovedEventData{EntityType: "vacuum", EntityId: "vacuum"}},
+	},
+	"event_driver_setup_change": {
+		integration.DriverSetupChangeEvent{CommonEvent: event("driver_setup_change", "DEVICE"), MsgData: integration.DriverSetupChangeData{
+			EventType: integration.StartEvent, State: integration.SetupState,
+		}},
+		integration.DriverSetupChangeEvent{CommonEvent: event("driver_setup_change", "DEVICE"), MsgData: integration.DriverSetupChangeData{
+			EventType: integration.SetupEvent, State: integration.WaitUserActionState,
+			RequireUserAction: integration.RequireUserAction{Input: integration.SettigsPage{Title: integration.LanguageText{En: "Settings"}, Settings: []integration.Setting{
+				{Id: "port", Label: integration.LanguageText{En: "Port"}, Field: integration.SettingTypeNumber{}},
+			}}},
+		}},
+		integration.DriverSetupChangeEvent{CommonEvent: event("driver_setup_change", "DEVICE"), MsgData: integration.DriverSetupChangeData{
+			EventType: integration.SetupEvent, State: integration.WaitUserActionState,
+			RequireUserAction: integration.RequireUserAction{Confirmation: integration.ConfirmationPage{Title: integration.LanguageText{En: "Confirm"}, Message1: "Press the button"}},
+		}},
+		integration.DriverSetupChangeEvent{CommonEvent: event("driver_setup_change", "DEVICE"), MsgData: integration.DriverSetupChangeData{
+			EventType: integration.StopEvent, State: integration.ErrorState, Error: integration.OtherError,
+		}},
+	},
+	"event_connect":            {integration.ConnectEvent{CommonEvent: event("connect", "DEVICE")}},
+	"event_disconnect":         {integration.ConnectEvent{CommonEvent: event("disconnect", "DEVICE"), MsgData: integration.ConnectEventData{DeviceId: "device"}}},
+	"event_enter_standby":      {integration.EventMessage{CommonEvent: event("enter_standby", "REMOTE")}},
+	"event_exit_standby":       {integration.EventMessage{CommonEvent: event("exit_standby", "REMOTE")}},
+	"event_abort_driver_setup": {integration.AbortDriverSetupEvent{CommonEvent: event("abort_driver_setup", "DEVICE"), MsgData: integration.AbortDriverSetupData{Error: integration.OtherError}}},
+}
+
+func TestMessageStructsConformToSchema(t *testing.T) {
+	for name, values := range messages {
+		for _, v := range values {
+			msg, err := json.Marshal(v)
+			if err != nil {
+				t.Fatalf("Cannot marshal %s: %v", name, err)
+			}
+
+			if err := apischema.Validate(msg); err != nil {
+				t.Errorf("%s: %v\n%s", name, err, msg)
+			}
+		}
+	}
+}
+
+func TestEveryMessageSchemaIsTested(t *testing.T) {
+	names, err := apischema.Messages()
+	if err != nil {
+		t.Fatalf("Cannot load schemas: %v", err)
+	}
+
+	for _, name := range names {
+		if len(messages[name]) == 0 {
+			t.Errorf("No message struct validated against the schema of %s", name)
+		}
+	}
+
+	for name := range messages {
+		if !contains(names, name) {
+			t.Errorf("No schema for %s", name)
+		}
+	}
+}
+
+func TestSchemaMismatches(t *testing.T) {
+	for msg, path := range map[string]string{
+		`{"kind":"event","msg":"entity_change","cat":"ENTITY","msg_data":{"entity_type":"","entity_id":"light","attributes":{}}}`: "/msg_data/entity_type",
+		`{"kind":"event","msg":"device_state","cat":"DEVICE","msg_data":{"state":"ON"}}`:                                          "/msg_data/state",
+		`{"kind":"req","id":1,"msg":"entity_command","msg_data":{"entity_id":"light"}}`:                                           "/msg_data",
+		`{"kind":"resp","req_id":1,"msg":"result","code":404,"msg_data":{"code":"MISSING"}}`:                                      "/msg_data/code",
+	} {
+		err := apischema.Validate([]byte(msg))
+
+		var validationErr *apischema.ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("Expected a validation error for %s, got %v", msg, err)
+			continue
+		}
+
+		if validationErr.Mismatches[0].Path != path {
+			t.Errorf("Expected a mismatch at %s for %s, got %v", path, msg, validationErr.Mismatches)
+		}
+	}
+
+	if err := apischema.Validate([]byte(`{"kind":"req","id":1,"msg":"unknown"}`)); !errors.Is(err, apischema.ErrUnknownMessage) {
+		t.Errorf("Expected ErrUnknownMessage, got %v", err)
+	}
+}
+
+func TestVendoredVersionMatchesAPIVersion(t *testing.T) {
+	version, err := os.ReadFile("schemas/upstream/VERSION")
+	if err != nil {
+		t.Fatalf("Cannot read the vendored version: %v", err)
+	}
+
+	if v := strings.TrimSpace(string(version)); v != integration.API_VERSION {
+		t.Errorf("Schemas follow integration API %s, the integration implements %s", v, integration.API_VERSION)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The AsyncAPI definition fetched with go generate, see schemas/upstream/README.md
+const upstreamDefinition = "schemas/upstream/UCR-integration-asyncapi.yaml"
+
+func TestSchemaFollowsUpstreamDefinition(t *testing.T) {
+	raw, err := os.ReadFile(upstreamDefinition)
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skip("Upstream definition not fetched, run go generate ./pkg/integration/apischema")
+	}
+	if err != nil {
+		t.Fatalf("Cannot read the upstream definition: %v", err)
+	}
+
+	source, err := os.ReadFile("schemas/upstream/SOURCE")
+	if err != nil || !strings.Contains(string(source), "commit: ") {
+		t.Errorf("The upstream definition has no SOURCE with the commit it was fetched from: %v", err)
+	}
+
+	definition := map[string]interface{}{}
+	if err := yaml.Unmarshal(raw, &definition); err != nil {
+		t.Fatalf("Cannot parse the upstream definition: %v", err)
+	}
+
+	info, _ := definition["info"].(map[string]interface{})
+	if v := strings.TrimPrefix(fmt.Sprint(info["version"]), "v"); v != integration.API_VERSION {
+		t.Errorf("Upstream definition is version %s, the schemas follow %s", v, integration.API_VERSION)
+	}
+
+	upstreamValues := make(map[string]bool)
+	collectStrings(definition, upstreamValues)
+
+	names, err := apischema.Messages()
+	if err != nil {
+		t.Fatalf("Cannot load schemas: %v", err)
+	}
+
+	for _, name := range names {
+		msg := name[strings.Index(name, "_")+1:]
+		if !upstreamValues[msg] {
+			t.Errorf("Message %s of the schemas is not in the upstream definition", name)
+		}
+	}
+}
+
+// Collect all keys and string values of a parsed YAML document
+func collectStrings(v interface{}, values map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			values[k] = true
+			collectStrings(value, values)
+		}
+	case []interface{}:
+		for _, value := range v {
+			collectStrings(value, values)
+		}
+	case string:
+		values[v] = true
+	}
+}
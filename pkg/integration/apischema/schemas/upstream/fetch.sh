@@ -0,0 +1,25 @@
+#!/bin/sh
+# Vendor the AsyncAPI definition of the integration API from unfoldedcircle/core-api
+# The version is read from VERSION, CORE_API_REF overrides the git ref to fetch, e.g. a commit
+set -eu
+
+cd "$(dirname "$0")"
+
+repo=unfoldedcircle/core-api
+file=integration-api/UCR-integration-asyncapi.yaml
+version=$(cat VERSION)
+ref=${CORE_API_REF:-v$version}
+
+commit=$(curl -fsSL -H "Accept: application/vnd.github.sha" "https://api.github.com/repos/$repo/commits/$ref")
+curl -fsSL -o "$(basename "$file")" "https://raw.githubusercontent.com/$repo/$commit/$file"
+
+cat > SOURCE <<SOURCE
+repository: https://github.com/$repo
+file: $file
+version: $version
+ref: $ref
+commit: $commit
+sha256: $(sha256sum "$(basename "$file")" | cut -d' ' -f1)
+SOURCE
+
+echo "Vendored $file of $repo $ref ($commit)"
@@ -0,0 +1,175 @@
+package integration
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gorilla/websocket"
+)
+
+// Authentication methods supported by the driver
+// See DriverMetadata.AuthMethod
+const (
+	HeaderAuthMethod  = "HEADER"
+	MessageAuthMethod = "MESSAGE"
+)
+
+const (
+	// Header the Remote Two uses to send the token with header based authentication
+	AuthTokenHeader = "auth-token"
+
+	// Time allowed for the Remote Two to send the auth request with message based authentication
+	authWait = 10 * time.Second
+)
+
+// Return the auth token, read from the auth token file if no token is set
+func (c *Config) AuthTokenValue() (string, error) {
+	if c.AuthToken != "" || c.AuthTokenFile == "" {
+		return c.AuthToken, nil
+	}
+
+	file, err := os.ReadFile(c.AuthTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read auth token file: %w", err)
+	}
+
+	return strings.TrimSpace(string(file)), nil
+}
+
+// Check the configured authentication method and token
+// The token of the auth token file is set as AuthToken
+func (c *Config) validateAuth() error {
+	switch c.AuthMethod {
+	case "":
+		return nil
+	case HeaderAuthMethod, MessageAuthMethod:
+		token, err := c.AuthTokenValue()
+		if err != nil {
+			return err
+		}
+		c.AuthToken = token
+
+		if c.AuthToken == "" {
+			return fmt.Errorf("auth method %s requires an auth token", c.AuthMethod)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown auth method %s, must be %s or %s", c.AuthMethod, HeaderAuthMethod, MessageAuthMethod)
+}
+
+// Compare a token with the configured token in constant time
+func (i *Integration) validAuthToken(token string) bool {
+	if i.Config.AuthMethod == "" {
+		return true
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(i.Config.AuthToken)) == 1
+}
+
+// Authenticate a new websocket connection with the configured authentication method
+// The authentication response is written directly to the websocket, before the read and write loop are started
+// Unauthenticated connections get a authentication response with code 401 and are closed
+func (i *Integration) authenticate(s *session, r *http.Request) bool {
+	ws := s.ws
+
+	switch i.Config.AuthMethod {
+	case HeaderAuthMethod:
+		if !i.validAuthToken(r.Header.Get(AuthTokenHeader)) {
+			i.rejectConnection(s, 0)
+			return false
+		}
+
+	case MessageAuthMethod:
+		event := AuthRequiredEvent{
+			CommonEvent{Kind: "event", Msg: "auth_required", Cat: "DEVICE", Ts: time.Now().Format(time.RFC3339)},
+			i.driverVersionData(),
+		}
+		if err := s.writeMessage(event); err != nil {
+			log.WithError(err).Error("Cannot send auth_required event")
+			ws.Close()
+			return false
+		}
+
+		if err := ws.SetReadDeadline(time.Now().Add(authWait)); err != nil {
+			log.WithError(err).Error("Cannot set readdeadline")
+		}
+
+		_, p, err := ws.ReadMessage()
+		if err != nil {
+			log.WithError(err).Info("No auth request received")
+			i.rejectConnection(s, 0)
+			return false
+		}
+
+		s.received(p)
+
+		authReq := AuthRequestMessage{}
+		if err := json.Unmarshal(p, &authReq); err != nil || authReq.Msg != "auth" || !i.validAuthToken(authReq.MsgData.Token) {
+			i.rejectConnection(s, authReq.Id)
+			return false
+		}
+
+		if err := s.writeMessage(i.authenticationResponseMessage(authReq.Id, 200)); err != nil {
+			log.WithError(err).Error("Cannot send authentication response")
+			ws.Close()
+			return false
+		}
+
+		return true
+	}
+
+	if err := s.writeMessage(i.authenticationResponseMessage(0, 200)); err != nil {
+		log.WithError(err).Error("Cannot send authentication response")
+		ws.Close()
+		return false
+	}
+
+	return true
+}
+
+// Send a authentication response with code 401 and close the websocket
+func (i *Integration) rejectConnection(s *session, reqId int) {
+	ws := s.ws
+
+	log.WithField("RemoteAddr", ws.RemoteAddr().String()).Info("Authentication failed, closing Websocket")
+
+	if err := s.writeMessage(i.authenticationResponseMessage(reqId, 401)); err != nil {
+		log.WithError(err).Error("Cannot send authentication response")
+	}
+
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication failed")
+	if err := ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait)); err != nil {
+		log.WithError(err).Debug("Cannot send close message")
+	}
+
+	ws.Close()
+}
+
+// Handle a auth request sent on an already authenticated connection
+func (i *Integration) handleAuthRequest(req *AuthRequestMessage) *AuthenticationResponse {
+
+	if !i.validAuthToken(req.MsgData.Token) {
+		return i.authenticationResponseMessage(req.Id, 401)
+	}
+
+	return i.authenticationResponseMessage(req.Id, 200)
+}
+
+// Write a message directly to the websocket
+// Only used as long as the write loop is not yet started
+func (s *session) writeMessage(msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.write(data)
+}
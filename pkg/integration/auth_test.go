@@ -0,0 +1,34 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthTokenFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("Cannot write token file: %v", err)
+	}
+
+	i := newTestIntegration(t, Config{AuthMethod: MessageAuthMethod, AuthTokenFile: file})
+	if !i.validAuthToken("file-token") {
+		t.Error("Expected the token of the token file to be valid")
+	}
+
+	// The token takes precedence over the token file
+	i = newTestIntegration(t, Config{AuthMethod: MessageAuthMethod, AuthToken: "token", AuthTokenFile: file})
+	if i.validAuthToken("file-token") || !i.validAuthToken("token") {
+		t.Error("Expected only the token to be valid")
+	}
+
+	for _, c := range []Config{
+		{AuthMethod: HeaderAuthMethod},
+		{AuthMethod: HeaderAuthMethod, AuthTokenFile: filepath.Join(t.TempDir(), "missing")},
+	} {
+		if err := c.validateAuth(); err == nil {
+			t.Errorf("Expected an error for %+v", c)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package integration
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Separator between the backend name and the entity id or setup data key
+const backendSeparator = "."
+
+// Result of the setup of a backend
+type backendSetupResult struct {
+	state DriverSetupState
+	err   DriverSetupError
+}
+
+// Add a backend hosted by this integration, e.g. a deCONZ client next to a Shelly client in one driver
+// The returned integration is passed to the client of the backend. It shares the websocket endpoint and the
+// entities of this integration, its entity ids and setup data keys are namespaced with the backend name.
+// Each backend keeps its own setup data file, set by the client with SetMetadata
+func (i *Integration) AddBackend(name string) *Integration {
+	backend := &Integration{
+		Config:               i.Config,
+		DeviceId:             "",
+		deviceStates:         make(map[string]DState),
+		deviceUnhealthySince: make(map[string]time.Time),
+		Entities:             i.Entities,
+		detachedChanges:      make(map[string]*detachedChanges),
+		secretsKey:           i.secretsKey,
+
+		parent:      i,
+		backendName: name,
+	}
+
+	i.backendsMutex.Lock()
+	i.backends = append(i.backends, backend)
+	i.backendsMutex.Unlock()
+
+	return backend
+}
+
+// Return a snapshot of the hosted backends
+func (i *Integration) getBackends() []*Integration {
+	i.backendsMutex.Lock()
+	defer i.backendsMutex.Unlock()
+
+	return append([]*Integration(nil), i.backends...)
+}
+
+// Return the names of the hosted backends
+func (i *Integration) BackendNames() []string {
+	backends := i.getBackends()
+
+	names := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		names = append(names, backend.backendName)
+	}
+
+	return names
+}
+
+// Combine the setup data schemas of all backends, each setting id is prefixed with the backend name
+// Call after the clients of the backends set their metadata
+func (i *Integration) BackendsSetupDataSchema(title LanguageText) SetupDataSchema {
+	schema := SetupDataSchema{Title: title}
+
+	for _, backend := range i.getBackends() {
+		if backend.Metadata == nil {
+			continue
+		}
+
+		// A label as section header of the backend settings
+		schema.Settings = append(schema.Settings, SetupDataSchemaSettings{
+			Id:    backend.backendKey("label"),
+			Label: backend.Metadata.Name,
+			Field: SettingTypeLabel{
+				Label: SettingTypeLabelDefinition{
+					Value: LanguageText{En: "Leave the settings empty to skip " + backend.Metadata.Name.En},
+				},
+			},
+		})
+
+		for _, setting := range backend.Metadata.SetupDataSchema.Settings {
+			setting.Id = backend.backendKey(setting.Id)
+			schema.Settings = append(schema.Settings, setting)
+		}
+	}
+
+	return schema
+}
+
+// Prefix an entity id or setup data key with the backend name
+func (i *Integration) backendKey(key string) string {
+	if i.parent == nil {
+		return key
+	}
+
+	prefix := i.backendName + backendSeparator
+	if strings.HasPrefix(key, prefix) {
+		return key
+	}
+
+	return prefix + key
+}
+
+// Return the setup data values of the backend without the backend prefix
+func (i *Integration) backendSetupData(data SetupData) SetupData {
+	prefix := i.backendName + backendSeparator
+
+	values := make(SetupData)
+	for k, v := range data {
+		if strings.HasPrefix(k, prefix) {
+			values[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+
+	return values
+}
+
+// Set up the backends one after the other with their part of the setup data
+// The Remote Two only sees the final state, a failing backend stops the setup with its error
+func (i *Integration) runBackendSetups(ctx context.Context, value SetupDataValue) {
+	for _, backend := range i.getBackends() {
+		values := backend.backendSetupData(value.Value)
+
+		if isEmptySetupData(values) {
+			log.WithField("backend", backend.backendName).Info("No setup data for backend, skip setup")
+			continue
+		}
+
+		result := make(chan backendSetupResult, 1)
+
+		backend.setupMutex.Lock()
+		backend.setupResult = result
+		backend.setupMutex.Unlock()
+
+		log.WithField("backend", backend.backendName).Info("Setup backend")
+
+		if err := backend.startSetup(SetupDataValue{Reconfigure: value.Reconfigure, Value: values}); err != nil {
+			log.WithError(err).WithField("backend", backend.backendName).Error("Cannot persist setup data")
+			i.SetDriverSetupState(StopEvent, ErrorState, OtherError, nil)
+			return
+		}
+
+		select {
+		case r := <-result:
+			if r.state != OkState {
+				i.SetDriverSetupState(StopEvent, ErrorState, r.err, nil)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	i.SetDriverSetupState(StopEvent, OkState, "", nil)
+}
+
+func isEmptySetupData(data SetupData) bool {
+	for _, v := range data {
+		if v != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Start the setup of the backends in the background
+// A running setup of the backends is aborted
+func (i *Integration) startBackendSetups(value SetupDataValue) {
+	i.abortBackendSetups()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	i.setupMutex.Lock()
+	i.backendSetupCancel = cancel
+	i.setupMutex.Unlock()
+
+	go func() {
+		defer cancel()
+		i.runBackendSetups(ctx, value)
+	}()
+}
+
+// Abort the running backend setups
+// Backends that already finished their setup keep the new setup data
+func (i *Integration) abortBackendSetups() {
+	i.setupMutex.Lock()
+	cancel := i.backendSetupCancel
+	i.backendSetupCancel = nil
+	i.setupMutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	for _, backend := range i.getBackends() {
+		backend.abortSetup()
+	}
+}
+
+// Return the backend with a running setup, nil if no backend is in setup
+func (i *Integration) activeBackendSetup() *Integration {
+	for _, backend := range i.getBackends() {
+		if backend.activeSetup() != nil {
+			return backend
+		}
+	}
+
+	return nil
+}
+
+// Report the end of a backend setup to the hosting integration
+func (i *Integration) backendSetupStopped(state DriverSetupState, err DriverSetupError) {
+	i.setupMutex.Lock()
+	result := i.setupResult
+	i.setupResult = nil
+	i.setupMutex.Unlock()
+
+	if result != nil {
+		result <- backendSetupResult{state: state, err: err}
+	}
+}
+
+// Report the state of the slowest backend as the device state of the hosting integration
+// An error of any backend wins, then connecting, connected and disconnected
+func (i *Integration) updateBackendsDeviceState() {
+	priority := map[DState]int{
+		DisconnectedDeviceState: 0,
+		ConnectedDeviceState:    1,
+		ConnectingDeviceState:   2,
+		ErrorDeviceState:        3,
+	}
+
+	i.backendsMutex.Lock()
+	defer i.backendsMutex.Unlock()
+
+	state := DisconnectedDeviceState
+	for _, backend := range i.backends {
+		backendState := backend.GetDeviceState(backend.DeviceId)
+		if priority[backendState] > priority[state] {
+			state = backendState
+		}
+	}
+
+	if state != i.GetDeviceState(i.DeviceId) {
+		i.SetDeviceState(state)
+	}
+}
@@ -0,0 +1,26 @@
+package integration
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBackendsConcurrentWithConnectEvents(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+
+	runConcurrently(4, func(g int) {
+		for n := 0; n < 20; n++ {
+			if g%2 == 0 {
+				i.AddBackend(fmt.Sprintf("backend%d-%d", g, n))
+			} else {
+				i.handleConnectEvent(&ConnectEvent{CommonEvent: CommonEvent{Kind: "event", Msg: "connect", Cat: "DEVICE"}})
+				_ = i.BackendNames()
+				_ = i.deviceStatuses()
+			}
+		}
+	})
+
+	if len(i.BackendNames()) != 40 {
+		t.Errorf("Expected 40 backends, got %d", len(i.BackendNames()))
+	}
+}
@@ -1,46 +1,83 @@
 package integration
 
 import (
+	"context"
+	"fmt"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Device specific implementation of a client
+// The Client calls the methods and manages the goroutines, cancellation and reconnects
+type Driver interface {
+	// Initialize the driver
+	// Here you can add entities if they are already known
+	Init() error
+
+	// Called by RemoteTwo when the integration is added and setup started, unless the driver uses a SetupFlow
+	// Returns when the setup is finished, nil reports OK and an error reports ERROR to the Remote Two
+	// The context is cancelled when the user aborts the setup
+	Setup(ctx context.Context, setup_data SetupData) error
+
+	// Connect to the device and handle it until the context is cancelled
+	// Report CONNECTED with SetDeviceState once the device is connected
+	// Return nil when the context is cancelled, an error if the connection failed or was lost
+	Connect(ctx context.Context) error
+
+	// Release the device after Connect returned
+	Disconnect() error
+
+	// User input of a settings page or a confirmation requested during Setup
+	UserData(userdata map[string]string, confirm bool) error
+}
+
 // Generic client
 type Client struct {
 	IntegrationDriver *Integration
 
-	DeviceState DState
+	// Device handled by this client, empty for the default device of the integration
+	DeviceId string
 
-	Messages chan string
+	// Use GetDeviceState, the state is set by the reconnect goroutine while the driver reads it
+	deviceState      DState
+	deviceStateMutex sync.Mutex
 
-	// Client specific functions
-	// Initialize the client
-	// Here you can add entities if they are already known
-	InitFunc func()
-	// Called by RemoteTwo when the integration is added and setup started
-	SetupFunc func(SetupData)
-	// Handles connect/disconnect calls from RemoteTwo
-	ClientLoopFunc        func()
-	SetDriverUserDataFunc func(map[string]string, bool)
+	driver Driver
+
+	// Delay between reconnect attempts after the connection failed or was lost
+	Backoff Backoff
+
+	// Set when the driver reported CONNECTED during the current connect attempt
+	connected atomic.Bool
+	// Set after a failed attempt, the entity states are resynced once connected again
+	resync atomic.Bool
+
+	// Cancels the running connection, nil if not connected
+	cancel context.CancelFunc
+	// Closed when the running connection returned
+	done  chan struct{}
+	mutex sync.Mutex
 }
 
-func NewClient(i *Integration) *Client {
+func NewClient(i *Integration, driver Driver) *Client {
 
 	client := Client{}
 
 	client.IntegrationDriver = i
+	client.driver = driver
+	client.Backoff = DefaultBackoff
 	// Start without a connection
-	client.DeviceState = DisconnectedDeviceState
-
-	client.Messages = make(chan string)
+	client.deviceState = DisconnectedDeviceState
 
 	return &client
 
 }
 
-func (c *Client) InitClient() {
+func (c *Client) InitClient() error {
 
 	// Pass function to the integration driver that is called when the remote want to setup the driver
 	c.IntegrationDriver.SetHandleSetupFunction(c.HandleSetup)
@@ -48,38 +85,49 @@ func (c *Client) InitClient() {
 	c.IntegrationDriver.SetHandleConnectionFunction(c.HandleConnection)
 	// Pass function to the integration driver that is called when the remote want to send data from required user input page
 	c.IntegrationDriver.SetHandleSetDriverUserDataFunction(c.HandleSetDriverUserDataFunction)
+	// Pass function to the integration driver that is called when the integration shuts down
+	c.IntegrationDriver.SetHandleShutdownFunction(c.Shutdown)
+	// Pass function to the integration driver that is called when the setup was reconfigured
+	c.IntegrationDriver.SetHandleReconfigureFunction(c.Reconnect)
 
-	// Call setup Function if its set
-	if c.InitFunc != nil {
-		c.InitFunc()
+	if err := c.driver.Init(); err != nil {
+		return fmt.Errorf("cannot initialize client: %w", err)
 	}
+
+	return nil
 }
 
 func (c *Client) HandleConnection(e *ConnectEvent) {
+	// Events without device_id are meant for all devices
+	if e.MsgData.DeviceId != "" && e.MsgData.DeviceId != c.DeviceId {
+		return
+	}
+
 	switch e.Msg {
 	case "connect":
-		c.SetDeviceState(ConnectingDeviceState)
-		// to make sure event is sent
-		time.Sleep(1 * time.Second)
-
-		// And then connect
 		c.Connect()
 	case "disconnect":
-
-		if c.DeviceState == ConnectedDeviceState {
-			// And disconnect
-			c.Disconnect()
-		}
-
+		c.Disconnect()
 	}
 }
 
 // Handle Setup called by Remote Two to setup this integration
 // the SetupData are passed to this function
-func (c *Client) HandleSetup(setup_data SetupData) {
+func (c *Client) HandleSetup(ctx context.Context, setup_data SetupData) {
 
-	if c.SetupFunc != nil {
-		c.SetupFunc(setup_data)
+	if err := c.driver.Setup(ctx, setup_data); err != nil {
+		if ctx.Err() != nil {
+			log.Info("Setup cancelled")
+			return
+		}
+
+		log.WithError(err).Error("Setup failed")
+		c.IntegrationDriver.SetDriverSetupState(StopEvent, ErrorState, setupErrorCode(err), nil)
+		return
+	}
+
+	if ctx.Err() == nil {
+		c.IntegrationDriver.SetDriverSetupState(StopEvent, OkState, "", nil)
 	}
 
 }
@@ -91,53 +139,185 @@ func (c *Client) HandleSetup(setup_data SetupData) {
 func (c *Client) HandleSetDriverUserDataFunction(userdata map[string]string, confirm bool) {
 
 	log.WithFields(log.Fields{
-		"Userdata": userdata,
+		"Userdata": c.IntegrationDriver.redactedValues(userdata),
 		"Confim":   confirm,
 	}).Debug(("Handle SetDriverUserData"))
 
-	if c.SetDriverUserDataFunc != nil {
-		c.SetDriverUserDataFunc(userdata, confirm)
+	if err := c.driver.UserData(userdata, confirm); err != nil {
+		log.WithError(err).Error("Cannot handle driver user data")
+		c.IntegrationDriver.SetDriverSetupState(StopEvent, ErrorState, setupErrorCode(err), nil)
 	}
 
 }
 
+// Connect the driver in the background and reconnect with backoff when the connection fails or is lost
+// Does nothing if the client is already connected
 func (c *Client) Connect() {
-	c.ClientLoop()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cancel != nil {
+		return
+	}
+
+	log.Info("Connect Client")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	c.cancel = cancel
+	c.done = done
+
+	c.SetDeviceState(ConnectingDeviceState)
+
+	go c.run(ctx, cancel, done)
 }
 
+// Run the connection of the driver until the context is cancelled
+// A failed connection is reported as ERROR and retried after the backoff delay
+func (c *Client) run(ctx context.Context, cancel context.CancelFunc, done chan struct{}) {
+	defer func() {
+		c.mutex.Lock()
+		if c.done == done {
+			c.cancel = nil
+			c.done = nil
+		}
+		c.mutex.Unlock()
+
+		cancel()
+		close(done)
+	}()
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			c.SetDeviceState(ConnectingDeviceState)
+		}
+
+		c.connected.Store(false)
+
+		err := c.driver.Connect(ctx)
+
+		if disconnectErr := c.driver.Disconnect(); disconnectErr != nil {
+			log.WithError(disconnectErr).Error("Cannot disconnect client")
+		}
+
+		if err == nil || ctx.Err() != nil {
+			c.resync.Store(false)
+			c.SetDeviceState(DisconnectedDeviceState)
+			return
+		}
+
+		// Start over with the initial delay if the connection was established before it was lost
+		if c.connected.Load() {
+			attempt = 0
+		}
+
+		delay := c.Backoff.Delay(attempt)
+
+		log.WithError(err).WithField("retry", delay).Error("Client connection failed")
+		c.resync.Store(true)
+		c.SetDeviceState(ErrorDeviceState)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			c.resync.Store(false)
+			c.SetDeviceState(DisconnectedDeviceState)
+			return
+		}
+	}
+}
+
+// Ask the running connection to disconnect
+// Does nothing if the client is not connected
 func (c *Client) Disconnect() {
-	c.Messages <- "disconnect"
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cancel != nil {
+		log.Info("Disconnect Client")
+		c.cancel()
+	}
 }
 
-func (c *Client) SetDeviceState(state DState) {
-	log.WithField("state", state).Debug("Set device state and send to integration")
-	c.DeviceState = state
-	c.IntegrationDriver.SetDeviceState(c.DeviceState)
+// Disconnect the client and wait until the connection returned
+func (c *Client) Shutdown() {
+	c.mutex.Lock()
+	cancel, done := c.cancel, c.done
+	c.mutex.Unlock()
+
+	if done == nil {
+		return
+	}
+
+	log.Info("Shutdown Client")
+
+	cancel()
+	<-done
 }
 
-func (c *Client) ClientLoop() {
-	log.Info("Start Client Loop")
+// Reconnect a connected client, e.g. to use changed setup data
+func (c *Client) Reconnect() {
+	c.mutex.Lock()
+	connected := c.done != nil
+	c.mutex.Unlock()
+
+	if !connected {
+		return
+	}
+
+	log.Info("Reconnect Client")
+
+	c.Shutdown()
+	c.Connect()
+}
+
+func (c *Client) SetDeviceState(state DState) {
+	log.WithField("state", state).Debug("Set device state and send to integration")
+	c.deviceStateMutex.Lock()
+	c.deviceState = state
+	c.deviceStateMutex.Unlock()
 
-	if c.ClientLoopFunc != nil {
-		go c.ClientLoopFunc()
+	if c.DeviceId == "" {
+		c.IntegrationDriver.SetDeviceState(state)
 	} else {
-		log.Fatal("Client loop not implemented")
+		c.IntegrationDriver.SetDeviceStateById(c.DeviceId, state)
 	}
 
+	if state == ConnectedDeviceState {
+		c.connected.Store(true)
+
+		// Changes may have been missed while the connection was lost
+		if c.resync.CompareAndSwap(true, false) {
+			c.IntegrationDriver.ResyncEntityStates()
+		}
+	}
 }
 
-func (c *Client) FinishIntegrationSetup() {
+// Return the last device state set by the client or the driver
+func (c *Client) GetDeviceState() DState {
+	c.deviceStateMutex.Lock()
+	defer c.deviceStateMutex.Unlock()
 
-	c.IntegrationDriver.SetupData["integrationSetupFinished"] = "true"
-	c.IntegrationDriver.PersistSetupData()
+	return c.deviceState
+}
+
+func (c *Client) FinishIntegrationSetup() error {
+
+	c.IntegrationDriver.SetSetupDataValue("integrationSetupFinished", "true")
+	if err := c.IntegrationDriver.PersistSetupData(); err != nil {
+		return err
+	}
 
 	log.Debug("Integration Setup finished")
 
+	return nil
+
 }
 
 func (c *Client) IntegrationSetupFinished() bool {
 
-	finished, err := strconv.ParseBool(c.IntegrationDriver.SetupData["integrationSetupFinished"])
+	finished, err := strconv.ParseBool(c.IntegrationDriver.GetSetupDataValue("integrationSetupFinished"))
 	if err != nil {
 		return false
 	}
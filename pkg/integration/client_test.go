@@ -0,0 +1,242 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/splattner/goucrt/pkg/entities"
+)
+
+// Driver whose connection fails, optionally after reporting CONNECTED
+type failingDriver struct {
+	client          *Client
+	reportConnected bool
+
+	mutex    sync.Mutex
+	attempts []time.Time
+}
+
+func (d *failingDriver) Init() error { return nil }
+
+func (d *failingDriver) Setup(ctx context.Context, setup_data SetupData) error { return nil }
+
+func (d *failingDriver) Connect(ctx context.Context) error {
+	d.mutex.Lock()
+	d.attempts = append(d.attempts, time.Now())
+	d.mutex.Unlock()
+
+	if d.reportConnected {
+		d.client.SetDeviceState(ConnectedDeviceState)
+	}
+
+	return fmt.Errorf("connection lost")
+}
+
+func (d *failingDriver) Disconnect() error { return nil }
+
+func (d *failingDriver) UserData(userdata map[string]string, confirm bool) error { return nil }
+
+// Connect until the driver made the given number of attempts and return the delays between them
+func connectAttempts(t *testing.T, reportConnected bool, attempts int) []time.Duration {
+	t.Helper()
+
+	i := newTestIntegration(t, Config{})
+	driver := &failingDriver{reportConnected: reportConnected}
+	client := NewClient(i, driver)
+	client.Backoff = Backoff{Initial: 10 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	driver.client = client
+
+	client.Connect()
+	defer client.Shutdown()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		driver.mutex.Lock()
+		n := len(driver.attempts)
+		driver.mutex.Unlock()
+
+		if n >= attempts {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d connect attempts", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	var delays []time.Duration
+	for n := 1; n < attempts; n++ {
+		delays = append(delays, driver.attempts[n].Sub(driver.attempts[n-1]))
+	}
+
+	return delays
+}
+
+func TestBackoffIncreasesWhileTheConnectionFails(t *testing.T) {
+	delays := connectAttempts(t, false, 5)
+
+	// 10ms, 20ms, 40ms, 80ms
+	if delays[3] < 70*time.Millisecond {
+		t.Errorf("Expected increasing delays, got %v", delays)
+	}
+}
+
+func TestBackoffStartsOverAfterAConnectionWasEstablished(t *testing.T) {
+	delays := connectAttempts(t, true, 5)
+
+	// Each connection was established, so each reconnect starts with the initial delay instead of 80ms
+	if delays[3] >= 70*time.Millisecond {
+		t.Errorf("Expected the initial delay for each reconnect, got %v", delays)
+	}
+}
+
+// Driver that creates new entities on each connect, like the deconz, shelly and tasmota clients
+type reconnectingDriver struct {
+	i *Integration
+
+	mutex      sync.Mutex
+	light      *entities.LightEntity
+	subscribed int
+
+	connected chan struct{}
+}
+
+func (d *reconnectingDriver) Init() error { return nil }
+
+func (d *reconnectingDriver) Setup(ctx context.Context, setup_data SetupData) error { return nil }
+
+func (d *reconnectingDriver) Connect(ctx context.Context) error {
+	light := entities.NewLightEntity("light", entities.LanguageText{En: "Light"}, "")
+	light.AddFeature(entities.DimLightEntityFeatures)
+	light.SubscribeCallbackFunc = func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.subscribed++
+	}
+
+	d.mutex.Lock()
+	d.light = light
+	d.mutex.Unlock()
+
+	if err := d.i.AddEntity(light); err != nil {
+		return err
+	}
+
+	d.connected <- struct{}{}
+	<-ctx.Done()
+
+	return nil
+}
+
+func (d *reconnectingDriver) Disconnect() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.light = nil
+
+	return nil
+}
+
+func (d *reconnectingDriver) UserData(userdata map[string]string, confirm bool) error { return nil }
+
+// The light of the current connection as updated by the device
+func (d *reconnectingDriver) deviceLight() *entities.LightEntity {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.light
+}
+
+func entityBrightness(t *testing.T, i *Integration, entity_id string) interface{} {
+	t.Helper()
+
+	for _, state := range i.handleGetEntityStatesRequest(&GetEntityStatesMessageReq{}).MsgData {
+		if state.EntityId == entity_id {
+			return state.Attributes["brightness"]
+		}
+	}
+
+	t.Fatalf("No state of %s", entity_id)
+	return nil
+}
+
+func TestDeviceUpdatesAfterReconnectAreReported(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+
+	s := newTestSession(64, BlockQueuePolicy)
+	i.sessions[s.id] = s
+	i.subscribeEntities(s, []string{"light"})
+
+	driver := &reconnectingDriver{i: i, connected: make(chan struct{})}
+	client := NewClient(i, driver)
+
+	client.Connect()
+	<-driver.connected
+	driver.deviceLight().SetAttributes(map[string]interface{}{"brightness": 100})
+
+	client.Shutdown()
+	client.Connect()
+	defer client.Shutdown()
+	<-driver.connected
+
+	// The last known brightness until the device reports
+	if brightness := entityBrightness(t, i, "light"); brightness != 100 {
+		t.Errorf("Expected the last known brightness 100 after the reconnect, got %v", brightness)
+	}
+
+	driver.deviceLight().SetAttributes(map[string]interface{}{"brightness": 200})
+
+	if brightness := entityBrightness(t, i, "light"); brightness != 200 {
+		t.Errorf("Expected brightness 200 after the device update, got %v", brightness)
+	}
+
+	// Skip the device_state events
+	var received []string
+	for _, change := range decodeEntityChanges(t, s.queue.popAll()) {
+		if strings.HasPrefix(change, "light=") {
+			received = append(received, change)
+		}
+	}
+	if fmt.Sprint(received) != "[light=100 light=200]" {
+		t.Errorf("Expected the entity_change events of both connections, got %v", received)
+	}
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+	if driver.subscribed != 2 {
+		t.Errorf("Expected the devices of both connections to be subscribed, got %d subscribe calls", driver.subscribed)
+	}
+}
+
+func TestDeviceStateCanBeReadWhileReconnecting(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+	driver := &failingDriver{}
+	client := NewClient(i, driver)
+	client.Backoff = Backoff{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	driver.client = client
+
+	if state := client.GetDeviceState(); state != DisconnectedDeviceState {
+		t.Errorf("Expected %s before the first connect, got %s", DisconnectedDeviceState, state)
+	}
+
+	client.Connect()
+	defer client.Shutdown()
+
+	// Run with -race, the reconnect goroutine sets the state meanwhile
+	seen := map[DState]bool{}
+	deadline := time.Now().Add(10 * time.Second)
+	for !seen[ErrorDeviceState] || !seen[ConnectingDeviceState] {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the states of the reconnect, got %v", seen)
+		}
+		seen[client.GetDeviceState()] = true
+		time.Sleep(100 * time.Microsecond)
+	}
+}
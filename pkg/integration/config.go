@@ -11,5 +11,17 @@ type Config struct {
 	ConfigHome               string `mapstructure:"ucconfighome"`
 	RemoteTwoHost            string `mapstructure:"remoteTwoIP"`
 	RemoteTwoPort            int    `mapstructure:"remoteTwoPort"`
+	AuthMethod               string `mapstructure:"authMethod"`
+	AuthToken                string `mapstructure:"authToken"`
+	AuthTokenFile            string `mapstructure:"authTokenFile"`
+	QueueSize                int    `mapstructure:"queueSize"`
+	QueuePolicy              string `mapstructure:"queuePolicy"`
+	PersistEntityState       bool   `mapstructure:"persistEntityState"`
+	SecretsKey               string `mapstructure:"secretsKey"`
+	SecretsKeyFile           string `mapstructure:"secretsKeyFile"`
+	ValidateMessages         bool   `mapstructure:"validateMessages"`
+	RecordFile               string `mapstructure:"recordFile"`
+	AdminAPI                 bool   `mapstructure:"adminAPI"`
+	AdminToken               string `mapstructure:"adminToken"`
 	IgnoreEntitySubscription bool
 }
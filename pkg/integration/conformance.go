@@ -0,0 +1,34 @@
+package integration
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/splattner/goucrt/pkg/integration/apischema"
+)
+
+// Check a message of the session against the integration API schema and log the mismatching fields
+// Does nothing unless message validation is enabled
+func (s *session) validateMessage(direction string, msg []byte) {
+	if !s.validateMessages {
+		return
+	}
+
+	err := apischema.Validate(msg)
+	if err == nil {
+		return
+	}
+
+	fields := log.Fields{
+		"Direction":  direction,
+		"RawMessage": redactMessage(msg, s.isSecretKey),
+	}
+
+	if errors.Is(err, apischema.ErrUnknownMessage) {
+		log.WithFields(s.logFields()).WithFields(fields).Debug(err)
+		return
+	}
+
+	log.WithFields(s.logFields()).WithFields(fields).Warn(err)
+}
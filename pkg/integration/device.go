@@ -1,7 +1,10 @@
 package integration
 
 import (
+	"sort"
+
 	log "github.com/sirupsen/logrus"
+	"github.com/splattner/goucrt/pkg/entities"
 )
 
 type DState string
@@ -13,10 +16,71 @@ const (
 	ErrorDeviceState        DState = "ERROR"
 )
 
+// Set the state of the default device
 func (i *Integration) SetDeviceState(state DState) {
-	log.WithField("DeviceState", state).Info("Set Device State")
-	i.deviceState = state
+	i.SetDeviceStateById(i.DeviceId, state)
+}
+
+// Set the state of a device, e.g. one of several gateways managed by the driver
+// The device is known to the integration from its first state on
+func (i *Integration) SetDeviceStateById(device_id string, state DState) {
+	log.WithFields(log.Fields{"device_id": device_id, "DeviceState": state}).Info("Set Device State")
+
+	i.deviceStatesMutex.Lock()
+	i.deviceStates[device_id] = state
+	i.trackDeviceHealth(device_id, state)
+	i.deviceStatesMutex.Unlock()
+
+	// The hosting integration reports the combined state of its backends
+	if i.parent != nil && device_id == i.DeviceId {
+		i.parent.updateBackendsDeviceState()
+		return
+	}
 
 	// Notify remote about new state
-	i.sendDeviceStateEvent()
+	i.sendDeviceStateEvent(device_id)
+}
+
+// Return the state of a device, an unknown device is disconnected
+func (i *Integration) GetDeviceState(device_id string) DState {
+	i.deviceStatesMutex.RLock()
+	defer i.deviceStatesMutex.RUnlock()
+
+	if state, ok := i.deviceStates[device_id]; ok {
+		return state
+	}
+
+	return DisconnectedDeviceState
+}
+
+// Forget a device, e.g. when a gateway was removed from the setup
+func (i *Integration) RemoveDevice(device_id string) {
+	i.deviceStatesMutex.Lock()
+	defer i.deviceStatesMutex.Unlock()
+
+	delete(i.deviceStates, device_id)
+	delete(i.deviceUnhealthySince, device_id)
+}
+
+// Return the ids of all known devices, at least the default device
+func (i *Integration) DeviceIds() []string {
+	i.deviceStatesMutex.RLock()
+	defer i.deviceStatesMutex.RUnlock()
+
+	if len(i.deviceStates) == 0 {
+		return []string{i.DeviceId}
+	}
+
+	device_ids := make([]string, 0, len(i.deviceStates))
+	for device_id := range i.deviceStates {
+		device_ids = append(device_ids, device_id)
+	}
+	sort.Strings(device_ids)
+
+	return device_ids
+}
+
+// Check if an entity belongs to the device_id of a request, an empty device_id matches all entities
+func entityOfDevice(e entities.EntityInterface, device_id string) bool {
+	return device_id == "" || e.GetDeviceId() == device_id
 }
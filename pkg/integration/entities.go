@@ -5,421 +5,124 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/splattner/goucrt/pkg/entities"
-	"k8s.io/utils/strings/slices"
 )
 
-// Return the ID of an entity
-func (i *Integration) getEntityId(entity interface{}) string {
-	var id string
-
-	// Ugly.. I guess but I don't know how better
-	switch e := entity.(type) {
-	case *entities.Entity:
-		id = e.Id
-	case *entities.ButtonEntity:
-		id = e.Id
-
-	case *entities.LightEntity:
-		id = e.Id
-
-	case *entities.SwitchsEntity:
-		id = e.Id
-
-	case *entities.MediaPlayerEntity:
-		id = e.Id
-
-	case *entities.SensorEntity:
-		id = e.Id
-
-	case *entities.ClimateEntity:
-		id = e.Id
-
-	case *entities.CoverEntity:
-		id = e.Id
-
-	case *entities.RemoteEntity:
-		id = e.Id
-	}
-
-	return id
-}
-
-// Return the DeviceId of an entity
-func (i *Integration) getDeviceId(entity interface{}) string {
-	var device_id string
-
-	// Ugly.. I guess but I don't know how better
-	switch e := entity.(type) {
-	case *entities.Entity:
-		device_id = e.DeviceId
-	case *entities.ButtonEntity:
-		device_id = e.DeviceId
-
-	case *entities.LightEntity:
-		device_id = e.DeviceId
-
-	case *entities.SwitchsEntity:
-		device_id = e.DeviceId
-
-	case *entities.MediaPlayerEntity:
-		device_id = e.DeviceId
-
-	case *entities.SensorEntity:
-		device_id = e.DeviceId
-
-	case *entities.ClimateEntity:
-		device_id = e.DeviceId
-
-	case *entities.CoverEntity:
-		device_id = e.DeviceId
-
-	case *entities.RemoteEntity:
-		device_id = e.DeviceId
-	}
-
-	return device_id
-}
-
-// Return the EntityType of an entity
-func (i *Integration) getEntityType(entity interface{}) entities.EntityType {
-	var entity_type entities.EntityType
-
-	// Ugly.. I guess but I don't know how better
-	switch e := entity.(type) {
-	case *entities.Entity:
-		entity_type = e.EntityType
-	case *entities.ButtonEntity:
-		entity_type = e.EntityType
-
-	case *entities.LightEntity:
-		entity_type = e.EntityType
-
-	case *entities.SwitchsEntity:
-		entity_type = e.EntityType
-
-	case *entities.MediaPlayerEntity:
-		entity_type = e.EntityType
-
-	case *entities.SensorEntity:
-		entity_type = e.EntityType
-
-	case *entities.ClimateEntity:
-		entity_type = e.EntityType
-
-	case *entities.CoverEntity:
-		entity_type = e.EntityType
-
-	case *entities.RemoteEntity:
-		entity_type = e.EntityType
-	}
-
-	return entity_type
-}
-
-// Return the EntityType of an entity
-func (i *Integration) getEntityAttributes(entity interface{}) map[string]interface{} {
-	var attributes map[string]interface{}
-
-	// Ugly.. I guess but I don't know how better
-	switch e := entity.(type) {
-	case *entities.Entity:
-		attributes = e.GetAttribute()
-	case *entities.ButtonEntity:
-		attributes = e.GetAttribute()
-	case *entities.LightEntity:
-		attributes = e.GetAttribute()
-	case *entities.SwitchsEntity:
-		attributes = e.GetAttribute()
-	case *entities.MediaPlayerEntity:
-		attributes = e.GetAttribute()
-	case *entities.SensorEntity:
-		attributes = e.GetAttribute()
-	case *entities.ClimateEntity:
-		attributes = e.GetAttribute()
-	case *entities.CoverEntity:
-		attributes = e.GetAttribute()
-	case *entities.RemoteEntity:
-		attributes = e.GetAttribute()
-	}
-
-	return attributes
-}
-
 // Add a new Entity to the list of Entities (if not already added)
 // Also make sure the EntityChange Function is set so Entity Change Events are emitted when a Entity Attribute changes
 // Send Entity Available Event to RT
-func (i *Integration) AddEntity(e interface{}) error {
-	entity_id := i.getEntityId(e)
+func (i *Integration) AddEntity(e entities.EntityInterface) error {
+	// Entity ids of backends are namespaced with the backend name
+	e.SetId(i.backendKey(e.GetId()))
+
+	entity_id := e.GetId()
 	log.WithField("entity_id", entity_id).Debug("Add a new entity to the integration")
 
-	// Search if entity is already added
-	existingEntity, _, err := i.GetEntityById(entity_id)
-	if err != nil {
-		// Entity not found, so add id
-		i.setEntityChangeFunc(e, i.SendEntityChangeEvent)
-		i.Entities = append(i.Entities, e)
+	e.SetHandleEntityChangeFunc(i.SendEntityChangeEvent)
+
+	existingEntity, added := i.Entities.Add(e)
+	if added {
+		// Last known state until the device reports
+		i.restoreEntityState(e)
+
 		// Send "entity_available" event to remote
 		i.sendEntityAvailable(e)
 
 		// if RT already subscribed, call the Subscribe callback for this entity
 		if i.isSubscribed(e) {
-			i.callSubscribeCallback(e)
+			e.CallSubscribeCallback()
 		}
 
 		return nil
 	}
 
-	// else update the existing entity
-	return i.UpdateEntity(existingEntity, e)
-}
-
-func (i *Integration) isSubscribed(entity interface{}) bool {
-	entity_id := i.getEntityId(entity)
-
-	return slices.Contains(i.SubscribedEntities, entity_id)
+	// else the entity of a recreated device, e.g. after a reconnect, replaces the existing entity
+	return i.replaceEntity(existingEntity, e)
 }
 
-// Update an existing entity with a new entity
-func (i *Integration) UpdateEntity(entity interface{}, newEntity interface{}) error {
-	switch e := entity.(type) {
-	case *entities.ButtonEntity:
-		return e.UpdateEntity(newEntity.(entities.ButtonEntity))
-
-	case *entities.LightEntity:
-		return e.UpdateEntity(newEntity.(entities.LightEntity))
-
-	case *entities.SwitchsEntity:
-		return e.UpdateEntity(newEntity.(entities.SwitchsEntity))
+// Register the new entity instead of the existing one, so the entity the device updates is the one
+// reported to the Remote Two. The last known attributes are kept until the device reports them
+func (i *Integration) replaceEntity(existingEntity entities.EntityInterface, e entities.EntityInterface) error {
+	if existingEntity == e {
+		return nil
+	}
 
-	case *entities.MediaPlayerEntity:
-		return e.UpdateEntity(newEntity.(entities.MediaPlayerEntity))
+	if fmt.Sprintf("%T", existingEntity) != fmt.Sprintf("%T", e) {
+		return fmt.Errorf("cannot replace entity %s with an entity of type %T", e.GetId(), e)
+	}
 
-	case *entities.SensorEntity:
-		return e.UpdateEntity(newEntity.(entities.SensorEntity))
+	e.RestoreAttributes(existingEntity.GetAttribute())
 
-	case *entities.ClimateEntity:
-		return e.UpdateEntity(newEntity.(entities.ClimateEntity))
+	if _, err := i.Entities.Replace(e); err != nil {
+		return err
+	}
 
-	case *entities.CoverEntity:
-		return e.UpdateEntity(newEntity.(entities.CoverEntity))
+	log.WithField("entity_id", e.GetId()).Debug("Replaced entity of the integration")
 
-	case *entities.RemoteEntity:
-		return e.UpdateEntity(newEntity.(entities.RemoteEntity))
+	// The subscriptions are kept by id, the new device must be subscribed again
+	if i.isSubscribed(e) {
+		e.CallSubscribeCallback()
 	}
 
 	return nil
 }
 
+func (i *Integration) isSubscribed(entity entities.EntityInterface) bool {
+	return i.isSubscribedById(entity.GetId())
+}
+
+// Update an existing entity with a new entity
+func (i *Integration) UpdateEntity(entity entities.EntityInterface, newEntity entities.EntityInterface) error {
+	return entity.UpdateEntity(newEntity)
+}
+
 // Remove an Entity from the Integration
 // Send Entity Removed Event to RT
-func (i *Integration) RemoveEntity(entity interface{}) error {
+func (i *Integration) RemoveEntity(entity entities.EntityInterface) error {
 	// Search if entity is available
 
-	return i.RemoveEntityByID(i.getEntityId(entity))
+	return i.RemoveEntityByID(entity.GetId())
 
 }
 
 // Remove an Entity from the Integration
 // Send Entity Removed Event to RT
 func (i *Integration) RemoveEntityByID(entity_id string) error {
-	// Search if entity is available
 
-	entity, ix, err := i.GetEntityById(entity_id)
-	if err == nil {
+	entity_id = i.backendKey(entity_id)
 
-		i.Entities[ix] = i.Entities[len(i.Entities)-1] // Copy last element to index i.
-		i.Entities[len(i.Entities)-1] = ""             // Erase last element (write zero value).
-		i.Entities = i.Entities[:len(i.Entities)-1]    // Truncate slice.
+	entity, err := i.Entities.Remove(entity_id)
+	if err != nil {
+		return fmt.Errorf("entity to remove not found")
+	}
 
-		i.callUnubscribeCallback(entity)
+	entity.CallUnsubscribeCallback()
 
-		// Send "entity_removed" event to remote
-		i.sendEntityRemoved(entity)
-		return nil
+	if i.entityStates != nil {
+		i.entityStates.remove(entity_id)
 	}
 
-	return fmt.Errorf("entity to remove not found")
+	// Send "entity_removed" event to remote
+	i.sendEntityRemoved(entity)
+
+	return nil
 }
 
 // Return an Entity by its Name
-// Also return the current index in the Entities Array (TODO: do we need this?)
 // Error when Entity not found
-func (i *Integration) GetEntityById(id string) (interface{}, int, error) {
-	for ix, entity := range i.Entities {
-		entity_id := i.getEntityId(entity)
-
-		if entity_id == id {
-			return entity, ix, nil
-		}
-	}
-
-	return entities.Entity{}, 0, fmt.Errorf("entity with id %s not found", id)
+func (i *Integration) GetEntityById(id string) (entities.EntityInterface, error) {
+	return i.Entities.Get(i.backendKey(id))
 }
 
 // Return all available entities of a given type
-func (i *Integration) GetEntitiesByType(entityType entities.EntityType) []interface{} {
-	var es []interface{}
-
-	for _, e := range i.Entities {
-		if i.getEntityType(e) == entityType {
-			es = append(es, e)
-		}
-	}
-
-	return es
+func (i *Integration) GetEntitiesByType(entityType entities.EntityType) []entities.EntityInterface {
+	return i.Entities.ListByType(entityType)
 }
 
-// Call the correct HandleCommand function depending on the entity type
-func (i *Integration) handleCommand(entity interface{}, req *EntityCommandReq) int {
-	cmd_id := req.MsgData.CmdId
-	params := req.MsgData.Params
-
-	// Ugly.. I guess but I don't know how better
-	switch e := entity.(type) {
-	case *entities.ButtonEntity:
-		return e.HandleCommand(cmd_id)
-
-	case *entities.LightEntity:
-		return e.HandleCommand(cmd_id, params)
-
-	case *entities.SwitchsEntity:
-		return e.HandleCommand(cmd_id, params)
-
-	case *entities.MediaPlayerEntity:
-		return e.HandleCommand(cmd_id, params)
-
-	case *entities.ClimateEntity:
-		return e.HandleCommand(cmd_id, params)
-
-	case *entities.CoverEntity:
-		return e.HandleCommand(cmd_id, params)
-
-	case *entities.SensorEntity:
-		// Sensor do not have commands
-
-	case *entities.RemoteEntity:
-		return e.HandleCommand(cmd_id, params)
+// Call the typed function of the entity with the decoded params or its HandleCommand function
+func (i *Integration) handleCommand(entity entities.EntityInterface, req *EntityCommandReq, params entities.CommandParams) error {
+	if handled, err := entity.HandleDecodedCommand(req.MsgData.CmdId, req.MsgData.Params, params); handled {
+		return err
 	}
 
-	return 404
-}
-
-// Call the correct HandleCommand function depending on the entity type
-func (i *Integration) setEntityChangeFunc(entity interface{}, f func(interface{}, *map[string]interface{})) {
-
-	// Ugly.. I guess but I don't know how better
-	switch e := entity.(type) {
-	case *entities.Entity:
-		e.SetHandleEntityChangeFunc(f)
-	case *entities.SensorEntity:
-		e.SetHandleEntityChangeFunc(f)
-	case *entities.ButtonEntity:
-		e.SetHandleEntityChangeFunc(f)
-	case *entities.LightEntity:
-		e.SetHandleEntityChangeFunc(f)
-	case *entities.SwitchsEntity:
-		e.SetHandleEntityChangeFunc(f)
-	case *entities.MediaPlayerEntity:
-		e.SetHandleEntityChangeFunc(f)
-	case *entities.ClimateEntity:
-		e.SetHandleEntityChangeFunc(f)
-	case *entities.CoverEntity:
-		e.SetHandleEntityChangeFunc(f)
-	case *entities.RemoteEntity:
-		e.SetHandleEntityChangeFunc(f)
-	}
-}
-
-// Call the correct subscribe Callback Func depending on the entity type
-func (i *Integration) callSubscribeCallback(entity interface{}) {
-
-	// Ugly.. I guess but I don't know how better
-	switch e := entity.(type) {
-	case *entities.ButtonEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-
-	case *entities.LightEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-
-	case *entities.SwitchsEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-
-	case *entities.MediaPlayerEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-
-	case *entities.ClimateEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-
-	case *entities.CoverEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-
-	case *entities.SensorEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-
-	case *entities.RemoteEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-	}
-}
-
-// Call the correct unsubscribe Callback Func depending on the entity type
-func (i *Integration) callUnubscribeCallback(entity interface{}) {
-
-	// Ugly.. I guess but I don't know how better
-	switch e := entity.(type) {
-	case *entities.ButtonEntity:
-		if e.UnsubscribeCallbackFunc != nil {
-			e.UnsubscribeCallbackFunc()
-		}
-
-	case *entities.LightEntity:
-		if e.UnsubscribeCallbackFunc != nil {
-			e.UnsubscribeCallbackFunc()
-		}
-
-	case *entities.SwitchsEntity:
-		if e.UnsubscribeCallbackFunc != nil {
-			e.UnsubscribeCallbackFunc()
-		}
-
-	case *entities.MediaPlayerEntity:
-		if e.UnsubscribeCallbackFunc != nil {
-			e.UnsubscribeCallbackFunc()
-		}
-
-	case *entities.ClimateEntity:
-		if e.UnsubscribeCallbackFunc != nil {
-			e.UnsubscribeCallbackFunc()
-		}
-
-	case *entities.CoverEntity:
-		if e.SubscribeCallbackFunc != nil {
-			e.SubscribeCallbackFunc()
-		}
-
-	case *entities.SensorEntity:
-		if e.UnsubscribeCallbackFunc != nil {
-			e.UnsubscribeCallbackFunc()
-		}
-
-	case *entities.RemoteEntity:
-		if e.UnsubscribeCallbackFunc != nil {
-			e.UnsubscribeCallbackFunc()
-		}
-	}
+	return entity.HandleCommand(req.MsgData.CmdId, req.MsgData.Params)
 }
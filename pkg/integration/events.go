@@ -2,15 +2,23 @@ package integration
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/websocket"
-	"k8s.io/utils/strings/slices"
+	"github.com/splattner/goucrt/pkg/entities"
 )
 
+// Send an event to all sessions
 func (i *Integration) sendEventMessage(res *interface{}, messageType int) error {
+	return i.sendEventMessageTo(res, messageType, func(s *session) bool { return true })
+}
+
+// Send an event to all sessions matching the filter
+// Sessions in standby mode do not receive events
+func (i *Integration) sendEventMessageTo(res *interface{}, messageType int, filter func(*session) bool) error {
 
 	msg, _ := json.Marshal(res)
 
@@ -21,27 +29,44 @@ func (i *Integration) sendEventMessage(res *interface{}, messageType int) error
 		return err
 	}
 
-	if i.Remote.standby {
-		log.WithFields(log.Fields{
-			"Message": event.Msg,
-			"Kind":    event.Kind,
-			"standby": i.Remote.standby,
-		}).Info("Remote is in standby mode or not (yet) connected, not sending event / no websocket")
-		return nil
-	}
+	for _, s := range i.getSessions() {
 
-	log.WithFields(log.Fields{
-		"Message": event.Msg,
-		"Kind:":   event.Kind,
-		"Data":    event.MsgData,
-	}).Info("Send Event Message")
+		if !filter(s) {
+			continue
+		}
 
-	select {
-	case i.Remote.messageChannel <- msg:
-		log.Debug("Message sent for processing")
-	default:
-		log.Debug("Message Channel not ready")
+		if s.InStandBy() {
+			// Keep the latest entity changes, they are sent on exit_standby
+			if entityChange, ok := (*res).(EntityChangeEvent); ok {
+				log.WithFields(s.logFields()).WithField("entity_id", entityChange.MsgData.EntityId).Debug("Remote is in standby mode, collect entity change")
+				s.pending.add(&entityChange)
+				continue
+			}
+
+			log.WithFields(s.logFields()).WithFields(log.Fields{
+				"Message": event.Msg,
+				"Kind":    event.Kind,
+			}).Info("Remote is in standby mode, not sending event")
+			continue
+		}
+
+		log.WithFields(s.logFields()).WithFields(log.Fields{
+			"Message": event.Msg,
+			"Kind:":   event.Kind,
+			"Data":    event.MsgData,
+		}).Info("Send Event Message")
+
+		var err error
+		if entityChange, ok := (*res).(EntityChangeEvent); ok {
+			// entity_change events may be coalesced in the outbound queue
+			err = s.sendEntityChange(&entityChange)
+		} else {
+			err = s.send(msg)
+		}
 
+		if err != nil {
+			log.WithError(err).Debug("Message not sent")
+		}
 	}
 
 	return nil
@@ -49,16 +74,17 @@ func (i *Integration) sendEventMessage(res *interface{}, messageType int) error
 }
 
 // Handle events received from the Remote
-func (i *Integration) handleEvent(req *RequestMessage, p []byte) interface{} {
+func (i *Integration) handleEvent(s *session, req *RequestMessage, p []byte) interface{} {
 
 	var res interface{}
 
 	switch req.Msg {
 	case "enter_standby":
-		i.Remote.EnterStandBy()
+		s.EnterStandBy()
 
 	case "exit_standby":
-		i.Remote.ExitStandBy()
+		s.ExitStandBy()
+		i.replayPendingChanges(s)
 
 	case "connect":
 		connectEvent := ConnectEvent{}
@@ -96,15 +122,15 @@ func (i *Integration) handleEvent(req *RequestMessage, p []byte) interface{} {
 
 }
 
-func (i *Integration) sendEntityRemoved(e interface{}) {
+func (i *Integration) sendEntityRemoved(e entities.EntityInterface) {
 
 	var res interface{}
 	now := time.Now()
 
 	msg_data := EntityRemovedEventData{
-		DeviceId:   i.getDeviceId(e),
-		EntityType: i.getEntityType(e).Type,
-		EntityId:   i.getEntityId(e),
+		DeviceId:   e.GetDeviceId(),
+		EntityType: e.GetEntityType().Type,
+		EntityId:   e.GetId(),
 	}
 
 	res = EntityRemovedEvent{
@@ -122,7 +148,7 @@ func (i *Integration) sendEntityRemoved(e interface{}) {
 	}
 }
 
-func (i *Integration) sendEntityAvailable(e interface{}) {
+func (i *Integration) sendEntityAvailable(e entities.EntityInterface) {
 
 	var res interface{}
 	now := time.Now()
@@ -138,22 +164,26 @@ func (i *Integration) sendEntityAvailable(e interface{}) {
 	}
 
 	// Only send event when connected, otherwise we assume this is still during setup e.g. discovering of entities
-	if i.deviceState == ConnectedDeviceState {
+	if i.GetDeviceState(e.GetDeviceId()) == ConnectedDeviceState {
 		if err := i.sendEventMessage(&res, websocket.TextMessage); err != nil {
 			log.WithError(err).Error("Cannot send Event Message")
 		}
 	}
 }
 
-func (i *Integration) sendDeviceStateEvent() {
-
-	var res interface{}
+func (i *Integration) deviceStateEvent(device_id string) interface{} {
 
 	now := time.Now()
-	res = DeviceStateEventMessage{
+	return DeviceStateEventMessage{
 		CommonEvent{Kind: "event", Msg: "device_state", Cat: "DEVICE", Ts: now.Format(time.RFC3339)},
-		DeviceState{DeviceId: DeviceId{DeviceId: i.DeviceId}, State: string(i.deviceState)},
+		DeviceState{DeviceId: DeviceId{DeviceId: device_id}, State: string(i.GetDeviceState(device_id))},
 	}
+}
+
+// Send the state of a device to all sessions
+func (i *Integration) sendDeviceStateEvent(device_id string) {
+
+	res := i.deviceStateEvent(device_id)
 
 	if err := i.sendEventMessage(&res, websocket.TextMessage); err != nil {
 		log.WithError(err).Error("Cannot send Event Message")
@@ -188,6 +218,17 @@ func (i *Integration) handleConnectEvent(e *ConnectEvent) {
 
 	// Cat should be "DEVICE"
 
+	// Connect the backends in parallel, each client takes its time to connect
+	var wg sync.WaitGroup
+	for _, backend := range i.getBackends() {
+		wg.Add(1)
+		go func(backend *Integration) {
+			defer wg.Done()
+			backend.handleConnectEvent(e)
+		}(backend)
+	}
+	wg.Wait()
+
 	switch e.Msg {
 	case "connect":
 		// Call the handler of the client
@@ -208,59 +249,66 @@ func (i *Integration) handleConnectEvent(e *ConnectEvent) {
 // Further messages from the integration from the setup process will be ignored afterwards.
 func (i *Integration) handleAbortDriverSetupEvent(e *AbortDriverSetupEvent) {
 	log.Info("Abort Driver Setup")
-	// TODO: implement something?
+
+	i.abortSetup()
 }
 
 // Emitted when an attribute of an entity changes, e.g. is switched off.
 // Either after an entity_command or if the entity is updated manually through a user or an external system.
 // This keeps the Remote Two in sync with the real state of the entity without the need of constant polling.
-func (i *Integration) SendEntityChangeEvent(e interface{}, a *map[string]interface{}) {
+func (i *Integration) SendEntityChangeEvent(e entities.EntityInterface, a *map[string]interface{}) {
 
-	entity_id := i.getEntityId(e)
+	entity_id := e.GetId()
 
 	log.WithField("entity_id", entity_id).Debug("Send Entity Change Event if subscribed")
-	log.WithField("subscribedEtities", i.SubscribedEntities).Debug("Currently subscribed entities")
 
-	// Only send the event when remote is subscribed to
-	if i.Config.IgnoreEntitySubscription || slices.Contains(i.SubscribedEntities, entity_id) {
+	i.saveEntityState(e)
 
-		var res interface{}
+	// Only send the event to sessions subscribed to the entity
+	subscribed := func(s *session) bool {
+		return i.Config.IgnoreEntitySubscription || s.subscriptions.Contains(entity_id)
+	}
 
-		// UTC time for event timestamp
-		loc, _ := time.LoadLocation("UTC")
-		now := time.Now().In(loc)
-		timeformat := "2006-01-02T15:04:05.999999999Z"
+	var attributes map[string]interface{}
+	//if attributes is set, only send thos
+	if a == nil {
+		attributes = e.GetAttribute()
+	} else {
+		attributes = *a
+	}
 
-		device_id := i.getDeviceId(e)
+	// UTC time for event timestamp
+	loc, _ := time.LoadLocation("UTC")
+	now := time.Now().In(loc)
+	timeformat := "2006-01-02T15:04:05.999999999Z"
 
-		entity_type := i.getEntityType(e)
+	event := EntityChangeEvent{
+		CommonEvent{
+			Kind: "event",
+			Msg:  "entity_change",
+			Cat:  "ENTITY",
+			Ts:   now.Format(timeformat),
+		},
+		EntityChangeData{
+			DeviceId:   e.GetDeviceId(),
+			EntityId:   entity_id,
+			EntityType: e.GetEntityType().Type,
+			Attributes: attributes,
+		},
+	}
 
-		var attributes map[string]interface{}
-		//if attributes is set, only send thos
-		if a == nil {
-			attributes = i.getEntityAttributes(e)
-		} else {
-			attributes = *a
-		}
+	if i.Config.IgnoreEntitySubscription || i.isSubscribedById(entity_id) {
 
-		res = EntityChangeEvent{
-			CommonEvent{
-				Kind: "event",
-				Msg:  "entity_change",
-				Cat:  "ENTITY",
-				Ts:   now.Format(timeformat),
-			},
-			EntityChangeData{
-				DeviceId:   device_id,
-				EntityId:   entity_id,
-				EntityType: entity_type.Type,
-				Attributes: attributes,
-			},
-		}
+		var res interface{} = event
 
-		if err := i.sendEventMessage(&res, websocket.TextMessage); err != nil {
+		if err := i.sendEventMessageTo(&res, websocket.TextMessage, subscribed); err != nil {
 			log.WithError(err).Error("Cannot send Event Message")
 		}
 	}
 
+	// Also collect the change for Remote Twos that disconnected while in standby
+	i.addDetachedChange(&event)
+
+	i.publishAdminEvent(&event)
+
 }
@@ -0,0 +1,139 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Path of the liveness probe on the HTTP server of the integration
+	healthzPath = "/healthz"
+	// Path of the readiness probe on the HTTP server of the integration
+	readyzPath = "/readyz"
+)
+
+// Time a device may be connecting or in error before the integration is reported unhealthy
+// Longer than the maximum reconnect delay, so a device that keeps failing to reconnect makes the integration unhealthy
+const unhealthyAfter = 5 * time.Minute
+
+// State of a device as reported by the health endpoints
+type deviceStatus struct {
+	// Name of the backend of the device, empty for devices of the integration itself
+	Backend  string `json:"backend,omitempty"`
+	DeviceId string `json:"device_id"`
+	State    DState `json:"state"`
+	// False if the integration of the device has no setup data, its state is ignored for readiness
+	Configured bool `json:"configured"`
+	// Since when the device is connecting or in error, nil if it is connected or disconnected
+	UnhealthySince *time.Time `json:"unhealthy_since,omitempty"`
+}
+
+// Response of the health endpoints
+type healthResponse struct {
+	Status  string         `json:"status"`
+	Devices []deviceStatus `json:"devices"`
+}
+
+// Remember since when a device is connecting or in error
+// Must be called with the deviceStatesMutex locked
+func (i *Integration) trackDeviceHealth(device_id string, state DState) {
+	switch state {
+	case ConnectingDeviceState, ErrorDeviceState:
+		if _, ok := i.deviceUnhealthySince[device_id]; !ok {
+			i.deviceUnhealthySince[device_id] = time.Now()
+		}
+	default:
+		delete(i.deviceUnhealthySince, device_id)
+	}
+}
+
+// Return the state of all devices of the integration and its backends
+func (i *Integration) deviceStatuses() []deviceStatus {
+	statuses := i.ownDeviceStatuses()
+
+	for _, backend := range i.getBackends() {
+		statuses = append(statuses, backend.ownDeviceStatuses()...)
+	}
+
+	return statuses
+}
+
+func (i *Integration) ownDeviceStatuses() []deviceStatus {
+	device_ids := i.DeviceIds()
+	statuses := make([]deviceStatus, 0, len(device_ids))
+	configured := !isEmptySetupData(i.GetSetupData())
+
+	i.deviceStatesMutex.RLock()
+	defer i.deviceStatesMutex.RUnlock()
+
+	for _, device_id := range device_ids {
+		status := deviceStatus{Backend: i.backendName, DeviceId: device_id, State: DisconnectedDeviceState, Configured: configured}
+
+		if state, ok := i.deviceStates[device_id]; ok {
+			status.State = state
+		}
+
+		if since, ok := i.deviceUnhealthySince[device_id]; ok {
+			status.UnhealthySince = &since
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// Liveness probe, fails if a device is connecting or in error for longer than unhealthyAfter
+// A driver that cannot reconnect to its devices is considered wedged and should be restarted
+func (i *Integration) healthzEndpoint(w http.ResponseWriter, r *http.Request) {
+	devices := i.deviceStatuses()
+
+	healthy := true
+	for _, device := range devices {
+		if device.UnhealthySince != nil && time.Since(*device.UnhealthySince) > unhealthyAfter {
+			healthy = false
+		}
+	}
+
+	writeHealthResponse(w, healthy, devices)
+}
+
+// Readiness probe, succeeds while the server is up and no configured device is connecting or in error
+// Unconfigured devices and devices the Remote Two did not ask to connect yet are disconnected and ignored,
+// clients only connect after the connect event of the Remote Two
+func (i *Integration) readyzEndpoint(w http.ResponseWriter, r *http.Request) {
+	devices := i.deviceStatuses()
+
+	ready := i.serving.Load()
+	for _, device := range devices {
+		if !device.Configured {
+			continue
+		}
+
+		if device.State == ConnectingDeviceState || device.State == ErrorDeviceState {
+			ready = false
+		}
+	}
+
+	writeHealthResponse(w, ready, devices)
+}
+
+func writeHealthResponse(w http.ResponseWriter, ok bool, devices []deviceStatus) {
+	res := healthResponse{Status: "ok", Devices: devices}
+	code := http.StatusOK
+
+	if !ok {
+		res.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.WithError(err).Debug("Cannot write health response")
+	}
+}
@@ -0,0 +1,75 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func readyzCode(i *Integration) int {
+	w := httptest.NewRecorder()
+	i.readyzEndpoint(w, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+
+	return w.Code
+}
+
+func TestReadyzRequiresTheServer(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+
+	if code := readyzCode(i); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the server is up, got %d", code)
+	}
+
+	i.serving.Store(true)
+	if code := readyzCode(i); code != http.StatusOK {
+		t.Errorf("Expected 200 once the server is up, got %d", code)
+	}
+}
+
+func TestReadyzIgnoresUnconfiguredAndDisconnectedDevices(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+	i.serving.Store(true)
+
+	// Unconfigured devices do not block readiness
+	i.SetDeviceState(ErrorDeviceState)
+	if code := readyzCode(i); code != http.StatusOK {
+		t.Errorf("Expected 200 with an unconfigured device, got %d", code)
+	}
+
+	i.SetSetupData(SetupData{"ipaddr": "10.0.0.1"})
+
+	// The Remote Two did not ask to connect yet
+	i.SetDeviceState(DisconnectedDeviceState)
+	if code := readyzCode(i); code != http.StatusOK {
+		t.Errorf("Expected 200 with a disconnected device, got %d", code)
+	}
+
+	for _, state := range []DState{ConnectingDeviceState, ErrorDeviceState} {
+		i.SetDeviceState(state)
+		if code := readyzCode(i); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 with a %s device, got %d", state, code)
+		}
+	}
+
+	i.SetDeviceState(ConnectedDeviceState)
+	if code := readyzCode(i); code != http.StatusOK {
+		t.Errorf("Expected 200 with a connected device, got %d", code)
+	}
+}
+
+func TestReadyzIgnoresBackendsWithoutSetupData(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+	i.serving.Store(true)
+
+	configured := i.AddBackend("configured")
+	configured.SetSetupData(SetupData{"ipaddr": "10.0.0.1"})
+	configured.SetDeviceState(ConnectedDeviceState)
+
+	// Skipped by the multi driver because it has no setup data, it never connects
+	skipped := i.AddBackend("skipped")
+	skipped.SetDeviceState(DisconnectedDeviceState)
+
+	if code := readyzCode(i); code != http.StatusOK {
+		t.Errorf("Expected 200 with a skipped backend, got %d", code)
+	}
+}
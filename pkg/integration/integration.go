@@ -1,61 +1,158 @@
 package integration
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/grandcat/zeroconf"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const API_VERSION = "0.10.0"
 
+// Time allowed to close all connections on shutdown
+const shutdownTimeout = 10 * time.Second
+
 type Integration struct {
 	DeviceId string
 	DriverId string
 
 	Metadata *DriverMetadata
 
-	//authToken string
-
-	deviceState DState
+	// Connection state by device id, the default device has the DeviceId of the integration
+	deviceStates map[string]DState
+	// Since when a device is connecting or in error, by device id
+	deviceUnhealthySince map[string]time.Time
+	deviceStatesMutex    sync.RWMutex
 
 	Config        Config
 	listenAddress string
 
-	Remote remote
+	// Websocket sessions of connected Remote Twos
+	sessions      map[string]*session
+	sessionsMutex sync.RWMutex
+
+	// Serializes subscription changes across sessions
+	subscriptionsMutex sync.Mutex
+
+	eventMetrics eventMetrics
+
+	// Prometheus metrics, nil for backends
+	metrics *metrics
+
+	// Entity changes for Remote Twos that disconnected while in standby, by host
+	detachedChanges      map[string]*detachedChanges
+	detachedChangesMutex sync.Mutex
 
-	Entities []interface{}
+	Entities *EntityRegistry
 
-	SubscribedEntities []string
+	// Last known entity states, nil if not persisted
+	entityStates *entityStateStore
 
-	handleSetupFunction             func(SetupData)
+	// Records the websocket frames of all sessions, nil if not recording
+	recorder *recorder
+
+	// Entity change streams of the admin API, nil if the admin API is disabled
+	adminEvents *adminEvents
+
+	// Set while the server accepts connections of the Remote Two
+	serving atomic.Bool
+
+	handleSetupFunction             func(context.Context, SetupData)
 	handleConnectionFunction        func(*ConnectEvent)
 	handleSetDriverUserDataFunction func(map[string]string, bool)
+	handleShutdownFunction          func()
+
+	handleReconfigureFunction func()
+
+	setupFlow *SetupFlow
 
+	// Running driver setup, nil if no setup is running
+	setup      *driverSetup
+	setupMutex sync.Mutex
+
+	// Settings page of the last requested user action, the input of set_driver_user_data is validated against it
+	userActionPage *SettigsPage
+
+	// Integration hosting this backend, nil if this is not a backend
+	parent      *Integration
+	backendName string
+	// Notified when the setup of this backend stopped
+	setupResult chan backendSetupResult
+
+	// Backends hosted by this integration
+	backends           []*Integration
+	backendsMutex      sync.Mutex
+	backendSetupCancel context.CancelFunc
+
+	// Deprecated: not updated by the integration, use GetSetupState
 	SetupState DriverSetupState
 
-	SetupData SetupData
+	// Last setup state sent to the Remote Twos
+	setupState DriverSetupState
+
+	// Use GetSetupData and SetSetupData, the setup data is changed by the setup while clients read it
+	setupData      SetupData
+	setupDataMutex sync.RWMutex
+	// Why the persisted setup data could not be loaded, the file is then not overwritten
+	setupDataLoadErr error
+
+	// Migrations of persisted setup data by version they migrate from
+	setupDataMigrations map[int]SetupDataMigration
+
+	// Key to encrypt secrets of the setup data on disk, nil if not configured
+	secretsKey []byte
 
 	mdns *zeroconf.Server
 }
 
 func NewIntegration(config Config) (*Integration, error) {
 
+	if err := config.validateAuth(); err != nil {
+		return nil, err
+	}
+
+	if err := config.validateQueue(); err != nil {
+		return nil, err
+	}
+
+	if err := config.validateAdmin(); err != nil {
+		return nil, err
+	}
+
+	secretsKey, err := config.secretsKey()
+	if err != nil {
+		return nil, err
+	}
+
 	i := Integration{
 		Config: config,
 		// TODO: for the moment, only IPv4, as somehow the behaviour seems strange when both.. not investigated though
-		listenAddress: fmt.Sprintf("0.0.0.0:%d", config.ListenPort),
-		deviceState:   DisconnectedDeviceState,
-		DeviceId:      "", // I think device_id is not yet implemented in Remote TV, used for multi-device integrati
+		listenAddress:        fmt.Sprintf("0.0.0.0:%d", config.ListenPort),
+		deviceStates:         make(map[string]DState),
+		deviceUnhealthySince: make(map[string]time.Time),
+		DeviceId:             "", // Default device, drivers managing several devices use SetDeviceStateById
+
+		Entities: NewEntityRegistry(),
+		sessions: make(map[string]*session),
+
+		detachedChanges: make(map[string]*detachedChanges),
 
+		secretsKey: secretsKey,
 	}
 
-	i.Remote.messageChannel = make(chan []byte)
-	i.Remote.controlChannel = make(chan string)
+	i.metrics = newMetrics(&i)
+
+	if config.AdminAPI {
+		i.adminEvents = newAdminEvents()
+	}
 
 	return &i, nil
 
@@ -65,43 +162,143 @@ func (i *Integration) SetMetadata(metadata *DriverMetadata) {
 	log.WithField("Metadata", metadata).Debug("Set Metadata")
 	i.Metadata = metadata
 
-	i.LoadSetupData()
+	// Announce the configured authentication method
+	if i.Config.AuthMethod != "" {
+		i.Metadata.AuthMethod = i.Config.AuthMethod
+	}
+
+	if err := i.LoadSetupData(); err != nil {
+		log.WithError(err).Error("Cannot load setup data, it is not persisted until it can be loaded")
+	}
+
+	if i.Config.PersistEntityState {
+		i.loadEntityStates()
+	}
 }
 
-func (i *Integration) Run() error {
-	log.Info("Start Remote Two integration")
+// Run the integration until the context is cancelled
+// On cancellation all websockets are closed cleanly, a final DISCONNECTED device state is sent,
+// mDNS advertisement is stopped and the client is disconnected
+func (i *Integration) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", i.listenAddress)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", i.listenAddress, err)
+	}
 
-	defer func() {
-		i.stopAdvertising()
-	}()
+	return i.Serve(ctx, listener)
+}
+
+// Run the integration on the listener until the context is cancelled, see Run
+// The listener is closed when Serve returns
+func (i *Integration) Serve(ctx context.Context, listener net.Listener) error {
+	log.Info("Start Remote Two integration")
 
 	if i.Metadata == nil {
-		log.Panic("Metadata not set, cannot start Remote Two integration")
-		return fmt.Errorf("Metadata not set")
+		listener.Close()
+		return fmt.Errorf("metadata not set, cannot start Remote Two integration")
+	}
+
+	if i.Config.RecordFile != "" {
+		recorder, err := openRecorder(i.Config.RecordFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		i.recorder = recorder
 	}
 
-	http.HandleFunc(i.Config.WebsocketPath, i.wsEndpoint)
+	mux := http.NewServeMux()
+	mux.HandleFunc(i.Config.WebsocketPath, i.wsEndpoint)
+	mux.Handle(metricsPath, promhttp.HandlerFor(i.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc(healthzPath, i.healthzEndpoint)
+	mux.HandleFunc(readyzPath, i.readyzEndpoint)
+
+	server := &http.Server{
+		Handler: mux,
+	}
+
+	if i.Config.AdminAPI {
+		i.handleAdmin(mux, server)
+	}
 
 	//MDNS
 	if !i.Config.DisableMDNS {
-		go i.startAdvertising()
+		if err := i.startAdvertising(); err != nil {
+			listener.Close()
+			i.recorder.close()
+			return fmt.Errorf("cannot start mDNS advertisement: %w", err)
+		}
 	}
 
 	// Register the integration
 	if i.Config.EnableRegistration && i.Config.RegistrationPin != "" {
-		go i.registerIntegration()
+		go func() {
+			if err := i.registerIntegration(ctx); err != nil {
+				log.WithError(err).Error("Cannot register integration with Remote Two")
+			}
+		}()
+	}
+
+	serverErr := make(chan error, 1)
+	i.serving.Store(true)
+	go func() {
+		log.WithField("Address", listener.Addr().String()).Debug("Listen for new Websocket connection")
+		serverErr <- server.Serve(listener)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Info("Stopping Remote Two integration")
+	case err = <-serverErr:
+		log.WithError(err).Error("Websocket server stopped")
+	}
+
+	i.serving.Store(false)
+	i.shutdown(server)
+
+	return err
+}
+
+// Graceful shutdown of the integration
+func (i *Integration) shutdown(server *http.Server) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	i.stopAdvertising()
+
+	for _, backend := range i.getBackends() {
+		if backend.handleShutdownFunction != nil {
+			backend.handleShutdownFunction()
+		}
+
+		backend.flushEntityStates()
+	}
+
+	if i.handleShutdownFunction != nil {
+		i.handleShutdownFunction()
 	}
 
-	log.Debug("Listen for new Websocket connection")
+	i.flushEntityStates()
 
-	log.Fatal(http.ListenAndServe(i.listenAddress, nil))
+	// Final device states, sent before the websockets are closed
+	for _, device_id := range i.DeviceIds() {
+		i.SetDeviceStateById(device_id, DisconnectedDeviceState)
+	}
 
-	return nil
+	i.closeSessions(ctx)
 
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("Cannot shutdown websocket server")
+	}
+
+	i.recorder.close()
 }
 
 // Set the function which is called when the setup_driver request was sent by the remote
-func (i *Integration) SetHandleSetupFunction(f func(SetupData)) {
+// The context is cancelled when the remote aborts the setup
+func (i *Integration) SetHandleSetupFunction(f func(context.Context, SetupData)) {
 	i.handleSetupFunction = f
 }
 
@@ -115,6 +312,11 @@ func (i *Integration) SetHandleSetDriverUserDataFunction(f func(map[string]strin
 	i.handleSetDriverUserDataFunction = f
 }
 
+// Set the function which is called when the integration shuts down
+func (i *Integration) SetHandleShutdownFunction(f func()) {
+	i.handleShutdownFunction = f
+}
+
 // Set and then Send the Driver Setup State to Remote two
 func (i *Integration) SetDriverSetupState(event_Type DriverSetupEventType, state DriverSetupState, err DriverSetupError, requireUserAction *RequireUserAction) {
 
@@ -129,31 +331,41 @@ func (i *Integration) SetDriverSetupState(event_Type DriverSetupEventType, state
 		state = WaitUserActionState
 	}
 
+	i.setupMutex.Lock()
+	i.userActionPage = userActionSettingsPage(requireUserAction)
+	i.setupMutex.Unlock()
+
+	if i.parent != nil && event_Type == StopEvent {
+		// The hosting integration reports the end of the setup once all backends are set up
+		i.handleSetupStateChange(event_Type, state)
+		i.backendSetupStopped(state, err)
+		return
+	}
+
+	i.recordSetupState(state)
 	i.sendDriverSetupChangeEvent(event_Type, state, err, requireUserAction)
 
-}
+	i.handleSetupStateChange(event_Type, state)
 
-// Load persist setupData File
-// TODO: handle location via ENV's
-func (i *Integration) LoadSetupData() {
+}
 
-	file, err := os.ReadFile(i.Config.ConfigHome + i.Metadata.DriverId + ".json")
-	if err != nil {
-		log.WithError(err).Info("Cannot read setupDataFile")
-		i.SetupData = make(SetupData)
-	} else {
-		if err := json.Unmarshal(file, &i.SetupData); err != nil {
-			log.WithError(err).Error("Cannot unmarshall setSetupDataupdata")
-		}
-		log.WithField("SetupData", i.SetupData).Info("Read persisted setup data")
+// Remember the setup state sent to the Remote Twos, backends send it for the hosting integration
+func (i *Integration) recordSetupState(state DriverSetupState) {
+	if i.parent != nil {
+		i.parent.recordSetupState(state)
+		return
 	}
+
+	i.setupMutex.Lock()
+	defer i.setupMutex.Unlock()
+
+	i.setupState = state
 }
 
-// Persist File
-// TODO: handle location via ENV's
-func (i *Integration) PersistSetupData() {
+// Return the last setup state sent to the Remote Twos, empty if no setup ran
+func (i *Integration) GetSetupState() DriverSetupState {
+	i.setupMutex.Lock()
+	defer i.setupMutex.Unlock()
 
-	log.WithField("SetupData", i.SetupData).Info("Persist setup data")
-	file, _ := json.MarshalIndent(i.SetupData, "", " ")
-	_ = os.WriteFile(i.Config.ConfigHome+i.Metadata.DriverId+".json", file, 0644)
+	return i.setupState
 }
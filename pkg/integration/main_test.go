@@ -0,0 +1,35 @@
+package integration
+
+import (
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the test output readable, the integration logs every message on info level
+	log.SetLevel(log.ErrorLevel)
+
+	os.Exit(m.Run())
+}
+
+// Return an integration with metadata and the configuration directory in a temporary directory
+func newTestIntegration(t *testing.T, config Config) *Integration {
+	t.Helper()
+
+	config.ConfigHome = t.TempDir() + "/"
+	config.DisableMDNS = true
+	if config.WebsocketPath == "" {
+		config.WebsocketPath = "/ws"
+	}
+
+	i, err := NewIntegration(config)
+	if err != nil {
+		t.Fatalf("Cannot create integration: %v", err)
+	}
+
+	i.SetMetadata(&DriverMetadata{DriverId: "test", Name: LanguageText{En: "Test"}, Version: "0.0.1"})
+
+	return i
+}
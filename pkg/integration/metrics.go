@@ -0,0 +1,129 @@
+package integration
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Path of the Prometheus metrics on the HTTP server of the integration
+const metricsPath = "/metrics"
+
+var (
+	connectedRemotesDesc = prometheus.NewDesc("ucrt_connected_remotes",
+		"Number of connected Remote Twos", nil, nil)
+	remotesInStandbyDesc = prometheus.NewDesc("ucrt_remotes_in_standby",
+		"Number of connected Remote Twos in standby", nil, nil)
+	subscribedEntitiesDesc = prometheus.NewDesc("ucrt_subscribed_entities",
+		"Number of entities subscribed by any Remote Two", nil, nil)
+	eventsSentDesc = prometheus.NewDesc("ucrt_events_sent_total",
+		"Number of events sent to Remote Twos", nil, nil)
+	eventsDroppedDesc = prometheus.NewDesc("ucrt_events_dropped_total",
+		"Number of events dropped because of a full outbound queue", nil, nil)
+	eventsCoalescedDesc = prometheus.NewDesc("ucrt_events_coalesced_total",
+		"Number of entity_change events merged into an already queued event", nil, nil)
+	deviceStateDesc = prometheus.NewDesc("ucrt_device_state",
+		"Connection state of a device, e.g. the deCONZ websocket or the MQTT broker, 1 for the current state",
+		[]string{"backend", "device_id", "state"}, nil)
+	setupStateDesc = prometheus.NewDesc("ucrt_setup_state",
+		"State of the driver setup, 1 for the current state, all 0 if no setup ran", []string{"state"}, nil)
+)
+
+var allDeviceStates = []DState{ConnectedDeviceState, ConnectingDeviceState, DisconnectedDeviceState, ErrorDeviceState}
+
+var allSetupStates = []DriverSetupState{SetupState, WaitUserActionState, OkState, ErrorState}
+
+// Prometheus metrics of the integration
+// Each integration has its own registry, so several integrations can run in one process
+type metrics struct {
+	registry *prometheus.Registry
+
+	commandDuration *prometheus.HistogramVec
+}
+
+func newMetrics(i *Integration) *metrics {
+	m := metrics{
+		registry: prometheus.NewRegistry(),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ucrt_entity_command_duration_seconds",
+			Help: "Time to handle an entity command by entity type and result code",
+		}, []string{"entity_type", "code"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.commandDuration,
+		&integrationCollector{i: i},
+	)
+
+	return &m
+}
+
+// Record the time to handle an entity command
+// Does nothing if the metrics are nil, e.g. for backends which are handled by the hosting integration
+func (m *metrics) observeCommand(entityType string, code int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.commandDuration.WithLabelValues(entityType, strconv.Itoa(code)).Observe(duration.Seconds())
+}
+
+// Collects the state of the integration when scraped
+type integrationCollector struct {
+	i *Integration
+}
+
+func (c *integrationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectedRemotesDesc
+	ch <- remotesInStandbyDesc
+	ch <- subscribedEntitiesDesc
+	ch <- eventsSentDesc
+	ch <- eventsDroppedDesc
+	ch <- eventsCoalescedDesc
+	ch <- deviceStateDesc
+	ch <- setupStateDesc
+}
+
+func (c *integrationCollector) Collect(ch chan<- prometheus.Metric) {
+	i := c.i
+
+	sessions := i.getSessions()
+	standby := 0
+	for _, s := range sessions {
+		if s.InStandBy() {
+			standby++
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(connectedRemotesDesc, prometheus.GaugeValue, float64(len(sessions)))
+	ch <- prometheus.MustNewConstMetric(remotesInStandbyDesc, prometheus.GaugeValue, float64(standby))
+	ch <- prometheus.MustNewConstMetric(subscribedEntitiesDesc, prometheus.GaugeValue, float64(len(i.SubscribedEntities())))
+
+	ch <- prometheus.MustNewConstMetric(eventsSentDesc, prometheus.CounterValue, float64(i.SentEvents()))
+	ch <- prometheus.MustNewConstMetric(eventsDroppedDesc, prometheus.CounterValue, float64(i.DroppedEvents()))
+	ch <- prometheus.MustNewConstMetric(eventsCoalescedDesc, prometheus.CounterValue, float64(i.CoalescedEvents()))
+
+	for _, device := range i.deviceStatuses() {
+		for _, state := range allDeviceStates {
+			ch <- prometheus.MustNewConstMetric(deviceStateDesc, prometheus.GaugeValue, boolValue(device.State == state),
+				device.Backend, device.DeviceId, string(state))
+		}
+	}
+
+	current := i.GetSetupState()
+	for _, state := range allSetupStates {
+		ch <- prometheus.MustNewConstMetric(setupStateDesc, prometheus.GaugeValue, boolValue(current == state), string(state))
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,219 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// What happens when an event is sent to a session with a full outbound queue
+type QueuePolicy string
+
+const (
+	// Wait until the write loop has sent queued messages
+	BlockQueuePolicy QueuePolicy = "block"
+	// Drop the oldest queued event
+	DropOldestQueuePolicy QueuePolicy = "dropOldest"
+	// Merge entity_change events of the same entity, drop the oldest event if the queue is still full
+	CoalesceQueuePolicy QueuePolicy = "coalesce"
+)
+
+const (
+	// Default number of outbound messages queued per session
+	defaultQueueSize = 64
+
+	defaultQueuePolicy = CoalesceQueuePolicy
+)
+
+// Check the configured outbound queue size and policy and apply defaults
+func (c *Config) validateQueue() error {
+	if c.QueueSize < 0 {
+		return fmt.Errorf("queue size must not be negative")
+	}
+
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultQueueSize
+	}
+
+	switch QueuePolicy(c.QueuePolicy) {
+	case "":
+		c.QueuePolicy = string(defaultQueuePolicy)
+	case BlockQueuePolicy, DropOldestQueuePolicy, CoalesceQueuePolicy:
+	default:
+		return fmt.Errorf("unknown queue policy %s, must be %s, %s or %s", c.QueuePolicy, BlockQueuePolicy, DropOldestQueuePolicy, CoalesceQueuePolicy)
+	}
+
+	return nil
+}
+
+// A message waiting to be sent over the websocket
+type outboundMessage struct {
+	data []byte
+
+	// Set for entity_change events so they can be coalesced, marshalled when written
+	entityChange *EntityChangeEvent
+
+	// Responses are never dropped or blocked
+	response bool
+}
+
+// Return the message as it is sent over the websocket
+func (m *outboundMessage) bytes() ([]byte, error) {
+	if m.entityChange != nil {
+		return json.Marshal(m.entityChange)
+	}
+
+	return m.data, nil
+}
+
+// Bounded FIFO queue of outbound messages of a session
+// Safe for concurrent use
+type outboundQueue struct {
+	mu       sync.Mutex
+	notFull  *sync.Cond
+	messages []*outboundMessage
+	size     int
+	policy   QueuePolicy
+	closed   bool
+
+	// Signaled when messages are available
+	ready chan struct{}
+}
+
+func newOutboundQueue(size int, policy QueuePolicy) *outboundQueue {
+	q := outboundQueue{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+	q.notFull = sync.NewCond(&q.mu)
+
+	return &q
+}
+
+// Add a message to the queue
+// Return the number of events dropped to make room and the number of coalesced events
+func (q *outboundQueue) push(m *outboundMessage) (dropped int, coalesced int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, 0, fmt.Errorf("queue closed")
+	}
+
+	if q.policy == CoalesceQueuePolicy && m.entityChange != nil {
+		if q.coalesce(m.entityChange) {
+			return 0, 1, nil
+		}
+	}
+
+	for !m.response && len(q.messages) >= q.size {
+		if q.policy == BlockQueuePolicy {
+			q.notFull.Wait()
+
+			if q.closed {
+				return dropped, coalesced, fmt.Errorf("queue closed")
+			}
+			continue
+		}
+
+		if !q.dropOldestEvent() {
+			// Only responses queued, drop the new event
+			return dropped + 1, coalesced, nil
+		}
+		dropped++
+	}
+
+	q.messages = append(q.messages, m)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return dropped, coalesced, nil
+}
+
+// Merge the attributes of an entity_change event into a queued event of the same entity
+func (q *outboundQueue) coalesce(event *EntityChangeEvent) bool {
+	for _, queued := range q.messages {
+		if queued.entityChange == nil || queued.entityChange.MsgData.EntityId != event.MsgData.EntityId {
+			continue
+		}
+
+		attributes := make(map[string]interface{}, len(queued.entityChange.MsgData.Attributes)+len(event.MsgData.Attributes))
+		for k, v := range queued.entityChange.MsgData.Attributes {
+			attributes[k] = v
+		}
+		for k, v := range event.MsgData.Attributes {
+			attributes[k] = v
+		}
+
+		merged := *event
+		merged.MsgData.Attributes = attributes
+		queued.entityChange = &merged
+
+		return true
+	}
+
+	return false
+}
+
+// Remove the oldest queued event, return false if only responses are queued
+func (q *outboundQueue) dropOldestEvent() bool {
+	for ix, queued := range q.messages {
+		if queued.response {
+			continue
+		}
+
+		q.messages = append(q.messages[:ix], q.messages[ix+1:]...)
+		return true
+	}
+
+	return false
+}
+
+// Remove and return all queued messages in order
+func (q *outboundQueue) popAll() []*outboundMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages := q.messages
+	q.messages = nil
+
+	q.notFull.Broadcast()
+
+	return messages
+}
+
+// Close the queue, blocked senders return
+func (q *outboundQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notFull.Broadcast()
+}
+
+// Counters of sent events and events not sent as they were queued, shared by all sessions
+type eventMetrics struct {
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+// Number of events written to the websockets of all sessions
+func (i *Integration) SentEvents() uint64 {
+	return i.eventMetrics.sent.Load()
+}
+
+// Number of events dropped because of a full outbound queue
+func (i *Integration) DroppedEvents() uint64 {
+	return i.eventMetrics.dropped.Load()
+}
+
+// Number of entity_change events merged into an already queued event
+func (i *Integration) CoalescedEvents() uint64 {
+	return i.eventMetrics.coalesced.Load()
+}
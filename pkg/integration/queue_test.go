@@ -0,0 +1,217 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func newTestSession(size int, policy QueuePolicy) *session {
+	return &session{
+		id:            "test",
+		queue:         newOutboundQueue(size, policy),
+		metrics:       &eventMetrics{},
+		subscriptions: NewEntitySubscriptions(),
+		pending:       newPendingChanges(),
+		done:          make(chan struct{}),
+	}
+}
+
+func entityChange(entity_id string, value int) *EntityChangeEvent {
+	return &EntityChangeEvent{
+		CommonEvent{Kind: "event", Msg: "entity_change", Cat: "ENTITY"},
+		EntityChangeData{EntityId: entity_id, EntityType: "light", Attributes: map[string]interface{}{"brightness": value}},
+	}
+}
+
+// Return the entity id and brightness of queued entity_change events
+func decodeEntityChanges(t *testing.T, messages []*outboundMessage) []string {
+	t.Helper()
+
+	var result []string
+	for _, m := range messages {
+		data, err := m.bytes()
+		if err != nil {
+			t.Fatalf("Cannot marshal message: %v", err)
+		}
+
+		event := EntityChangeEvent{}
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatalf("Cannot unmarshal message: %v", err)
+		}
+
+		result = append(result, fmt.Sprintf("%s=%v", event.MsgData.EntityId, event.MsgData.Attributes["brightness"]))
+	}
+
+	return result
+}
+
+func TestBlockPolicyDeliversBurstInOrder(t *testing.T) {
+	s := newTestSession(4, BlockQueuePolicy)
+
+	const burst = 1000
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < burst; n++ {
+			if err := s.sendEntityChange(entityChange("light", n)); err != nil {
+				t.Errorf("Cannot send event: %v", err)
+				return
+			}
+		}
+	}()
+
+	// The write loop
+	var received []string
+	for len(received) < burst {
+		<-s.queue.ready
+		received = append(received, decodeEntityChanges(t, s.queue.popAll())...)
+	}
+	<-done
+
+	for n, r := range received {
+		if r != fmt.Sprintf("light=%d", n) {
+			t.Fatalf("Event %d out of order: %s", n, r)
+		}
+	}
+
+	if s.metrics.dropped.Load() != 0 {
+		t.Errorf("Expected no dropped events, got %d", s.metrics.dropped.Load())
+	}
+}
+
+func TestDropOldestPolicyKeepsNewestInOrder(t *testing.T) {
+	s := newTestSession(8, DropOldestQueuePolicy)
+
+	for n := 0; n < 20; n++ {
+		if err := s.sendEntityChange(entityChange("light", n)); err != nil {
+			t.Fatalf("Cannot send event: %v", err)
+		}
+	}
+
+	received := decodeEntityChanges(t, s.queue.popAll())
+	if len(received) != 8 {
+		t.Fatalf("Expected 8 queued events, got %d", len(received))
+	}
+
+	for n, r := range received {
+		if r != fmt.Sprintf("light=%d", n+12) {
+			t.Errorf("Event %d out of order: %s", n, r)
+		}
+	}
+
+	if s.metrics.dropped.Load() != 12 {
+		t.Errorf("Expected 12 dropped events, got %d", s.metrics.dropped.Load())
+	}
+}
+
+func TestCoalescePolicyMergesEventsOfAnEntity(t *testing.T) {
+	s := newTestSession(8, CoalesceQueuePolicy)
+
+	for n := 0; n < 30; n++ {
+		if err := s.sendEntityChange(entityChange(fmt.Sprintf("light%d", n%3), n)); err != nil {
+			t.Fatalf("Cannot send event: %v", err)
+		}
+	}
+
+	received := decodeEntityChanges(t, s.queue.popAll())
+	expected := []string{"light0=27", "light1=28", "light2=29"}
+
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, received)
+	}
+
+	if s.metrics.coalesced.Load() != 27 {
+		t.Errorf("Expected 27 coalesced events, got %d", s.metrics.coalesced.Load())
+	}
+	if s.metrics.dropped.Load() != 0 {
+		t.Errorf("Expected no dropped events, got %d", s.metrics.dropped.Load())
+	}
+}
+
+func TestCoalescePolicyDropsOldestOfDifferentEntities(t *testing.T) {
+	s := newTestSession(4, CoalesceQueuePolicy)
+
+	for n := 0; n < 6; n++ {
+		if err := s.sendEntityChange(entityChange(fmt.Sprintf("light%d", n), n)); err != nil {
+			t.Fatalf("Cannot send event: %v", err)
+		}
+	}
+
+	received := decodeEntityChanges(t, s.queue.popAll())
+	expected := []string{"light2=2", "light3=3", "light4=4", "light5=5"}
+
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, received)
+	}
+
+	if s.metrics.dropped.Load() != 2 {
+		t.Errorf("Expected 2 dropped events, got %d", s.metrics.dropped.Load())
+	}
+}
+
+func TestResponsesAreNeverDropped(t *testing.T) {
+	s := newTestSession(2, DropOldestQueuePolicy)
+
+	for n := 0; n < 4; n++ {
+		if err := s.sendResponse([]byte(fmt.Sprintf(`{"req_id":%d}`, n))); err != nil {
+			t.Fatalf("Cannot send response: %v", err)
+		}
+	}
+
+	// Only responses queued, the new event is dropped
+	if err := s.sendEntityChange(entityChange("light", 0)); err != nil {
+		t.Fatalf("Cannot send event: %v", err)
+	}
+
+	messages := s.queue.popAll()
+	if len(messages) != 4 {
+		t.Fatalf("Expected 4 queued responses, got %d", len(messages))
+	}
+
+	for n, m := range messages {
+		if string(m.data) != fmt.Sprintf(`{"req_id":%d}`, n) {
+			t.Errorf("Response %d out of order: %s", n, m.data)
+		}
+	}
+
+	if s.metrics.dropped.Load() != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", s.metrics.dropped.Load())
+	}
+}
+
+func TestBlockedSenderReturnsWhenSessionCloses(t *testing.T) {
+	s := newTestSession(1, BlockQueuePolicy)
+
+	if err := s.sendEntityChange(entityChange("light", 0)); err != nil {
+		t.Fatalf("Cannot send event: %v", err)
+	}
+
+	blocked := make(chan error)
+	go func() {
+		blocked <- s.sendEntityChange(entityChange("light", 1))
+	}()
+
+	s.close()
+
+	if err := <-blocked; err == nil {
+		t.Error("Expected an error for a blocked send on a closed session")
+	}
+}
+
+func TestValidateQueueConfig(t *testing.T) {
+	c := Config{}
+	if err := c.validateQueue(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.QueueSize != defaultQueueSize || c.QueuePolicy != string(defaultQueuePolicy) {
+		t.Errorf("Expected defaults, got size %d and policy %s", c.QueueSize, c.QueuePolicy)
+	}
+
+	for _, c := range []Config{{QueueSize: -1}, {QueuePolicy: "unknown"}} {
+		if err := c.validateQueue(); err == nil {
+			t.Errorf("Expected an error for %+v", c)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package integration
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Delay between the reconnect attempts of a client
+// The delay grows by Multiplier after every failed attempt up to Max, Jitter spreads it randomly
+// by the given fraction so several clients do not reconnect at the same time
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// Backoff of clients that do not set their own
+var DefaultBackoff = Backoff{
+	Initial:    1 * time.Second,
+	Max:        2 * time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Return the delay before the reconnect attempt, starting with attempt 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt))
+	if delay > float64(b.Max) || math.IsInf(delay, 0) {
+		delay = float64(b.Max)
+	}
+
+	// Randomize within +/- Jitter of the delay
+	delay += delay * b.Jitter * (2*rand.Float64() - 1)
+
+	return time.Duration(delay)
+}
+
+// Send the current state of all entities to the subscribed Remote Twos
+// Used after a reconnect, changes while the connection was lost may be missing
+func (i *Integration) ResyncEntityStates() {
+	log.Info("Resync entity states")
+
+	for _, e := range i.Entities.List() {
+		// Backends only resync their own entities
+		if i.parent != nil && i.backendKey(e.GetId()) != e.GetId() {
+			continue
+		}
+
+		i.SendEntityChangeEvent(e, nil)
+	}
+}
@@ -0,0 +1,127 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Direction of a recorded websocket frame
+const (
+	// Sent by the Remote Two to the integration
+	RecordInbound = "in"
+	// Sent by the integration to the Remote Two
+	RecordOutbound = "out"
+)
+
+// A websocket frame as recorded in the record file, one json object per line
+type RecordedFrame struct {
+	Time time.Time `json:"ts"`
+	// Id of the websocket connection, unique while the integration runs
+	Connection string `json:"conn"`
+	Direction  string `json:"dir"`
+	// The message with secrets masked
+	Message json.RawMessage `json:"msg"`
+}
+
+// Appends the frames of all websocket connections to the record file
+type recorder struct {
+	file    *os.File
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+func openRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open record file: %w", err)
+	}
+
+	log.WithField("File", path).Info("Recording websocket frames")
+
+	return &recorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Record a frame of a connection with the values of secret keys masked
+// Does nothing if the recorder is nil or closed
+func (r *recorder) record(conn string, direction string, msg []byte, isSecret func(string) bool) {
+	if r == nil {
+		return
+	}
+
+	frame := RecordedFrame{
+		Time:       time.Now(),
+		Connection: conn,
+		Direction:  direction,
+	}
+
+	redacted := []byte(redactMessage(msg, isSecret))
+	if json.Valid(redacted) {
+		frame.Message = redacted
+	} else {
+		// Keep frames that are not json as string
+		frame.Message, _ = json.Marshal(string(msg))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if err := r.encoder.Encode(frame); err != nil {
+		log.WithError(err).Error("Cannot record websocket frame")
+	}
+}
+
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if err := r.file.Close(); err != nil {
+		log.WithError(err).Error("Cannot close record file")
+	}
+	r.file = nil
+}
+
+// Read the frames of a record file
+func ReadRecording(reader io.Reader) ([]RecordedFrame, error) {
+	var frames []RecordedFrame
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		frame := RecordedFrame{}
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return nil, fmt.Errorf("invalid frame in line %d: %w", line, err)
+		}
+
+		frames = append(frames, frame)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read recording: %w", err)
+	}
+
+	return frames, nil
+}
@@ -21,6 +21,8 @@ type DriverRegistration struct {
 	DriverId        string          `json:"driver_id,omitempty"`
 	Name            LanguageText    `json:"name"`
 	DriverURL       string          `json:"driver_url"`
+	Token           string          `json:"token,omitempty"`
+	AuthMethod      string          `json:"auth_method,omitempty"`
 	Version         string          `json:"version"`
 	Icon            string          `json:"icon"`
 	Enabled         bool            `json:"enabled"`
@@ -32,59 +34,64 @@ type DriverRegistration struct {
 
 // Register the integration with Remote Two
 // TODO: make this more robust and nicer
-func (i *Integration) registerIntegration() {
+func (i *Integration) registerIntegration(ctx context.Context) error {
 
 	// Use configured IP for registration instead of Remote Two discovery
 	if i.Config.RegistrationPin != "" && i.Config.RemoteTwoPort > 0 {
-		i.registerWithRemoteTwo(i.Config.RemoteTwoHost, i.Config.RemoteTwoPort)
-	} else {
-
-		entries := make(chan *zeroconf.ServiceEntry)
+		return i.registerWithRemoteTwo(ctx, i.Config.RemoteTwoHost, i.Config.RemoteTwoPort)
+	}
 
-		go func(results <-chan *zeroconf.ServiceEntry) {
-			for entry := range results {
+	entries := make(chan *zeroconf.ServiceEntry)
 
-				log.WithField("MDNS Record", entry).Debug("Found Remote Two instance")
+	go func(results <-chan *zeroconf.ServiceEntry) {
+		for entry := range results {
 
-				if len(entry.AddrIPv4) == 0 {
-					// TODO: IPv6?
-					log.Debug("No IPv4 address available. Not using this record")
-					continue
-				}
+			log.WithField("MDNS Record", entry).Debug("Found Remote Two instance")
 
-				i.registerWithRemoteTwo(entry.AddrIPv4[0].String(), entry.Port)
+			if len(entry.AddrIPv4) == 0 {
+				// TODO: IPv6?
+				log.Debug("No IPv4 address available. Not using this record")
+				continue
+			}
 
+			if err := i.registerWithRemoteTwo(ctx, entry.AddrIPv4[0].String(), entry.Port); err != nil {
+				log.WithError(err).Error("Cannot register integration with Remote Two")
 			}
-		}(entries)
 
-		resolver, err := zeroconf.NewResolver(nil)
-		if err != nil {
-			log.Fatalln("Failed to initialize resolver:", err.Error())
 		}
+	}(entries)
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return fmt.Errorf("failed to initialize resolver: %w", err)
+	}
 
-		defer cancel()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
 
-		err = resolver.Browse(ctx, "_uc-remote._tcp", "local.", entries)
-		if err != nil {
-			log.Fatalln("Failed to browse:", err.Error())
-		}
+	defer cancel()
 
-		<-ctx.Done()
+	err = resolver.Browse(ctx, "_uc-remote._tcp", "local.", entries)
+	if err != nil {
+		return fmt.Errorf("failed to browse: %w", err)
 	}
+
+	<-ctx.Done()
+
+	return nil
 }
 
-func (i *Integration) registerWithRemoteTwo(remoteTwoIP string, remoteTwoPort int) {
+func (i *Integration) registerWithRemoteTwo(ctx context.Context, remoteTwoIP string, remoteTwoPort int) error {
 
 	myip := GetLocalIP()
 	driverURL := "ws://" + myip + i.listenAddress + i.Config.WebsocketPath
 	remoteTwoURL := "http://" + remoteTwoIP + ":" + fmt.Sprint(remoteTwoPort)
 
 	driverRegistration := DriverRegistration{
-		DriverId:        i.SetupData["driver_id"],
+		DriverId:        i.GetSetupDataValue("driver_id"),
 		Name:            i.Metadata.Name,
 		DriverURL:       driverURL,
+		Token:           i.Config.AuthToken,
+		AuthMethod:      i.Config.AuthMethod,
 		Version:         i.Metadata.Version,
 		Icon:            i.Metadata.Icon,
 		Enabled:         true,
@@ -101,11 +108,11 @@ func (i *Integration) registerWithRemoteTwo(remoteTwoIP string, remoteTwoPort in
 
 	data, err := json.Marshal(driverRegistration)
 	if err != nil {
-		log.WithError(err).Error("Cannot unmarshal driverRegistration")
+		return fmt.Errorf("cannot marshal driverRegistration: %w", err)
 	}
-	req, err := http.NewRequest("POST", remoteTwoURL+"/api/intg/drivers", bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", remoteTwoURL+"/api/intg/drivers", bytes.NewReader(data))
 	if err != nil {
-		log.WithError(err).Fatal("impossible to build request")
+		return fmt.Errorf("impossible to build request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
@@ -117,7 +124,7 @@ func (i *Integration) registerWithRemoteTwo(remoteTwoIP string, remoteTwoPort in
 	client := http.Client{Timeout: 10 * time.Second}
 	res, err := client.Do(req)
 	if err != nil {
-		log.WithError(err).Fatal("Failed to send the request")
+		return fmt.Errorf("failed to send the request: %w", err)
 	}
 
 	defer res.Body.Close()
@@ -125,7 +132,7 @@ func (i *Integration) registerWithRemoteTwo(remoteTwoIP string, remoteTwoPort in
 	statusCode := res.StatusCode
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Fatalf("impossible to read all body of response: %s", err)
+		return fmt.Errorf("impossible to read all body of response: %w", err)
 	}
 
 	log.WithFields(log.Fields{
@@ -140,9 +147,13 @@ func (i *Integration) registerWithRemoteTwo(remoteTwoIP string, remoteTwoPort in
 			log.WithError(err).Error("Cannot unmarshall driverRegistration")
 		}
 
-		i.SetupData["driver_id"] = driverRegistration.DriverId
-		i.PersistSetupData()
+		i.SetSetupDataValue("driver_id", driverRegistration.DriverId)
+		if err := i.PersistSetupData(); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
 // GetLocalIP returns the non loopback local IP of the host
@@ -0,0 +1,193 @@
+package integration
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/splattner/goucrt/pkg/entities"
+)
+
+// Registry of all entities of the integration
+// Safe for concurrent use, all list functions return a snapshot
+type EntityRegistry struct {
+	mu       sync.RWMutex
+	entities []entities.EntityInterface
+}
+
+func NewEntityRegistry() *EntityRegistry {
+	return &EntityRegistry{}
+}
+
+// Add an entity if no entity with the same id is registered yet
+// Return the already registered entity and false otherwise
+func (r *EntityRegistry) Add(entity entities.EntityInterface) (entities.EntityInterface, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.entities {
+		if e.GetId() == entity.GetId() {
+			return e, false
+		}
+	}
+
+	r.entities = append(r.entities, entity)
+
+	return entity, true
+}
+
+// Replace the registered entity with the same id, e.g. with the entity of a reconnected device
+// Return the replaced entity, or an error if no entity with the id is registered
+func (r *EntityRegistry) Replace(entity entities.EntityInterface) (entities.EntityInterface, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for ix, e := range r.entities {
+		if e.GetId() == entity.GetId() {
+			r.entities[ix] = entity
+			return e, nil
+		}
+	}
+
+	return nil, fmt.Errorf("entity with id %s not found", entity.GetId())
+}
+
+// Return an entity by its id
+func (r *EntityRegistry) Get(id string) (entities.EntityInterface, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, e := range r.entities {
+		if e.GetId() == id {
+			return e, nil
+		}
+	}
+
+	return nil, fmt.Errorf("entity with id %s not found", id)
+}
+
+// Remove an entity by its id and return the removed entity
+func (r *EntityRegistry) Remove(id string) (entities.EntityInterface, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for ix, e := range r.entities {
+		if e.GetId() == id {
+			r.entities = append(r.entities[:ix], r.entities[ix+1:]...)
+			return e, nil
+		}
+	}
+
+	return nil, fmt.Errorf("entity with id %s not found", id)
+}
+
+// Return a snapshot of all registered entities
+func (r *EntityRegistry) List() []entities.EntityInterface {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]entities.EntityInterface, len(r.entities))
+	copy(list, r.entities)
+
+	return list
+}
+
+// Return a snapshot of all registered entities of a given type
+func (r *EntityRegistry) ListByType(entityType entities.EntityType) []entities.EntityInterface {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var list []entities.EntityInterface
+	for _, e := range r.entities {
+		if e.GetEntityType() == entityType {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
+// Return the number of registered entities
+func (r *EntityRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.entities)
+}
+
+// Set of entity ids the Remote Two subscribed to
+// Safe for concurrent use, all list functions return a snapshot
+type EntitySubscriptions struct {
+	mu  sync.RWMutex
+	ids []string
+}
+
+func NewEntitySubscriptions() *EntitySubscriptions {
+	return &EntitySubscriptions{}
+}
+
+// Add an entity id, return false if already subscribed
+func (s *EntitySubscriptions) Add(entity_id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range s.ids {
+		if id == entity_id {
+			return false
+		}
+	}
+
+	s.ids = append(s.ids, entity_id)
+
+	return true
+}
+
+// Remove an entity id, return false if it was not subscribed
+func (s *EntitySubscriptions) Remove(entity_id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ix, id := range s.ids {
+		if id == entity_id {
+			s.ids = append(s.ids[:ix], s.ids[ix+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove all entity ids and return the removed ids
+func (s *EntitySubscriptions) Clear() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := s.ids
+	s.ids = nil
+
+	return ids
+}
+
+// Check if an entity id is subscribed
+func (s *EntitySubscriptions) Contains(entity_id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range s.ids {
+		if id == entity_id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return a snapshot of all subscribed entity ids
+func (s *EntitySubscriptions) List() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]string, len(s.ids))
+	copy(list, s.ids)
+
+	return list
+}
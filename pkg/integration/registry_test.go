@@ -0,0 +1,194 @@
+package integration
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/splattner/goucrt/pkg/entities"
+)
+
+// Run f concurrently in n goroutines and wait for all of them
+func runConcurrently(n int, f func(n int)) {
+	var wg sync.WaitGroup
+	for g := 0; g < n; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			f(g)
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestEntityRegistryConcurrentUse(t *testing.T) {
+	r := NewEntityRegistry()
+
+	runConcurrently(8, func(g int) {
+		for n := 0; n < 50; n++ {
+			id := fmt.Sprintf("light%d-%d", g, n)
+			if _, added := r.Add(entities.NewLightEntity(id, entities.LanguageText{En: id}, "")); !added {
+				t.Errorf("Entity %s not added", id)
+			}
+
+			if _, err := r.Get(id); err != nil {
+				t.Errorf("Entity %s not found: %v", id, err)
+			}
+
+			for _, e := range r.List() {
+				_ = e.GetId()
+			}
+			_ = r.ListByType(entities.EntityType{Type: "light"})
+
+			if n%2 == 0 {
+				if _, err := r.Remove(id); err != nil {
+					t.Errorf("Cannot remove entity %s: %v", id, err)
+				}
+			}
+		}
+	})
+
+	if r.Len() != 8*25 {
+		t.Errorf("Expected %d entities, got %d", 8*25, r.Len())
+	}
+}
+
+func TestEntityRegistryAddKeepsExistingEntity(t *testing.T) {
+	r := NewEntityRegistry()
+
+	first := entities.NewLightEntity("light", entities.LanguageText{En: "first"}, "")
+	second := entities.NewLightEntity("light", entities.LanguageText{En: "second"}, "")
+
+	runConcurrently(2, func(g int) {
+		if g == 0 {
+			r.Add(first)
+		} else {
+			r.Add(second)
+		}
+	})
+
+	if r.Len() != 1 {
+		t.Errorf("Expected one entity, got %d", r.Len())
+	}
+}
+
+func TestEntitySubscriptionsConcurrentUse(t *testing.T) {
+	s := NewEntitySubscriptions()
+
+	runConcurrently(8, func(g int) {
+		for n := 0; n < 50; n++ {
+			id := fmt.Sprintf("entity%d", n)
+			s.Add(id)
+			s.Contains(id)
+			_ = s.List()
+			if g%2 == 0 {
+				s.Remove(id)
+			}
+		}
+	})
+
+	s.Clear()
+	if len(s.List()) != 0 {
+		t.Errorf("Expected no subscriptions after Clear, got %v", s.List())
+	}
+}
+
+func TestEntityAttributesConcurrentWithEntityStates(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+
+	for n := 0; n < 4; n++ {
+		light := entities.NewLightEntity(fmt.Sprintf("light%d", n), entities.LanguageText{En: "Light"}, "")
+		light.AddFeature(entities.OnOffLightEntityFeatures)
+		light.AddFeature(entities.DimLightEntityFeatures)
+		if err := i.AddEntity(light); err != nil {
+			t.Fatalf("Cannot add entity: %v", err)
+		}
+	}
+
+	runConcurrently(8, func(g int) {
+		for n := 0; n < 100; n++ {
+			if g%2 == 0 {
+				// Device callbacks setting attributes
+				for _, e := range i.Entities.List() {
+					e.(*entities.LightEntity).SetAttributes(map[string]interface{}{"brightness": n})
+				}
+			} else {
+				// The websocket reader answering get_entity_states
+				res := i.handleGetEntityStatesRequest(&GetEntityStatesMessageReq{})
+				if len(res.MsgData) != 4 {
+					t.Errorf("Expected 4 entity states, got %d", len(res.MsgData))
+				}
+			}
+		}
+	})
+}
+
+func TestSubscribeEventsConcurrentWithAddEntity(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+
+	s := &session{id: "test", subscriptions: NewEntitySubscriptions(), pending: newPendingChanges()}
+	i.sessions[s.id] = s
+
+	runConcurrently(4, func(g int) {
+		for n := 0; n < 50; n++ {
+			id := fmt.Sprintf("switch%d-%d", g, n)
+			if g%2 == 0 {
+				if err := i.AddEntity(entities.NewSwitchEntity(id, entities.LanguageText{En: id}, "")); err != nil {
+					t.Errorf("Cannot add entity: %v", err)
+				}
+			} else {
+				i.subscribeEntities(s, []string{id})
+				_ = i.SubscribedEntities()
+			}
+		}
+	})
+
+	if len(i.SubscribedEntities()) != 100 {
+		t.Errorf("Expected 100 subscribed entities, got %d", len(i.SubscribedEntities()))
+	}
+}
+
+func TestSetupDataConcurrentUse(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+
+	runConcurrently(8, func(g int) {
+		for n := 0; n < 50; n++ {
+			switch g % 4 {
+			case 0:
+				// The setup replacing the setup data
+				i.SetSetupData(SetupData{"ipaddr": fmt.Sprint(n), "apikey": "secret"})
+			case 1:
+				// Registration adding the driver id
+				i.SetSetupDataValue("driver_id", fmt.Sprint(n))
+			case 2:
+				// A client reading the setup data on connect
+				_ = i.GetSetupData()["ipaddr"]
+				_ = i.GetSetupDataValue("apikey")
+			case 3:
+				// Logging and the admin API
+				if v := i.RedactedSetupData()["apikey"]; v != "" && v != redactedValue {
+					t.Errorf("Secret not redacted: %s", v)
+				}
+			}
+		}
+	})
+
+	if err := i.PersistSetupData(); err != nil {
+		t.Fatalf("Cannot persist setup data: %v", err)
+	}
+}
+
+func TestGetSetupDataReturnsCopy(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+
+	data := SetupData{"ipaddr": "10.0.0.1"}
+	i.SetSetupData(data)
+	data["ipaddr"] = "changed"
+
+	snapshot := i.GetSetupData()
+	snapshot["ipaddr"] = "changed"
+
+	if got := i.GetSetupDataValue("ipaddr"); got != "10.0.0.1" {
+		t.Errorf("Setup data changed through a copy: %s", got)
+	}
+}
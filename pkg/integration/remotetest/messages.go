@@ -0,0 +1,224 @@
+package remotetest
+
+import (
+	"fmt"
+
+	"github.com/splattner/goucrt/pkg/entities"
+	"github.com/splattner/goucrt/pkg/integration"
+)
+
+// Request the driver metadata
+func (r *Remote) GetDriverMetadata() (*integration.DriverMetadata, error) {
+	resp, err := r.Request("get_driver_metadata", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := expectCode(resp, 200); err != nil {
+		return nil, err
+	}
+
+	metadata := integration.DriverMetadata{}
+	if err := resp.Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("cannot decode driver metadata: %w", err)
+	}
+
+	return &metadata, nil
+}
+
+// Request the device state, the integration answers with device_state events
+func (r *Remote) GetDeviceState(device_id string) (integration.DeviceState, error) {
+	if err := r.write(integration.RequestMessage{
+		CommonReq: integration.CommonReq{Kind: "req", Id: r.id(), Msg: "get_device_state"},
+		MsgData:   integration.DeviceId{DeviceId: device_id},
+	}); err != nil {
+		return integration.DeviceState{}, fmt.Errorf("cannot send get_device_state: %w", err)
+	}
+
+	return r.WaitDeviceState(device_id)
+}
+
+// Start the driver setup with the setup data, reconfigure an existing setup if reconfigure is set
+// Returns the response, the progress of the setup is reported with driver_setup_change events
+func (r *Remote) SetupDriver(setup_data integration.SetupData, reconfigure bool) (Message, error) {
+	return r.Request("setup_driver", integration.SetupDataValue{Reconfigure: reconfigure, Value: setup_data})
+}
+
+// Send the user input of a settings page or a confirmation during the setup
+func (r *Remote) SetDriverUserData(input_values map[string]string, confirm bool) (Message, error) {
+	return r.Request("set_driver_user_data", integration.SetDriverUserData{InputValues: input_values, Confirm: confirm})
+}
+
+// Abort the running driver setup
+func (r *Remote) AbortDriverSetup() error {
+	return r.SendEvent("abort_driver_setup", integration.AbortDriverSetupData{Error: integration.OtherError})
+}
+
+// Wait for a driver_setup_change event with the state, other setup changes are skipped
+// An ERROR state is returned as error unless ERROR is awaited
+func (r *Remote) WaitSetupState(state integration.DriverSetupState) (integration.DriverSetupChangeData, error) {
+	for {
+		event, err := r.WaitEvent("driver_setup_change")
+		if err != nil {
+			return integration.DriverSetupChangeData{}, err
+		}
+
+		change := integration.DriverSetupChangeData{}
+		if err := event.Decode(&change); err != nil {
+			return change, fmt.Errorf("cannot decode driver_setup_change: %w", err)
+		}
+
+		if change.State == state {
+			return change, nil
+		}
+
+		if change.State == integration.ErrorState {
+			return change, fmt.Errorf("setup failed with %s", change.Error)
+		}
+	}
+}
+
+// Request the available entities of the device
+func (r *Remote) GetAvailableEntities(device_id string) ([]map[string]interface{}, error) {
+	resp, err := r.Request("get_available_entities", integration.AvailableEntityMessageData{
+		Filter: integration.AvailableEntityFilter{DeviceId: integration.DeviceId{DeviceId: device_id}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := expectCode(resp, 200); err != nil {
+		return nil, err
+	}
+
+	data := struct {
+		AvailableEntities []map[string]interface{} `json:"available_entities"`
+	}{}
+	if err := resp.Decode(&data); err != nil {
+		return nil, fmt.Errorf("cannot decode available entities: %w", err)
+	}
+
+	return data.AvailableEntities, nil
+}
+
+// Subscribe to the entity_change events of the entities, all entities if none is given
+func (r *Remote) SubscribeEvents(entity_ids ...string) error {
+	resp, err := r.Request("subscribe_events", integration.SubscribeEventMessageData{EntityIds: entity_ids})
+	if err != nil {
+		return err
+	}
+
+	return expectCode(resp, 200)
+}
+
+// Unsubscribe from the entity_change events of the entities, all entities if none is given
+func (r *Remote) UnsubscribeEvents(entity_ids ...string) error {
+	resp, err := r.Request("unsubscribe_events", integration.SubscribeEventMessageData{EntityIds: entity_ids})
+	if err != nil {
+		return err
+	}
+
+	return expectCode(resp, 200)
+}
+
+// Request the states of the subscribed entities
+func (r *Remote) GetEntityStates() ([]entities.EntityStateData, error) {
+	resp, err := r.Request("get_entity_states", integration.GetEntityStatesMessageData{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := expectCode(resp, 200); err != nil {
+		return nil, err
+	}
+
+	states := []entities.EntityStateData{}
+	if len(resp.MsgData) == 0 {
+		return states, nil
+	}
+
+	if err := resp.Decode(&states); err != nil {
+		return nil, fmt.Errorf("cannot decode entity states: %w", err)
+	}
+
+	return states, nil
+}
+
+// Send a command to an entity
+// Returns the response, check its Code for the result of the command
+func (r *Remote) EntityCommand(entity_id string, cmd_id string, params map[string]interface{}) (Message, error) {
+	return r.Request("entity_command", integration.EntityCommandData{EntityId: entity_id, CmdId: cmd_id, Params: params})
+}
+
+// Wait for the next entity_change event of the entity
+func (r *Remote) WaitEntityChange(entity_id string) (integration.EntityChangeData, error) {
+	event, err := r.waitFor(func(m Message) bool {
+		if m.Kind != "event" || m.Msg != "entity_change" {
+			return false
+		}
+
+		change := integration.EntityChangeData{}
+		return m.Decode(&change) == nil && change.EntityId == entity_id
+	})
+	if err != nil {
+		return integration.EntityChangeData{}, fmt.Errorf("no entity_change event for %s: %w", entity_id, err)
+	}
+
+	change := integration.EntityChangeData{}
+	if err := event.Decode(&change); err != nil {
+		return change, fmt.Errorf("cannot decode entity_change: %w", err)
+	}
+
+	return change, nil
+}
+
+// Wait for the next device_state event of the device
+func (r *Remote) WaitDeviceState(device_id string) (integration.DeviceState, error) {
+	event, err := r.waitFor(func(m Message) bool {
+		if m.Kind != "event" || m.Msg != "device_state" {
+			return false
+		}
+
+		state := integration.DeviceState{}
+		return m.Decode(&state) == nil && state.DeviceId.DeviceId == device_id
+	})
+	if err != nil {
+		return integration.DeviceState{}, fmt.Errorf("no device_state event for %q: %w", device_id, err)
+	}
+
+	state := integration.DeviceState{}
+	if err := event.Decode(&state); err != nil {
+		return state, fmt.Errorf("cannot decode device_state: %w", err)
+	}
+
+	return state, nil
+}
+
+// Ask the driver to connect its devices
+func (r *Remote) Connect() error {
+	return r.SendEvent("connect", integration.ConnectEventData{})
+}
+
+// Ask the driver to disconnect its devices
+func (r *Remote) Disconnect() error {
+	return r.SendEvent("disconnect", integration.ConnectEventData{})
+}
+
+// Put the remote into standby, the integration holds back entity changes
+func (r *Remote) EnterStandby() error {
+	return r.SendEvent("enter_standby", nil)
+}
+
+// Wake the remote from standby, the integration sends the held back entity changes
+func (r *Remote) ExitStandby() error {
+	return r.SendEvent("exit_standby", nil)
+}
+
+// Return the id of the next request
+func (r *Remote) id() int {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+
+	r.nextId++
+	return r.nextId
+}
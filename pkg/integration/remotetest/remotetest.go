@@ -0,0 +1,411 @@
+// Package remotetest runs an integration on an ephemeral port and connects to it as a scripted Remote Two,
+// to drive an integration end to end without a physical remote, e.g. in tests of a driver:
+//
+//	remote, err := remotetest.Start(i)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer remote.Close()
+//
+//	if err := remote.SubscribeEvents("light1"); err != nil {
+//		t.Fatal(err)
+//	}
+//
+//	resp, err := remote.EntityCommand("light1", "on", nil)
+package remotetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/splattner/goucrt/pkg/integration"
+	"github.com/splattner/goucrt/pkg/integration/apischema"
+)
+
+// Time to wait for a response or event if the Remote has no Timeout set
+const DefaultTimeout = 5 * time.Second
+
+// A message received from the integration, a response or an event
+type Message struct {
+	Kind    string          `json:"kind"`
+	Msg     string          `json:"msg"`
+	ReqId   int             `json:"req_id,omitempty"`
+	Code    int             `json:"code,omitempty"`
+	Cat     string          `json:"cat,omitempty"`
+	MsgData json.RawMessage `json:"msg_data,omitempty"`
+
+	// The message as received
+	Raw []byte `json:"-"`
+}
+
+// Decode the msg_data of the message
+func (m Message) Decode(v interface{}) error {
+	if len(m.MsgData) == 0 {
+		return fmt.Errorf("%s has no msg_data", m.Msg)
+	}
+
+	return json.Unmarshal(m.MsgData, v)
+}
+
+// A response with a code other than the expected one
+type UnexpectedCodeError struct {
+	Msg     string
+	Code    int
+	MsgData json.RawMessage
+}
+
+func (e *UnexpectedCodeError) Error() string {
+	return fmt.Sprintf("unexpected response code %d to %s: %s", e.Code, e.Msg, string(e.MsgData))
+}
+
+// A scripted Remote Two connected to an integration
+type Remote struct {
+	// The integration started with Start, nil if connected with Dial
+	Integration *integration.Integration
+
+	// Time to wait for a response or event
+	Timeout time.Duration
+
+	ws *websocket.Conn
+
+	authMethod string
+	authToken  string
+
+	// Stops the integration started with Start
+	cancel context.CancelFunc
+	// Result of Serve, sent when the integration stopped
+	serveErr chan error
+
+	nextId      int
+	writeMutex  sync.Mutex
+	closeOnce   sync.Once
+	readerError error
+
+	// Received messages that were not yet expected
+	received      []Message
+	receivedMutex sync.Mutex
+	// Signalled when a message was received or the connection closed
+	receivedSignal chan struct{}
+	readerDone     chan struct{}
+
+	// Sent and received messages that do not conform to the integration API schema
+	conformanceErrors []error
+	conformanceMutex  sync.Mutex
+}
+
+// Return a config for an integration used with Start
+// mDNS is disabled, messages are validated and setup data is persisted in configHome
+func Config(configHome string) integration.Config {
+	return integration.Config{
+		WebsocketPath:    "/ws",
+		DisableMDNS:      true,
+		ConfigHome:       configHome + "/",
+		ValidateMessages: true,
+	}
+}
+
+// Start the integration on an ephemeral port on localhost and connect to it as a Remote Two
+// The metadata of the integration must be set. With header or message authentication, the
+// configured auth token of the integration is used.
+func Start(i *integration.Integration) (*Remote, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- i.Serve(ctx, listener)
+	}()
+
+	r, err := Dial("ws://"+listener.Addr().String()+i.Config.WebsocketPath, i.Config)
+	if err != nil {
+		cancel()
+		<-serveErr
+		return nil, err
+	}
+
+	r.Integration = i
+	r.cancel = cancel
+	r.serveErr = serveErr
+
+	return r, nil
+}
+
+// Connect as a Remote Two to an integration that is already running, e.g. a driver started with ucrt
+// The auth method and token or token file of the config are used to authenticate
+func Dial(url string, config integration.Config) (*Remote, error) {
+	authToken, err := config.AuthTokenValue()
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if config.AuthMethod == integration.HeaderAuthMethod {
+		header.Set(integration.AuthTokenHeader, authToken)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", url, err)
+	}
+
+	r := &Remote{
+		Timeout:        DefaultTimeout,
+		ws:             ws,
+		authMethod:     config.AuthMethod,
+		authToken:      authToken,
+		receivedSignal: make(chan struct{}, 1),
+		readerDone:     make(chan struct{}),
+	}
+
+	go r.read()
+
+	if err := r.authenticate(); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Wait for the authentication response the integration sends on connect
+func (r *Remote) authenticate() error {
+	if r.authMethod == integration.MessageAuthMethod {
+		if _, err := r.WaitEvent("auth_required"); err != nil {
+			return err
+		}
+
+		resp, err := r.Request("auth", integration.AuthRequestData{Token: r.authToken})
+		if err != nil {
+			return err
+		}
+
+		return expectCode(resp, 200)
+	}
+
+	resp, err := r.waitFor(func(m Message) bool {
+		return m.Kind == "resp" && m.Msg == "authentication"
+	})
+	if err != nil {
+		return err
+	}
+
+	return expectCode(resp, 200)
+}
+
+// Close the connection and stop the integration if it was started with Start
+// Returns the error of the integration, nil if it stopped cleanly
+func (r *Remote) Close() error {
+	var err error
+
+	r.closeOnce.Do(func() {
+		if r.cancel != nil {
+			r.cancel()
+			err = <-r.serveErr
+		}
+
+		r.ws.Close()
+		<-r.readerDone
+	})
+
+	return err
+}
+
+// Disconnect the websocket without stopping the integration, like a Remote Two going away
+func (r *Remote) Drop() error {
+	return r.ws.Close()
+}
+
+// Read the messages of the integration until the connection is closed
+func (r *Remote) read() {
+	defer close(r.readerDone)
+
+	for {
+		_, p, err := r.ws.ReadMessage()
+		if err != nil {
+			r.receivedMutex.Lock()
+			r.readerError = err
+			r.receivedMutex.Unlock()
+			r.signal()
+			return
+		}
+
+		r.checkConformance("received", p)
+
+		m := Message{}
+		if err := json.Unmarshal(p, &m); err != nil {
+			continue
+		}
+		m.Raw = p
+
+		r.receivedMutex.Lock()
+		r.received = append(r.received, m)
+		r.receivedMutex.Unlock()
+		r.signal()
+	}
+}
+
+func (r *Remote) signal() {
+	select {
+	case r.receivedSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for the first received message that matches and remove it
+// Messages that do not match are kept for later waits
+func (r *Remote) waitFor(match func(Message) bool) (Message, error) {
+	timeout := time.NewTimer(r.Timeout)
+	defer timeout.Stop()
+
+	for {
+		if m, ok := r.take(match); ok {
+			return m, nil
+		}
+
+		r.receivedMutex.Lock()
+		readerError := r.readerError
+		r.receivedMutex.Unlock()
+
+		if readerError != nil {
+			return Message{}, fmt.Errorf("connection closed: %w", readerError)
+		}
+
+		select {
+		case <-r.receivedSignal:
+		case <-timeout.C:
+			return Message{}, fmt.Errorf("timeout after %s", r.Timeout)
+		}
+	}
+}
+
+// Remove and return the first received message that matches, without waiting
+func (r *Remote) take(match func(Message) bool) (Message, bool) {
+	r.receivedMutex.Lock()
+	defer r.receivedMutex.Unlock()
+
+	for idx, m := range r.received {
+		if match(m) {
+			r.received = append(r.received[:idx], r.received[idx+1:]...)
+			return m, true
+		}
+	}
+
+	return Message{}, false
+}
+
+// Return and remove all received messages that were not yet expected
+func (r *Remote) Received() []Message {
+	r.receivedMutex.Lock()
+	defer r.receivedMutex.Unlock()
+
+	received := r.received
+	r.received = nil
+
+	return received
+}
+
+func (r *Remote) write(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return r.SendRaw(msg)
+}
+
+// Record a message that does not conform to the integration API schema
+func (r *Remote) checkConformance(direction string, msg []byte) {
+	if err := apischema.Validate(msg); err != nil {
+		r.conformanceMutex.Lock()
+		r.conformanceErrors = append(r.conformanceErrors, fmt.Errorf("%s: %w", direction, err))
+		r.conformanceMutex.Unlock()
+	}
+}
+
+// Return the sent and received messages that do not conform to the integration API schema, nil if all conform
+// Check it at the end of a test to catch drift between the message structs and the spec
+func (r *Remote) ConformanceErrors() error {
+	r.conformanceMutex.Lock()
+	defer r.conformanceMutex.Unlock()
+
+	return errors.Join(r.conformanceErrors...)
+}
+
+// Send a raw message, e.g. a recorded one, without waiting for a response
+func (r *Remote) SendRaw(msg []byte) error {
+	r.checkConformance("sent", msg)
+
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+
+	return r.ws.WriteMessage(websocket.TextMessage, msg)
+}
+
+// Send a request and wait for its response
+func (r *Remote) Request(msg string, msgData interface{}) (Message, error) {
+	id := r.id()
+
+	req := integration.RequestMessage{
+		CommonReq: integration.CommonReq{Kind: "req", Id: id, Msg: msg},
+		MsgData:   msgData,
+	}
+
+	if err := r.write(req); err != nil {
+		return Message{}, fmt.Errorf("cannot send %s: %w", msg, err)
+	}
+
+	resp, err := r.waitFor(func(m Message) bool {
+		return m.Kind == "resp" && m.ReqId == id
+	})
+	if err != nil {
+		return Message{}, fmt.Errorf("no response to %s: %w", msg, err)
+	}
+
+	return resp, nil
+}
+
+// Send an event to the integration
+func (r *Remote) SendEvent(msg string, msgData interface{}) error {
+	event := integration.EventMessage{
+		CommonEvent: integration.CommonEvent{Kind: "event", Msg: msg, Cat: "REMOTE", Ts: time.Now().Format(time.RFC3339)},
+		MsgData:     msgData,
+	}
+
+	if err := r.write(event); err != nil {
+		return fmt.Errorf("cannot send %s: %w", msg, err)
+	}
+
+	return nil
+}
+
+// Wait for the next event with the message name
+func (r *Remote) WaitEvent(msg string) (Message, error) {
+	event, err := r.waitFor(func(m Message) bool {
+		return m.Kind == "event" && m.Msg == msg
+	})
+	if err != nil {
+		return Message{}, fmt.Errorf("no %s event: %w", msg, err)
+	}
+
+	return event, nil
+}
+
+func expectCode(resp Message, code int) error {
+	if resp.Code != code {
+		return &UnexpectedCodeError{Msg: resp.Msg, Code: resp.Code, MsgData: resp.MsgData}
+	}
+
+	return nil
+}
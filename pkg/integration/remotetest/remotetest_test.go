@@ -0,0 +1,341 @@
+package remotetest_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/splattner/goucrt/pkg/entities"
+	"github.com/splattner/goucrt/pkg/integration"
+	"github.com/splattner/goucrt/pkg/integration/remotetest"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the test output readable, the integration logs every message on info level
+	log.SetLevel(log.ErrorLevel)
+
+	os.Exit(m.Run())
+}
+
+// An integration with one dimmable light, the on commands are recorded
+type testDriver struct {
+	i     *integration.Integration
+	light *entities.LightEntity
+
+	mutex      sync.Mutex
+	brightness []int
+}
+
+func newTestDriver(t *testing.T, config integration.Config) *testDriver {
+	t.Helper()
+
+	i, err := integration.NewIntegration(config)
+	if err != nil {
+		t.Fatalf("Cannot create integration: %v", err)
+	}
+
+	i.SetMetadata(&integration.DriverMetadata{
+		DriverId: "test",
+		Name:     integration.LanguageText{En: "Test"},
+		Version:  "0.0.1",
+		SetupDataSchema: integration.SetupDataSchema{
+			Title: integration.LanguageText{En: "Test"},
+			Settings: []integration.SetupDataSchemaSettings{
+				{
+					Id:    "port",
+					Label: integration.LanguageText{En: "Port"},
+					Field: integration.SettingTypeNumber{Number: integration.SettingTypeNumberDefinition{Value: 80, Min: 1, Max: 65535}},
+				},
+			},
+		},
+	})
+
+	d := &testDriver{i: i}
+
+	d.light = entities.NewLightEntity("light", entities.LanguageText{En: "Light"}, "")
+	d.light.AddFeature(entities.OnOffLightEntityFeatures)
+	d.light.AddFeature(entities.DimLightEntityFeatures)
+
+	if err := entities.AddTypedCommand(d.light, entities.OnLightEntityCommand, func(p *entities.LightOnParams) error {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+
+		brightness := 255
+		if p.Brightness != nil {
+			brightness = *p.Brightness
+		}
+		d.brightness = append(d.brightness, brightness)
+
+		d.light.SetAttributes(map[string]interface{}{
+			string(entities.StateLightEntityAttribute):      entities.OnLightEntityState,
+			string(entities.BrightnessLightEntityAttribute): brightness,
+		})
+
+		return nil
+	}); err != nil {
+		t.Fatalf("Cannot add on command: %v", err)
+	}
+
+	if err := i.AddEntity(d.light); err != nil {
+		t.Fatalf("Cannot add entity: %v", err)
+	}
+
+	return d
+}
+
+// Start the integration of the driver and connect as a Remote Two
+// The messages of the test must conform to the integration API schema
+func startRemote(t *testing.T, d *testDriver) *remotetest.Remote {
+	t.Helper()
+
+	remote, err := remotetest.Start(d.i)
+	if err != nil {
+		t.Fatalf("Cannot start integration: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := remote.Close(); err != nil {
+			t.Errorf("Integration stopped with error: %v", err)
+		}
+
+		if err := remote.ConformanceErrors(); err != nil {
+			t.Errorf("Messages do not conform to the integration API: %v", err)
+		}
+	})
+
+	return remote
+}
+
+func TestAuthentication(t *testing.T) {
+	for _, method := range []string{"", integration.HeaderAuthMethod, integration.MessageAuthMethod} {
+		t.Run(method, func(t *testing.T) {
+			config := remotetest.Config(t.TempDir())
+			config.AuthMethod = method
+			if method != "" {
+				config.AuthToken = "token"
+			}
+
+			remote := startRemote(t, newTestDriver(t, config))
+
+			metadata, err := remote.GetDriverMetadata()
+			if err != nil {
+				t.Fatalf("Cannot get driver metadata: %v", err)
+			}
+			if metadata.DriverId != "test" {
+				t.Errorf("Expected driver id test, got %s", metadata.DriverId)
+			}
+		})
+	}
+}
+
+func TestAuthenticationWithWrongToken(t *testing.T) {
+	for _, method := range []string{integration.HeaderAuthMethod, integration.MessageAuthMethod} {
+		t.Run(method, func(t *testing.T) {
+			config := remotetest.Config(t.TempDir())
+			config.AuthMethod = method
+			config.AuthToken = "token"
+
+			d := newTestDriver(t, config)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Cannot listen: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- d.i.Serve(ctx, listener)
+			}()
+			defer func() {
+				cancel()
+				if err := <-serveErr; err != nil {
+					t.Errorf("Integration stopped with error: %v", err)
+				}
+			}()
+
+			config.AuthToken = "wrong"
+			if remote, err := remotetest.Dial("ws://"+listener.Addr().String()+config.WebsocketPath, config); err == nil {
+				remote.Close()
+				t.Error("Expected the connection with a wrong token to fail")
+			}
+		})
+	}
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	d := newTestDriver(t, remotetest.Config(t.TempDir()))
+	remote := startRemote(t, d)
+
+	if err := remote.SubscribeEvents("light"); err != nil {
+		t.Fatalf("Cannot subscribe: %v", err)
+	}
+
+	d.light.SetAttributes(map[string]interface{}{string(entities.BrightnessLightEntityAttribute): 42})
+
+	change, err := remote.WaitEntityChange("light")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Attributes["brightness"] != 42.0 {
+		t.Errorf("Expected brightness 42, got %v", change.Attributes["brightness"])
+	}
+
+	if err := remote.UnsubscribeEvents("light"); err != nil {
+		t.Fatalf("Cannot unsubscribe: %v", err)
+	}
+}
+
+func TestGetEntityStates(t *testing.T) {
+	d := newTestDriver(t, remotetest.Config(t.TempDir()))
+	remote := startRemote(t, d)
+
+	d.light.SetAttributes(map[string]interface{}{string(entities.BrightnessLightEntityAttribute): 100})
+
+	if err := remote.SubscribeEvents(); err != nil {
+		t.Fatalf("Cannot subscribe: %v", err)
+	}
+
+	states, err := remote.GetEntityStates()
+	if err != nil {
+		t.Fatalf("Cannot get entity states: %v", err)
+	}
+
+	if len(states) != 1 || states[0].EntityId != "light" {
+		t.Fatalf("Expected the state of light, got %+v", states)
+	}
+	if states[0].Attributes["brightness"] != 100.0 {
+		t.Errorf("Expected brightness 100, got %v", states[0].Attributes["brightness"])
+	}
+}
+
+func TestEntityCommand(t *testing.T) {
+	d := newTestDriver(t, remotetest.Config(t.TempDir()))
+	remote := startRemote(t, d)
+
+	if err := remote.SubscribeEvents("light"); err != nil {
+		t.Fatalf("Cannot subscribe: %v", err)
+	}
+
+	resp, err := remote.EntityCommand("light", "on", map[string]interface{}{"brightness": 12.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != 200 {
+		t.Fatalf("Expected code 200, got %d", resp.Code)
+	}
+
+	change, err := remote.WaitEntityChange("light")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Attributes["brightness"] != 13.0 {
+		t.Errorf("Expected the rounded brightness 13, got %v", change.Attributes["brightness"])
+	}
+
+	for _, c := range []struct {
+		entity_id string
+		cmd_id    string
+		params    map[string]interface{}
+		code      int
+	}{
+		{"light", "on", map[string]interface{}{"brightness": 300}, 400},
+		{"light", "blink", nil, 404},
+		{"unknown", "on", nil, 404},
+	} {
+		resp, err := remote.EntityCommand(c.entity_id, c.cmd_id, c.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != c.code {
+			t.Errorf("Expected code %d for %s %s %v, got %d", c.code, c.entity_id, c.cmd_id, c.params, resp.Code)
+		}
+	}
+}
+
+func TestSetupFlow(t *testing.T) {
+	d := newTestDriver(t, remotetest.Config(t.TempDir()))
+	d.i.SetHandleSetupFunction(func(ctx context.Context, setup_data integration.SetupData) {
+		d.i.SetDriverSetupState(integration.StopEvent, integration.OkState, "", nil)
+	})
+	remote := startRemote(t, d)
+
+	resp, err := remote.SetupDriver(integration.SetupData{"port": "8080"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != 200 {
+		t.Fatalf("Expected code 200, got %d", resp.Code)
+	}
+
+	if _, err := remote.WaitSetupState(integration.OkState); err != nil {
+		t.Fatal(err)
+	}
+
+	if port := d.i.GetSetupDataValue("port"); port != "8080" {
+		t.Errorf("Expected port 8080 in the setup data, got %q", port)
+	}
+
+	// Invalid setup data is answered before the setup is aborted
+	resp, err = remote.SetupDriver(integration.SetupData{"port": "0"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("Expected code 400, got %d", resp.Code)
+	}
+
+	if _, err := remote.WaitSetupState(integration.ErrorState); err != nil {
+		t.Fatal(err)
+	}
+
+	if port := d.i.GetSetupDataValue("port"); port != "8080" {
+		t.Errorf("Expected the previous port 8080 to be kept, got %q", port)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	d := newTestDriver(t, remotetest.Config(t.TempDir()))
+	remote := startRemote(t, d)
+
+	if err := remote.SubscribeEvents("light"); err != nil {
+		t.Fatalf("Cannot subscribe: %v", err)
+	}
+
+	if err := remote.EnterStandby(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the integration handled enter_standby before the changes
+	if _, err := remote.GetDriverMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, brightness := range []int{10, 20, 30} {
+		d.light.SetAttributes(map[string]interface{}{string(entities.BrightnessLightEntityAttribute): brightness})
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	for _, m := range remote.Received() {
+		if m.Msg == "entity_change" {
+			t.Errorf("Received entity_change in standby: %s", m.Raw)
+		}
+	}
+
+	if err := remote.ExitStandby(); err != nil {
+		t.Fatal(err)
+	}
+
+	change, err := remote.WaitEntityChange("light")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Attributes["brightness"] != 30.0 {
+		t.Errorf("Expected the latest brightness 30 after standby, got %v", change.Attributes["brightness"])
+	}
+}
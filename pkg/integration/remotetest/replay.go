@@ -0,0 +1,198 @@
+package remotetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/splattner/goucrt/pkg/integration"
+)
+
+// A message the integration sent differently on replay than in the recording
+type Difference struct {
+	// The recorded frame sent by the integration
+	Expected integration.RecordedFrame
+	// The message sent on replay, nil if the integration did not send it
+	Actual []byte
+}
+
+func (d Difference) String() string {
+	if d.Actual == nil {
+		return fmt.Sprintf("missing: %s", string(d.Expected.Message))
+	}
+
+	return fmt.Sprintf("expected: %s\n  actual: %s", string(d.Expected.Message), string(d.Actual))
+}
+
+// Return the connection ids of the recorded frames in the order they connected
+func Connections(frames []integration.RecordedFrame) []string {
+	var connections []string
+	seen := make(map[string]bool)
+
+	for _, frame := range frames {
+		if !seen[frame.Connection] {
+			seen[frame.Connection] = true
+			connections = append(connections, frame.Connection)
+		}
+	}
+
+	return connections
+}
+
+// Return the recorded frames of a connection
+func ConnectionFrames(frames []integration.RecordedFrame, conn string) []integration.RecordedFrame {
+	var result []integration.RecordedFrame
+
+	for _, frame := range frames {
+		if frame.Connection == conn {
+			result = append(result, frame)
+		}
+	}
+
+	return result
+}
+
+// Header of a recorded message
+type recordedMessage struct {
+	Kind    string          `json:"kind"`
+	Msg     string          `json:"msg"`
+	ReqId   int             `json:"req_id"`
+	Code    int             `json:"code"`
+	MsgData json.RawMessage `json:"msg_data"`
+}
+
+// Replay the Remote Two side of a recorded connection
+// The recorded messages of the Remote Two are sent in order. Before the next one is sent, the integration must send
+// the responses and events it sent in the recording, they are compared by code and msg_data. Additional events of
+// the integration are ignored, as are the events recorded after the last response, e.g. on shutdown.
+// Authentication is not replayed, the Remote is already authenticated.
+// Returns the differences to the recording, an error if the connection failed
+func (r *Remote) Replay(frames []integration.RecordedFrame) ([]Difference, error) {
+	var differences []Difference
+
+	messages := make([]recordedMessage, len(frames))
+	lastResponse := -1
+	for idx, frame := range frames {
+		if err := json.Unmarshal(frame.Message, &messages[idx]); err != nil {
+			messages[idx] = recordedMessage{}
+		}
+
+		if frame.Direction == integration.RecordOutbound && messages[idx].Kind == "resp" {
+			lastResponse = idx
+		}
+	}
+
+	for idx, frame := range frames {
+		recorded := messages[idx]
+		if recorded.Kind == "" {
+			continue
+		}
+
+		switch frame.Direction {
+		case integration.RecordInbound:
+			if recorded.Kind == "req" && recorded.Msg == "auth" {
+				continue
+			}
+
+			if err := r.SendRaw(frame.Message); err != nil {
+				return differences, err
+			}
+
+		case integration.RecordOutbound:
+			if recorded.Msg == "authentication" || recorded.Msg == "auth_required" || idx > lastResponse {
+				continue
+			}
+
+			actual, err := r.replayed(recorded)
+			if err != nil {
+				return differences, err
+			}
+
+			if actual == nil || !sameResult(recorded, *actual) {
+				d := Difference{Expected: frame}
+				if actual != nil {
+					d.Actual = actual.Raw
+				}
+				differences = append(differences, d)
+			}
+		}
+	}
+
+	return differences, nil
+}
+
+// Wait for the message the integration sends in place of the recorded one
+// Returns nil if the integration did not send it
+func (r *Remote) replayed(recorded recordedMessage) (*Message, error) {
+	matches := func(m Message) bool {
+		if m.Kind != recorded.Kind || m.Msg != recorded.Msg {
+			return false
+		}
+
+		if recorded.Kind == "resp" {
+			return m.ReqId == recorded.ReqId
+		}
+
+		return sameSubject(recorded.MsgData, m.MsgData)
+	}
+
+	// Prefer an event with the recorded content, several events of the same entity may be sent
+	m, err := r.waitFor(func(m Message) bool {
+		return matches(m) && (recorded.Kind == "resp" || sameJSON(recorded.MsgData, m.MsgData))
+	})
+	if err == nil {
+		return &m, nil
+	}
+
+	r.receivedMutex.Lock()
+	readerError := r.readerError
+	r.receivedMutex.Unlock()
+	if readerError != nil {
+		return nil, fmt.Errorf("connection closed: %w", readerError)
+	}
+
+	// Not sent with the recorded content, take the first matching one if any
+	if m, ok := r.take(matches); ok {
+		return &m, nil
+	}
+
+	return nil, nil
+}
+
+// Compare the result of a replayed message with the recorded one
+func sameResult(recorded recordedMessage, actual Message) bool {
+	if recorded.Kind == "resp" && recorded.Code != actual.Code {
+		return false
+	}
+
+	return sameJSON(recorded.MsgData, actual.MsgData)
+}
+
+// Check if two events are about the same entity or device
+func sameSubject(a json.RawMessage, b json.RawMessage) bool {
+	subject := struct {
+		DeviceId string `json:"device_id"`
+		EntityId string `json:"entity_id"`
+	}{}
+
+	other := subject
+
+	// msg_data that is not an object has no subject
+	_ = json.Unmarshal(a, &subject)
+	_ = json.Unmarshal(b, &other)
+
+	return subject == other
+}
+
+func sameJSON(a json.RawMessage, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,216 @@
+package remotetest_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/splattner/goucrt/pkg/integration"
+	"github.com/splattner/goucrt/pkg/integration/remotetest"
+)
+
+// Return a driver with a password field in the setup that reports OK for every setup
+func newRecordTestDriver(t *testing.T, config integration.Config) *testDriver {
+	t.Helper()
+
+	d := newTestDriver(t, config)
+	d.i.Metadata.SetupDataSchema.Settings = append(d.i.Metadata.SetupDataSchema.Settings, integration.SetupDataSchemaSettings{
+		Id:    "gateway_secret",
+		Label: integration.LanguageText{En: "Secret"},
+		Field: integration.SettingTypePassword{},
+	})
+	d.i.SetHandleSetupFunction(func(ctx context.Context, setup_data integration.SetupData) {
+		d.i.SetDriverSetupState(integration.StopEvent, integration.OkState, "", nil)
+	})
+
+	return d
+}
+
+// Record a session of a Remote Two and return the record file
+func recordSession(t *testing.T) string {
+	t.Helper()
+
+	config := remotetest.Config(t.TempDir())
+	config.AuthMethod = integration.MessageAuthMethod
+	config.AuthToken = "auth-secret"
+	config.RecordFile = filepath.Join(t.TempDir(), "record.jsonl")
+
+	remote := startRemote(t, newRecordTestDriver(t, config))
+
+	if _, err := remote.GetDriverMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := remote.SetupDriver(integration.SetupData{"port": "8080", "gateway_secret": "gateway-secret"}, false)
+	if err != nil || resp.Code != 200 {
+		t.Fatalf("Setup failed: %v %+v", err, resp)
+	}
+	if _, err := remote.WaitSetupState(integration.OkState); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.SubscribeEvents("light"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = remote.EntityCommand("light", "on", map[string]interface{}{"brightness": 100})
+	if err != nil || resp.Code != 200 {
+		t.Fatalf("Command failed: %v %+v", err, resp)
+	}
+	if _, err := remote.WaitEntityChange("light"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = remote.EntityCommand("unknown", "on", nil)
+	if err != nil || resp.Code != 404 {
+		t.Fatalf("Expected 404 for an unknown entity: %v %+v", err, resp)
+	}
+
+	if _, err := remote.GetEntityStates(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stops the integration and closes the record file
+	if err := remote.Close(); err != nil {
+		t.Fatalf("Integration stopped with error: %v", err)
+	}
+
+	return config.RecordFile
+}
+
+func TestRecording(t *testing.T) {
+	recordFile := recordSession(t)
+
+	raw, err := os.ReadFile(recordFile)
+	if err != nil {
+		t.Fatalf("Cannot read record file: %v", err)
+	}
+
+	for _, secret := range []string{"auth-secret", "gateway-secret"} {
+		if bytes.Contains(raw, []byte(secret)) {
+			t.Errorf("Secret %s recorded in clear text", secret)
+		}
+	}
+
+	// One json object per line with the timestamp, connection, direction and message
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	var messages []string
+	for scanner.Scan() {
+		frame := map[string]json.RawMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			t.Fatalf("Invalid line %s: %v", scanner.Text(), err)
+		}
+
+		for _, field := range []string{"ts", "conn", "dir", "msg"} {
+			if _, ok := frame[field]; !ok {
+				t.Errorf("Line without %s: %s", field, scanner.Text())
+			}
+		}
+
+		msg := struct {
+			Kind string `json:"kind"`
+			Msg  string `json:"msg"`
+		}{}
+		if err := json.Unmarshal(frame["msg"], &msg); err != nil {
+			t.Fatalf("Invalid message %s: %v", frame["msg"], err)
+		}
+
+		var dir string
+		_ = json.Unmarshal(frame["dir"], &dir)
+		messages = append(messages, dir+" "+msg.Kind+" "+msg.Msg)
+	}
+
+	for _, expected := range []string{
+		"out event auth_required",
+		"in req auth",
+		"out resp authentication",
+		"in req setup_driver",
+		"out event driver_setup_change",
+		"in req entity_command",
+		"out event entity_change",
+		"out resp entity_states",
+	} {
+		if !containsString(messages, expected) {
+			t.Errorf("Recording has no %s: %v", expected, messages)
+		}
+	}
+
+	frames, err := integration.ReadRecording(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Cannot read recording: %v", err)
+	}
+	if len(frames) != len(messages) {
+		t.Errorf("Expected %d frames, got %d", len(messages), len(frames))
+	}
+	if connections := remotetest.Connections(frames); len(connections) != 1 {
+		t.Errorf("Expected one recorded connection, got %v", connections)
+	}
+
+	for _, frame := range frames {
+		if strings.Contains(string(frame.Message), `"setup_driver"`) && !strings.Contains(string(frame.Message), `"gateway_secret":"******"`) {
+			t.Errorf("Password field not masked: %s", frame.Message)
+		}
+	}
+}
+
+func TestReplayMatchesRecording(t *testing.T) {
+	file, err := os.Open(recordSession(t))
+	if err != nil {
+		t.Fatalf("Cannot open record file: %v", err)
+	}
+	defer file.Close()
+
+	frames, err := integration.ReadRecording(file)
+	if err != nil {
+		t.Fatalf("Cannot read recording: %v", err)
+	}
+	frames = remotetest.ConnectionFrames(frames, remotetest.Connections(frames)[0])
+
+	replay := func(frames []integration.RecordedFrame) []remotetest.Difference {
+		config := remotetest.Config(t.TempDir())
+		config.AuthMethod = integration.MessageAuthMethod
+		config.AuthToken = "auth-secret"
+
+		remote := startRemote(t, newRecordTestDriver(t, config))
+
+		differences, err := remote.Replay(frames)
+		if err != nil {
+			t.Fatalf("Cannot replay: %v", err)
+		}
+
+		return differences
+	}
+
+	if differences := replay(frames); len(differences) != 0 {
+		t.Errorf("Expected the replay to match the recording, got %v", differences)
+	}
+
+	// A recording of a driver that answered the command differently
+	changed := make([]integration.RecordedFrame, len(frames))
+	copy(changed, frames)
+	for idx, frame := range changed {
+		if frame.Direction == integration.RecordOutbound && strings.Contains(string(frame.Message), `"code":404`) {
+			changed[idx].Message = json.RawMessage(strings.Replace(string(frame.Message), `"code":404`, `"code":200`, 1))
+		}
+	}
+
+	differences := replay(changed)
+	if len(differences) != 1 || !strings.Contains(string(differences[0].Actual), `"code":404`) {
+		t.Errorf("Expected the changed response as difference, got %v", differences)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
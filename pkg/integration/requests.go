@@ -2,19 +2,23 @@ package integration
 
 import (
 	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/websocket"
 	"github.com/splattner/goucrt/pkg/entities"
-	"k8s.io/utils/strings/slices"
 )
 
 // Handle the request Message from Remote Two
-func (i *Integration) handleRequest(req *RequestMessage, p []byte) {
+func (i *Integration) handleRequest(s *session, req *RequestMessage, p []byte) {
 	var res interface{}
 
-	log.WithField("RawMessage", string(p)).Debug("Request received")
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.WithField("RawMessage", redactMessage(p, i.isSecretSetupDataKey)).Debug("Request received")
+	}
 
 	switch req.Msg {
 	case "auth":
@@ -23,8 +27,7 @@ func (i *Integration) handleRequest(req *RequestMessage, p []byte) {
 			log.WithError(err).Error("Cannot unmarshall authRequiredReq")
 		}
 
-		// TODO
-		//res = i.handleAuthRequired(&authRequiredReq)
+		res = i.handleAuthRequest(&authRequiredReq)
 
 	case "get_driver_version":
 		driverVersionReq := DriverVersionReq{}
@@ -48,7 +51,7 @@ func (i *Integration) handleRequest(req *RequestMessage, p []byte) {
 			log.WithError(err).Error("Cannot unmarshall deviceStateMessageReq")
 		}
 
-		i.handleGetDeviceStateRequest(&deviceStateMessageReq)
+		i.handleGetDeviceStateRequest(s, &deviceStateMessageReq)
 
 	case "get_available_entities":
 		availableEntityMessageReq := AvailableEntityMessageReq{}
@@ -63,14 +66,17 @@ func (i *Integration) handleRequest(req *RequestMessage, p []byte) {
 			log.WithError(err).Error("Cannot unmarshall subscribeEventMessageReq")
 		}
 
-		res = i.handleSubscribeEventRequest(&subscribeEventMessageReq)
+		res = i.handleSubscribeEventRequest(s, &subscribeEventMessageReq)
+
+		// Entity changes collected while the Remote Two was disconnected in standby are sent after the response
+		defer i.replayPendingChanges(s)
 	case "unsubscribe_events":
 		unsubscribeEventMessageReq := UnubscribeEventMessageReq{}
 		if err := json.Unmarshal(p, &unsubscribeEventMessageReq); err != nil {
 			log.WithError(err).Error("Cannot unmarshall unsubscribeEventMessageReq")
 		}
 
-		res = i.handleUnsubscribeEventsRequest(&unsubscribeEventMessageReq)
+		res = i.handleUnsubscribeEventsRequest(s, &unsubscribeEventMessageReq)
 
 	case "get_entity_states":
 		entityStatesReq := GetEntityStatesMessageReq{}
@@ -94,7 +100,13 @@ func (i *Integration) handleRequest(req *RequestMessage, p []byte) {
 			log.WithError(err).Error("Cannot unmarshall setupDriverReq")
 		}
 
-		res = i.handleSetupDriverRequest(&setupDriverReq)
+		setupRes, afterResponse := i.handleSetupDriverRequest(&setupDriverReq)
+		res = setupRes
+
+		// A failed setup is aborted after the response
+		if afterResponse != nil {
+			defer afterResponse()
+		}
 
 	case "set_driver_user_data":
 		setUserData := SetDriverUserDataRequest{}
@@ -102,14 +114,20 @@ func (i *Integration) handleRequest(req *RequestMessage, p []byte) {
 			log.WithError(err).Error("Cannot unmarshall setUserData")
 		}
 
-		res = i.handleSetDriverUserDataRequest(&setUserData)
+		userDataRes, afterResponse := i.handleSetDriverUserDataRequest(&setUserData)
+		res = userDataRes
+
+		// A failed setup is aborted after the response
+		if afterResponse != nil {
+			defer afterResponse()
+		}
 
 	default:
 		log.Debug("mesage not know")
 	}
 
 	if res != nil {
-		if err := i.sendResponseMessage(&res, websocket.TextMessage); err != nil {
+		if err := i.sendResponseMessage(s, &res, websocket.TextMessage); err != nil {
 			log.Error(err)
 		}
 	}
@@ -117,10 +135,19 @@ func (i *Integration) handleRequest(req *RequestMessage, p []byte) {
 
 // Called by the Remote Two when it needs to synchronize the device state,
 // e.g. after waking up from standby, or if it doesn't receive regular device_state events.
-func (i *Integration) handleGetDeviceStateRequest(req *DeviceStateMessageReq) {
+func (i *Integration) handleGetDeviceStateRequest(s *session, req *DeviceStateMessageReq) {
+
+	device_ids := i.DeviceIds()
+	if req.MsgData.DeviceId != "" {
+		device_ids = []string{req.MsgData.DeviceId}
+	}
 
-	// The response is a event Message and not a response
-	i.sendDeviceStateEvent()
+	// The response is a event Message and not a response, only sent to the requesting session
+	for _, device_id := range device_ids {
+		if err := s.sendMessage(i.deviceStateEvent(device_id)); err != nil {
+			log.WithError(err).Error("Cannot send Event Message")
+		}
+	}
 }
 
 // Get version information about the integration driver.
@@ -176,21 +203,27 @@ func (i *Integration) handleGetAvailableEntitiesRequest(req *AvailableEntityMess
 		"MsgData": req.MsgData,
 	}).Debug("Get available Entities")
 
-	var entities []interface{}
+	var availableEntities []interface{}
 
 	var res interface{}
 
-	for _, e := range i.Entities {
-		if req.MsgData.Filter.EntityType.Type == "" || i.getEntityType(e).Type == req.MsgData.Filter.EntityType.Type {
-			entities = append(entities, e)
+	filter := req.MsgData.Filter
+
+	for _, e := range i.Entities.List() {
+		if !entityOfDevice(e, filter.DeviceId.DeviceId) {
+			continue
+		}
+
+		if filter.EntityType.Type == "" || e.GetEntityType().Type == filter.EntityType.Type {
+			availableEntities = append(availableEntities, e)
 		}
 	}
 
-	if req.MsgData.Filter.EntityType.Type == "" {
+	if filter.EntityType.Type == "" && filter.DeviceId.DeviceId == "" {
 		res = AvailableEntityNoFilterMessage{
 			CommonResp{Kind: "resp", Id: req.Id, Msg: "available_entities", Code: 200},
 			AvailableEntityNoFilterData{
-				AvailableEntities: entities,
+				AvailableEntities: availableEntities,
 			},
 		}
 	} else {
@@ -198,7 +231,7 @@ func (i *Integration) handleGetAvailableEntitiesRequest(req *AvailableEntityMess
 			CommonResp{Kind: "resp", Id: req.Id, Msg: "available_entities", Code: 200},
 			AvailableEntityData{
 				Filter:            req.MsgData.Filter,
-				AvailableEntities: entities,
+				AvailableEntities: availableEntities,
 			},
 		}
 	}
@@ -209,15 +242,31 @@ func (i *Integration) handleGetAvailableEntitiesRequest(req *AvailableEntityMess
 
 // start driver setup
 // https://studio.asyncapi.com/?url=https://raw.githubusercontent.com/unfoldedcircle/core-api/main/integration-api/asyncapi.yaml#message-setup_driver
-func (i *Integration) handleSetupDriverRequest(req *SetupDriverMessageReq) *ResponseMessage {
+// The returned function must be called after the response was sent
+func (i *Integration) handleSetupDriverRequest(req *SetupDriverMessageReq) (*ResponseMessage, func()) {
 
-	i.SetupData = req.MsgData.Value
+	if err := i.Metadata.SetupDataSchema.Validate(req.MsgData.Value); err != nil {
+		log.WithError(err).Error("Invalid setup data")
 
-	i.PersistSetupData()
+		// Keep the current setup data and abort the setup
+		return invalidSetupInputResponse(req.Id, err), i.failSetup
+	}
 
-	if i.handleSetupFunction != nil {
-		// The handleSetupFunction is where the driver specific implmenentation for driver setup is
-		go i.handleSetupFunction(req.MsgData.Value)
+	if len(i.getBackends()) > 0 {
+		i.startBackendSetups(req.MsgData)
+	} else if err := i.startSetup(req.MsgData); err != nil {
+		log.WithError(err).Error("Cannot persist setup data")
+
+		// Abort the setup flow once the Remote Two got the response
+		return &ResponseMessage{
+			CommonResp{
+				Kind: "resp",
+				Id:   req.Id,
+				Msg:  "result",
+				Code: 500,
+			},
+			nil,
+		}, i.failSetup
 	}
 
 	res := ResponseMessage{
@@ -230,41 +279,33 @@ func (i *Integration) handleSetupDriverRequest(req *SetupDriverMessageReq) *Resp
 		nil,
 	}
 
-	return &res
+	return &res, nil
+
+}
 
+// Send the ERROR setup state, must be called after the response to the setup request
+func (i *Integration) failSetup() {
+	i.SetDriverSetupState(StopEvent, ErrorState, OtherError, nil)
 }
 
 // Subscribe to entity state change events to receive entity_change events from the integration driver.
 // If no entity IDs are specified then events for all available entities are sent to the Remote Two.
-func (i *Integration) handleSubscribeEventRequest(req *SubscribeEventMessageReq) *SubscribeEventMessage {
-
-	// Add entities to SubscribedEntities if not already in there
-	if req.MsgData.EntityIds == nil {
-		// Subscribe to all available entities
-		for _, e := range i.Entities {
-			entity_id := i.getEntityId(e)
-			if !slices.Contains(i.SubscribedEntities, entity_id) {
-				log.WithField("entity_id", entity_id).Info("RT subscribed to entity")
-				i.SubscribedEntities = append(i.SubscribedEntities, entity_id)
-				i.callSubscribeCallback(e)
+func (i *Integration) handleSubscribeEventRequest(s *session, req *SubscribeEventMessageReq) *SubscribeEventMessage {
 
-			}
-		}
+	entityIds := req.MsgData.EntityIds
 
-	} else {
-		for _, entity_id := range req.MsgData.EntityIds {
-			if !slices.Contains(i.SubscribedEntities, entity_id) {
-				log.WithField("entity_id", entity_id).Info("RT subscribed to entity")
-				i.SubscribedEntities = append(i.SubscribedEntities, entity_id)
-
-				if entity, _, err := i.GetEntityById(entity_id); err != nil {
-					i.callSubscribeCallback(entity)
-				}
+	if entityIds == nil {
+		// Subscribe to all available entities of the device
+		for _, e := range i.Entities.List() {
+			if entityOfDevice(e, req.MsgData.DeviceId) {
+				entityIds = append(entityIds, e.GetId())
 			}
 		}
 	}
 
-	log.WithField("subscribedEtities", i.SubscribedEntities).Debug("Change in subscribed entities")
+	i.subscribeEntities(s, entityIds)
+
+	log.WithFields(s.logFields()).WithField("subscribedEtities", s.subscriptions.List()).Debug("Change in subscribed entities")
 
 	res := SubscribeEventMessage{
 		CommonResp{Kind: "resp", Id: req.Id, Msg: "result", Code: 200},
@@ -276,23 +317,23 @@ func (i *Integration) handleSubscribeEventRequest(req *SubscribeEventMessageReq)
 
 // If no entity IDs are specified then all events for all available entities are stopped.
 // This message is sent by the Remote Two if a previously configured entity is no longer used and therefore no longer interested in entity updates. If the integration driver keeps sending events for the unsubscribed entities then they are simply discarded.
-func (i *Integration) handleUnsubscribeEventsRequest(req *UnubscribeEventMessageReq) *UnubscribeEventMessage {
-
-	for ix, e := range i.SubscribedEntities {
-		if req.MsgData.EntityIds == nil || slices.Contains(req.MsgData.EntityIds, e) {
-			log.WithField("entity_id", e).Info("RT subscribed from entity")
+func (i *Integration) handleUnsubscribeEventsRequest(s *session, req *UnubscribeEventMessageReq) *UnubscribeEventMessage {
 
-			i.SubscribedEntities[ix] = i.SubscribedEntities[len(i.SubscribedEntities)-1] // Copy last element to index i.
-			i.SubscribedEntities[len(i.SubscribedEntities)-1] = ""                       // Erase last element (write zero value).
-			i.SubscribedEntities = i.SubscribedEntities[:len(i.SubscribedEntities)-1]    // Truncate slice.
+	entityIds := req.MsgData.EntityIds
 
-			if entity, _, err := i.GetEntityById(e); err != nil {
-				i.callUnubscribeCallback(entity)
+	if entityIds == nil {
+		for _, entity_id := range s.subscriptions.List() {
+			// Entities removed in the meantime can only be unsubscribed without a device_id
+			e, err := i.GetEntityById(entity_id)
+			if req.MsgData.DeviceId == "" || (err == nil && entityOfDevice(e, req.MsgData.DeviceId)) {
+				entityIds = append(entityIds, entity_id)
 			}
 		}
 	}
 
-	log.WithField("subscribedEtities", i.SubscribedEntities).Debug("Change in subscribed entities")
+	i.unsubscribeEntities(s, entityIds)
+
+	log.WithFields(s.logFields()).WithField("subscribedEtities", s.subscriptions.List()).Debug("Change in subscribed entities")
 
 	res := UnubscribeEventMessage{
 		CommonResp{Kind: "resp", Id: req.Id, Msg: "result", Code: 200},
@@ -306,20 +347,10 @@ func (i *Integration) handleGetEntityStatesRequest(req *GetEntityStatesMessageRe
 
 	var entityStates []entities.EntityStateData
 
-	for _, e := range i.Entities {
-
-		entity_id := i.getEntityId(e)
-		device_id := i.getDeviceId(e)
-		entity_type := i.getEntityType(e)
-		attributes := i.getEntityAttributes(e)
-
-		entity_state := entities.EntityStateData{
-			EntityId:   entity_id,
-			DeviceId:   device_id,
-			EntityType: entity_type,
-			Attributes: attributes,
+	for _, e := range i.Entities.List() {
+		if entityOfDevice(e, req.MsgData.DeviceId) {
+			entityStates = append(entityStates, *e.GetEntityState())
 		}
-		entityStates = append(entityStates, entity_state)
 	}
 
 	res := GetEntityStatesMessage{
@@ -331,36 +362,107 @@ func (i *Integration) handleGetEntityStatesRequest(req *GetEntityStatesMessageRe
 }
 
 // Handle the entity command request sent by the remote
-func (i *Integration) handleEntityCommandRequest(req *EntityCommandReq) *EntityCommandResponse {
+// The params are decoded and validated before the command is handled, invalid params are rejected with 400
+func (i *Integration) handleEntityCommandRequest(req *EntityCommandReq) (response *EntityCommandResponse) {
 
 	log.WithFields(log.Fields{
 		"entity_id": req.MsgData.EntityId,
 		"command":   req.MsgData.CmdId,
 		"params":    req.MsgData.Params}).Debug("Entity Command")
 
-	entity, _, err := i.GetEntityById(req.MsgData.EntityId)
+	res := EntityCommandResponse{
+		CommonResp: CommonResp{Kind: "resp", Id: req.Id, Msg: "result"},
+	}
 
-	var returnCode int
+	// Observed after a panic was recovered, so the final result code is recorded
+	start := time.Now()
+	entityType := "unknown"
+	defer func() {
+		i.metrics.observeCommand(entityType, res.Code, time.Since(start))
+	}()
+
+	// A panicking command function must not kill the websocket connection
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"entity_id": req.MsgData.EntityId,
+				"command":   req.MsgData.CmdId,
+				"panic":     r,
+				"stack":     string(debug.Stack())}).Error("Recovered from panic in entity command")
+
+			res.Code = 500
+			res.MsgData = &ErrorResponseData{Code: "INTERNAL_ERROR", Message: fmt.Sprintf("command panicked: %v", r)}
+			response = &res
+		}
+	}()
 
-	if err == nil {
-		returnCode = i.handleCommand(entity, req)
-	} else {
-		returnCode = 404
+	entity, err := i.GetEntityById(req.MsgData.EntityId)
+	if err == nil && !entityOfDevice(entity, req.MsgData.DeviceId) {
+		err = fmt.Errorf("entity %s does not belong to device %s", req.MsgData.EntityId, req.MsgData.DeviceId)
+	}
+	if err != nil {
+		res.Code = 404
+		res.MsgData = &ErrorResponseData{Code: "NOT_FOUND", Message: err.Error()}
+		return &res
 	}
 
-	res := EntityCommandResponse{
-		CommonResp{Kind: "resp", Id: req.Id, Msg: "result", Code: returnCode},
+	entityType = string(entity.GetEntityType().Type)
+
+	params, err := entities.DecodeCommandParams(entity.GetEntityType().Type, req.MsgData.CmdId, req.MsgData.Params)
+	if err != nil {
+		log.WithError(err).WithField("entity_id", req.MsgData.EntityId).Info("Invalid entity command params")
+
+		res.Code = 400
+		res.MsgData = &ErrorResponseData{Code: "BAD_REQUEST", Message: err.Error()}
+		return &res
+	}
+
+	if err := i.handleCommand(entity, req, params); err != nil {
+		res.Code = entities.CommandErrorCode(err)
+		res.MsgData = &ErrorResponseData{Code: errorResponseCodes[res.Code], Message: err.Error()}
+
+		log.WithError(err).WithFields(log.Fields{
+			"entity_id": req.MsgData.EntityId,
+			"command":   req.MsgData.CmdId,
+			"code":      res.Code}).Info("Entity command failed")
+
+		return &res
 	}
 
+	res.Code = 200
+
 	return &res
 
 }
 
-func (i *Integration) handleSetDriverUserDataRequest(req *SetDriverUserDataRequest) *ResponseMessage {
+// The returned function must be called after the response was sent
+func (i *Integration) handleSetDriverUserDataRequest(req *SetDriverUserDataRequest) (*ResponseMessage, func()) {
 
-	log.WithField("Message", req.MsgData).Debug("Set DriverUserData Request")
+	// The input belongs to the backend in setup
+	if backend := i.activeBackendSetup(); backend != nil {
+		return backend.handleSetDriverUserDataRequest(req)
+	}
+
+	log.WithFields(log.Fields{
+		"InputValues": i.redactedValues(req.MsgData.InputValues),
+		"Confirm":     req.MsgData.Confirm}).Debug("Set DriverUserData Request")
 
-	if i.handleSetDriverUserDataFunction != nil {
+	i.setupMutex.Lock()
+	page := i.userActionPage
+	i.setupMutex.Unlock()
+
+	if page != nil {
+		if err := page.Validate(req.MsgData.InputValues); err != nil {
+			log.WithError(err).Error("Invalid driver user data")
+
+			// Abort the setup, a running setup is rolled back
+			return invalidSetupInputResponse(req.Id, err), i.failSetup
+		}
+	}
+
+	if i.setupFlow != nil && i.handleSetupFlowInput(req.MsgData.InputValues) {
+		// Handled by the running setup flow
+	} else if i.handleSetDriverUserDataFunction != nil {
 		go i.handleSetDriverUserDataFunction(req.MsgData.InputValues, req.MsgData.Confirm)
 	}
 
@@ -374,5 +476,18 @@ func (i *Integration) handleSetDriverUserDataRequest(req *SetDriverUserDataReque
 		nil,
 	}
 
-	return &res
+	return &res, nil
+}
+
+// Response to setup input that does not match the setup data schema or the requested settings
+func invalidSetupInputResponse(id int, err error) *ResponseMessage {
+	return &ResponseMessage{
+		CommonResp{
+			Kind: "resp",
+			Id:   id,
+			Msg:  "result",
+			Code: 400,
+		},
+		&ErrorResponseData{Code: errorResponseCodes[400], Message: err.Error()},
+	}
 }
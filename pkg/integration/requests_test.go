@@ -0,0 +1,104 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Handle a raw request of a session and return kind, msg and code or state of the queued messages
+func handleTestRequest(t *testing.T, i *Integration, s *session, raw string) []string {
+	t.Helper()
+
+	req := RequestMessage{}
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		t.Fatalf("Cannot unmarshal request: %v", err)
+	}
+
+	i.handleRequest(s, &req, []byte(raw))
+
+	var result []string
+	for _, m := range s.queue.popAll() {
+		data, err := m.bytes()
+		if err != nil {
+			t.Fatalf("Cannot marshal message: %v", err)
+		}
+
+		var msg struct {
+			Kind    string `json:"kind"`
+			Msg     string `json:"msg"`
+			Code    int    `json:"code"`
+			MsgData struct {
+				State string `json:"state"`
+			} `json:"msg_data"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Cannot unmarshal message: %v", err)
+		}
+
+		if msg.Kind == "resp" {
+			result = append(result, fmt.Sprintf("%s %s %d", msg.Kind, msg.Msg, msg.Code))
+		} else {
+			result = append(result, fmt.Sprintf("%s %s %s", msg.Kind, msg.Msg, msg.MsgData.State))
+		}
+	}
+
+	return result
+}
+
+func newSetupTestIntegration(t *testing.T) (*Integration, *session) {
+	i := newTestIntegration(t, Config{})
+	i.Metadata.SetupDataSchema = SetupDataSchema{Settings: []SetupDataSchemaSettings{
+		{Id: "port", Field: SettingTypeNumber{Number: SettingTypeNumberDefinition{Min: 1, Max: 65535}}},
+	}}
+
+	s := newTestSession(16, BlockQueuePolicy)
+	i.sessions[s.id] = s
+
+	return i, s
+}
+
+func TestInvalidSetupDataIsAnsweredBeforeTheErrorState(t *testing.T) {
+	i, s := newSetupTestIntegration(t)
+
+	messages := handleTestRequest(t, i, s, `{"kind":"req","id":1,"msg":"setup_driver","msg_data":{"setup_data":{"port":"0"}}}`)
+	expected := []string{"resp result 400", "event driver_setup_change ERROR"}
+
+	if fmt.Sprint(messages) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+}
+
+func TestFailedPersistIsAnsweredBeforeTheErrorState(t *testing.T) {
+	i, s := newSetupTestIntegration(t)
+
+	// The setup data cannot be written into a file
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("Cannot create file: %v", err)
+	}
+	i.Config.ConfigHome = file
+
+	messages := handleTestRequest(t, i, s, `{"kind":"req","id":1,"msg":"setup_driver","msg_data":{"setup_data":{"port":"80"}}}`)
+	expected := []string{"resp result 500", "event driver_setup_change ERROR"}
+
+	if fmt.Sprint(messages) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+}
+
+func TestInvalidUserDataIsAnsweredBeforeTheErrorState(t *testing.T) {
+	i, s := newSetupTestIntegration(t)
+	i.userActionPage = &SettigsPage{Settings: []Setting{
+		{Id: "port", Field: SettingTypeNumber{Number: SettingTypeNumberDefinition{Min: 1, Max: 65535}}},
+	}}
+
+	messages := handleTestRequest(t, i, s, `{"kind":"req","id":1,"msg":"set_driver_user_data","msg_data":{"input_values":{"port":"0"}}}`)
+	expected := []string{"resp result 400", "event driver_setup_change ERROR"}
+
+	if fmt.Sprint(messages) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+}
@@ -4,12 +4,10 @@ import (
 	"encoding/json"
 
 	log "github.com/sirupsen/logrus"
-
-	"github.com/gorilla/websocket"
 )
 
-// Send a generic Response Message to Remote Two
-func (i *Integration) sendResponseMessage(res interface{}, messageType int) error {
+// Send a generic Response Message to the session of the Remote Two which sent the request
+func (i *Integration) sendResponseMessage(s *session, res interface{}, messageType int) error {
 
 	msg, err := json.Marshal(res)
 	if err != nil {
@@ -22,43 +20,37 @@ func (i *Integration) sendResponseMessage(res interface{}, messageType int) erro
 		log.WithError(err).Error("Cannot unmarshal response")
 	}
 
-	log.WithFields(log.Fields{
+	log.WithFields(s.logFields()).WithFields(log.Fields{
 		"Message": response.Msg,
 		"Id":      response.Id,
 		"Kind":    response.Kind,
 		"Data":    response.MsgData}).Info("Send Response Message")
 
-	i.Remote.messageChannel <- msg
+	return s.sendResponse(msg)
 
-	return nil
+}
 
+func (i *Integration) driverVersionData() DriverVersionData {
+	return DriverVersionData{
+		Name: i.Metadata.Name.En,
+		Version: Version{
+			Api:    API_VERSION,
+			Driver: API_VERSION,
+		},
+	}
 }
 
-func (i *Integration) authenticationResponseMessage(code int) *AuthenticationResponse {
+func (i *Integration) authenticationResponseMessage(reqId int, code int) *AuthenticationResponse {
 
 	res := AuthenticationResponse{
 		CommonResp{
 			Kind: "resp",
-			Id:   0,
+			Id:   reqId,
 			Msg:  "authentication",
 			Code: code,
 		},
-		DriverVersionData{
-			Name: i.Metadata.Name.En,
-			Version: Version{
-				Api:    API_VERSION,
-				Driver: API_VERSION,
-			},
-		},
+		i.driverVersionData(),
 	}
 
 	return &res
 }
-
-// Send a AuthenticationResponse Message
-func (i *Integration) SendAuthenticationResponse() {
-	msg := i.authenticationResponseMessage(200)
-	if err := i.sendResponseMessage(msg, websocket.TextMessage); err != nil {
-		log.WithError(err).Error("Cannot send Response Message")
-	}
-}
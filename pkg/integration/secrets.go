@@ -0,0 +1,261 @@
+package integration
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix of encrypted setup data values on disk
+const encryptedValuePrefix = "enc:v1:"
+
+// Replacement of secret values in logs
+const redactedValue = "******"
+
+// Setup data keys that are always treated as secret
+// Password fields of the setup data schema are secret per integration, see (*Integration).isSecretSetupDataKey
+var secretSetupDataKeys = map[string]bool{
+	"apikey":           true,
+	"api_key":          true,
+	"password":         true,
+	"mqtt_password":    true,
+	"pin":              true,
+	"registration_pin": true,
+	"token":            true,
+	"auth_token":       true,
+}
+
+// Return the setup data with the known secret keys masked
+// Used when setup data is printed, e.g. in a log line
+func (d SetupData) String() string {
+	return fmt.Sprint(map[string]string(d.redacted(isSecretSetupDataKey)))
+}
+
+func (d SetupData) redacted(isSecret func(string) bool) SetupData {
+	redacted := make(SetupData, len(d))
+	for k, v := range d {
+		if isSecret(k) && v != "" {
+			v = redactedValue
+		}
+		redacted[k] = v
+	}
+
+	return redacted
+}
+
+// Check if a setup data key is one of the known secret keys
+func isSecretSetupDataKey(key string) bool {
+	return secretSetupDataKeys[strings.ToLower(key)]
+}
+
+// Check if a setup data key is a secret, either a known secret key or a password field of the setup data schema
+func (i *Integration) isSecretSetupDataKey(key string) bool {
+	if isSecretSetupDataKey(key) {
+		return true
+	}
+
+	if i.Metadata == nil {
+		return false
+	}
+
+	for _, setting := range i.Metadata.SetupDataSchema.Settings {
+		if setting.Id == key && isPasswordField(setting.Field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isPasswordField(field interface{}) bool {
+	switch f := field.(type) {
+	case SettingTypePassword, *SettingTypePassword:
+		return true
+	case map[string]interface{}:
+		_, ok := f["password"]
+		return ok
+	}
+
+	return false
+}
+
+// Return a copy of the setup data with all secrets masked
+func (i *Integration) RedactedSetupData() SetupData {
+	return i.GetSetupData().redacted(i.isSecretSetupDataKey)
+}
+
+// Return a copy of user input values with all secrets masked
+func (i *Integration) redactedValues(values map[string]string) SetupData {
+	return SetupData(values).redacted(i.isSecretSetupDataKey)
+}
+
+// Mask the values of secret keys in a raw json message, e.g. setup_data or input_values of a request
+// Messages that are not valid json are returned unchanged
+func redactMessage(p []byte, isSecret func(string) bool) string {
+	var msg interface{}
+	if err := json.Unmarshal(p, &msg); err != nil {
+		return string(p)
+	}
+
+	redacted, err := json.Marshal(redactJSON(msg, isSecret))
+	if err != nil {
+		return string(p)
+	}
+
+	return string(redacted)
+}
+
+func redactJSON(value interface{}, isSecret func(string) bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, nested := range v {
+			if s, ok := nested.(string); ok && s != "" && isSecret(k) {
+				v[k] = redactedValue
+				continue
+			}
+			v[k] = redactJSON(nested, isSecret)
+		}
+	case []interface{}:
+		for ix, nested := range v {
+			v[ix] = redactJSON(nested, isSecret)
+		}
+	}
+
+	return value
+}
+
+// Return the key to encrypt secrets on disk, nil if no key is configured
+// The key is taken from the secrets key or the content of the secrets key file
+func (c *Config) secretsKey() ([]byte, error) {
+	secret := c.SecretsKey
+
+	if secret == "" && c.SecretsKeyFile != "" {
+		file, err := os.ReadFile(c.SecretsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read secrets key file: %w", err)
+		}
+		secret = strings.TrimSpace(string(file))
+	}
+
+	if secret == "" {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(secret))
+
+	return key[:], nil
+}
+
+// Encrypt the secret values of the setup data
+func (i *Integration) encryptSecrets(data SetupData) (SetupData, error) {
+	encrypted := make(SetupData, len(data))
+	warned := false
+
+	for k, v := range data {
+		if v == "" || !i.isSecretSetupDataKey(k) {
+			encrypted[k] = v
+			continue
+		}
+
+		if i.secretsKey == nil {
+			if !warned {
+				log.Warn("No secrets key configured, secrets in setup data are persisted in clear text")
+				warned = true
+			}
+			encrypted[k] = v
+			continue
+		}
+
+		value, err := encryptValue(i.secretsKey, v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encrypt %s: %w", k, err)
+		}
+		encrypted[k] = value
+	}
+
+	return encrypted, nil
+}
+
+// Decrypt the encrypted values of the setup data in place
+// Return true if a secret was found in clear text
+func (i *Integration) decryptSecrets(data SetupData) (bool, error) {
+	cleartext := false
+
+	for k, v := range data {
+		if !strings.HasPrefix(v, encryptedValuePrefix) {
+			if v != "" && i.isSecretSetupDataKey(k) {
+				cleartext = true
+			}
+			continue
+		}
+
+		if i.secretsKey == nil {
+			return false, fmt.Errorf("%s is encrypted but no secrets key is configured", k)
+		}
+
+		value, err := decryptValue(i.secretsKey, v)
+		if err != nil {
+			return false, fmt.Errorf("cannot decrypt %s: %w", k, err)
+		}
+		data[k] = value
+	}
+
+	return cleartext, nil
+}
+
+// Encrypt a value with AES-GCM, the random nonce is prepended to the ciphertext
+func encryptValue(key []byte, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+
+	return encryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptValue(key []byte, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("wrong secrets key or corrupt value")
+	}
+
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
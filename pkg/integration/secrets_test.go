@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestSecretSetupDataKeysArePerIntegration(t *testing.T) {
+	withPassword := newTestIntegration(t, Config{})
+	withPassword.SetMetadata(&DriverMetadata{DriverId: "password", SetupDataSchema: SetupDataSchema{Settings: []SetupDataSchemaSettings{
+		{Id: "gateway_secret", Field: SettingTypePassword{}},
+	}}})
+
+	other := newTestIntegration(t, Config{})
+
+	data := SetupData{"gateway_secret": "secret", "apikey": "key", "ipaddr": "10.0.0.1"}
+	withPassword.SetSetupData(data)
+	other.SetSetupData(data)
+
+	redacted := withPassword.RedactedSetupData()
+	if redacted["gateway_secret"] != redactedValue || redacted["apikey"] != redactedValue || redacted["ipaddr"] != "10.0.0.1" {
+		t.Errorf("Unexpected redacted setup data: %v", redacted)
+	}
+
+	// The password field of another integration is no secret here
+	redacted = other.RedactedSetupData()
+	if redacted["gateway_secret"] != "secret" || redacted["apikey"] != redactedValue {
+		t.Errorf("Unexpected redacted setup data: %v", redacted)
+	}
+
+	// Printing setup data only masks the known secret keys
+	if isSecretSetupDataKey("gateway_secret") {
+		t.Error("Password field registered as known secret key")
+	}
+}
+
+func TestEncryptedSetupDataIsNotOverwrittenWithoutKey(t *testing.T) {
+	i := newTestIntegration(t, Config{SecretsKey: "key"})
+	i.SetSetupData(SetupData{"apikey": "secret"})
+	if err := i.PersistSetupData(); err != nil {
+		t.Fatalf("Cannot persist setup data: %v", err)
+	}
+
+	persisted, err := os.ReadFile(i.setupDataFile())
+	if err != nil {
+		t.Fatalf("Cannot read setup data: %v", err)
+	}
+
+	// Restart without the secrets key
+	restarted, err := NewIntegration(Config{ConfigHome: i.Config.ConfigHome, DisableMDNS: true, WebsocketPath: "/ws"})
+	if err != nil {
+		t.Fatalf("Cannot create integration: %v", err)
+	}
+	restarted.SetMetadata(&DriverMetadata{DriverId: "test"})
+
+	restarted.SetSetupDataValue("ipaddr", "10.0.0.1")
+	if err := restarted.PersistSetupData(); err == nil {
+		t.Error("Expected an error persisting setup data that could not be loaded")
+	}
+
+	current, err := os.ReadFile(restarted.setupDataFile())
+	if err != nil {
+		t.Fatalf("Cannot read setup data: %v", err)
+	}
+	if !bytes.Equal(persisted, current) {
+		t.Error("Encrypted setup data was overwritten")
+	}
+
+	// With the key the setup data can be persisted again
+	restarted.Config.SecretsKey = "key"
+	restarted.secretsKey, _ = restarted.Config.secretsKey()
+	if err := restarted.LoadSetupData(); err != nil {
+		t.Fatalf("Cannot load setup data: %v", err)
+	}
+	if err := restarted.PersistSetupData(); err != nil {
+		t.Errorf("Cannot persist setup data after a successful load: %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gorilla/websocket"
+)
+
+// Counter for unique session ids
+var sessionCounter atomic.Uint64
+
+// A websocket connection from a Remote Two (or the web configurator)
+// Each session has its own outbound queue, standby state and subscribed entities
+type session struct {
+	id         string
+	remoteAddr string
+	// Host of the Remote Two, identifies the Remote Two when it reconnects
+	host string
+	ws   *websocket.Conn
+
+	standby atomic.Bool
+
+	// Entities this session subscribed to
+	subscriptions *EntitySubscriptions
+
+	// Entity changes collected while in standby
+	pending *pendingChanges
+
+	// Messages to send over websocket
+	queue *outboundQueue
+
+	metrics *eventMetrics
+
+	// Validate sent and received messages against the integration API schema
+	validateMessages bool
+	// Records sent and received messages, nil if not recording
+	recorder *recorder
+	// Setup data keys masked in logged and recorded messages, the known secret keys if nil
+	isSecret func(key string) bool
+
+	// Closed when the session ends
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Closed to let the write loop send all queued messages and a close message
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// Closed when the write loop stopped
+	writerDone chan struct{}
+}
+
+func newSession(ws *websocket.Conn, queueSize int, queuePolicy QueuePolicy, metrics *eventMetrics) *session {
+	remoteAddr := ws.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	s := session{
+		id:            fmt.Sprint(sessionCounter.Add(1)),
+		remoteAddr:    remoteAddr,
+		host:          host,
+		ws:            ws,
+		subscriptions: NewEntitySubscriptions(),
+		pending:       newPendingChanges(),
+		queue:         newOutboundQueue(queueSize, queuePolicy),
+		metrics:       metrics,
+		done:          make(chan struct{}),
+		closing:       make(chan struct{}),
+		writerDone:    make(chan struct{}),
+	}
+
+	return &s
+}
+
+// Check if a setup data key of a message is a secret
+func (s *session) isSecretKey(key string) bool {
+	if s.isSecret == nil {
+		return isSecretSetupDataKey(key)
+	}
+
+	return s.isSecret(key)
+}
+
+func (s *session) logFields() log.Fields {
+	return log.Fields{
+		"Session":    s.id,
+		"RemoteAddr": s.remoteAddr,
+	}
+}
+
+func (s *session) EnterStandBy() {
+	log.WithFields(s.logFields()).Info("Remote entered standby mode")
+
+	s.standby.Store(true)
+
+}
+
+func (s *session) ExitStandBy() {
+	log.WithFields(s.logFields()).Info("Remote exited standby mode")
+
+	s.standby.Store(false)
+}
+
+func (s *session) InStandBy() bool {
+	return s.standby.Load()
+}
+
+// Queue a message to be sent over the websocket of this session
+func (s *session) enqueue(m *outboundMessage) error {
+	select {
+	case <-s.done:
+		return fmt.Errorf("session %s closed", s.id)
+	default:
+	}
+
+	dropped, coalesced, err := s.queue.push(m)
+
+	if dropped > 0 {
+		s.metrics.dropped.Add(uint64(dropped))
+		log.WithFields(s.logFields()).WithField("Dropped", dropped).Warn("Outbound queue full, dropped events")
+	}
+	if coalesced > 0 {
+		s.metrics.coalesced.Add(uint64(coalesced))
+	}
+
+	return err
+}
+
+// Queue an event
+func (s *session) send(msg []byte) error {
+	return s.enqueue(&outboundMessage{data: msg})
+}
+
+// Queue a response, responses are never dropped
+func (s *session) sendResponse(msg []byte) error {
+	return s.enqueue(&outboundMessage{data: msg, response: true})
+}
+
+// Queue an entity_change event, may be coalesced with a queued event of the same entity
+func (s *session) sendEntityChange(event *EntityChangeEvent) error {
+	return s.enqueue(&outboundMessage{entityChange: event})
+}
+
+// Marshal and queue an event
+func (s *session) sendMessage(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.send(msg)
+}
+
+// Close the session, the read and write loop will stop
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.queue.close()
+	})
+}
+
+// Close the session cleanly, queued messages are sent before the websocket is closed
+func (s *session) shutdown() {
+	s.closingOnce.Do(func() {
+		close(s.closing)
+	})
+}
+
+// Add a new session
+// Entity changes collected while the Remote Two was disconnected in standby are handed over to the session
+func (i *Integration) addSession(s *session) {
+	i.attachPendingChanges(s)
+
+	i.sessionsMutex.Lock()
+	defer i.sessionsMutex.Unlock()
+
+	i.sessions[s.id] = s
+
+	log.WithFields(s.logFields()).WithField("Sessions", len(i.sessions)).Debug("Session added")
+}
+
+// Remove a session and unsubscribe from all its entities
+// If the session is in standby, entity changes are collected until the Remote Two connects again
+func (i *Integration) removeSession(s *session) {
+	i.sessionsMutex.Lock()
+	_, ok := i.sessions[s.id]
+	delete(i.sessions, s.id)
+	i.sessionsMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	log.WithFields(s.logFields()).Debug("Session removed")
+
+	subscriptions := s.subscriptions.Clear()
+
+	i.detachPendingChanges(s, subscriptions)
+	i.unsubscribeEntities(s, subscriptions)
+}
+
+// Return a snapshot of all sessions
+func (i *Integration) getSessions() []*session {
+	// Backends send to the sessions of the hosting integration
+	if i.parent != nil {
+		return i.parent.getSessions()
+	}
+
+	i.sessionsMutex.RLock()
+	defer i.sessionsMutex.RUnlock()
+
+	sessions := make([]*session, 0, len(i.sessions))
+	for _, s := range i.sessions {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+// Return the ids of all entities subscribed by any session
+func (i *Integration) SubscribedEntities() []string {
+	subscribed := NewEntitySubscriptions()
+
+	for _, s := range i.getSessions() {
+		for _, entity_id := range s.subscriptions.List() {
+			subscribed.Add(entity_id)
+		}
+	}
+
+	return subscribed.List()
+}
+
+// Check if any session subscribed to an entity
+func (i *Integration) isSubscribedById(entity_id string) bool {
+	for _, s := range i.getSessions() {
+		if s.subscriptions.Contains(entity_id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Subscribe a session to entities
+// The subscribe callback of an entity is called when it is the first session subscribing to it
+func (i *Integration) subscribeEntities(s *session, entityIds []string) {
+	i.subscriptionsMutex.Lock()
+	defer i.subscriptionsMutex.Unlock()
+
+	for _, entity_id := range entityIds {
+		subscribedByOther := i.isSubscribedById(entity_id)
+
+		if s.subscriptions.Add(entity_id) {
+			log.WithFields(s.logFields()).WithField("entity_id", entity_id).Info("RT subscribed to entity")
+
+			if !subscribedByOther {
+				if entity, err := i.GetEntityById(entity_id); err == nil {
+					entity.CallSubscribeCallback()
+				}
+			}
+		}
+	}
+}
+
+// Unsubscribe a session from entities
+// The unsubscribe callback of an entity is called when no other session is subscribed to it anymore
+func (i *Integration) unsubscribeEntities(s *session, entityIds []string) {
+	i.subscriptionsMutex.Lock()
+	defer i.subscriptionsMutex.Unlock()
+
+	for _, entity_id := range entityIds {
+		s.subscriptions.Remove(entity_id)
+
+		log.WithFields(s.logFields()).WithField("entity_id", entity_id).Info("RT unsubscribed from entity")
+
+		if !i.isSubscribedById(entity_id) {
+			if entity, err := i.GetEntityById(entity_id); err == nil {
+				entity.CallUnsubscribeCallback()
+			}
+		}
+	}
+}
+
+// Cleanly close all sessions and wait until queued messages are sent
+func (i *Integration) closeSessions(ctx context.Context) {
+	sessions := i.getSessions()
+
+	for _, s := range sessions {
+		s.shutdown()
+	}
+
+	for _, s := range sessions {
+		select {
+		case <-s.writerDone:
+		case <-ctx.Done():
+			log.WithFields(s.logFields()).Warn("Timeout while closing session")
+		}
+
+		s.close()
+		s.ws.Close()
+		i.removeSession(s)
+	}
+}
@@ -0,0 +1,178 @@
+package integration
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A driver setup started by a setup_driver request
+type driverSetup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Setup data before the setup started, restored when the setup is aborted or fails
+	previous SetupData
+
+	// Merge the new values into the existing setup data and reconnect the client when done
+	reconfigure bool
+
+	// Set if the setup is driven by a SetupFlow
+	run *setupRun
+}
+
+func copySetupData(data SetupData) SetupData {
+	c := make(SetupData, len(data))
+	for k, v := range data {
+		c[k] = v
+	}
+
+	return c
+}
+
+// Start a new driver setup and apply the setup data of the request
+// A running setup is cancelled, its previous setup data is kept so a rollback restores the last working configuration
+func (i *Integration) beginSetup(value SetupDataValue) (*driverSetup, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	setup := &driverSetup{
+		ctx:         ctx,
+		cancel:      cancel,
+		previous:    i.GetSetupData(),
+		reconfigure: value.Reconfigure,
+	}
+
+	i.setupMutex.Lock()
+	if i.setup != nil {
+		i.setup.cancel()
+		setup.previous = i.setup.previous
+	}
+	i.setup = setup
+	i.setupMutex.Unlock()
+
+	if value.Reconfigure {
+		log.Info("Reconfigure driver setup")
+
+		merged := copySetupData(setup.previous)
+		for k, v := range value.Value {
+			merged[k] = v
+		}
+		i.SetSetupData(merged)
+	} else {
+		i.SetSetupData(value.Value)
+	}
+
+	if err := i.PersistSetupData(); err != nil {
+		i.rollbackSetup(setup)
+		return nil, err
+	}
+
+	return setup, nil
+}
+
+// Apply the setup data and start the setup flow or the setup function of the driver
+func (i *Integration) startSetup(value SetupDataValue) error {
+	setup, err := i.beginSetup(value)
+	if err != nil {
+		return err
+	}
+
+	if i.setupFlow != nil {
+		i.startSetupFlow(setup)
+	} else if i.handleSetupFunction != nil {
+		// The handleSetupFunction is where the driver specific implmenentation for driver setup is
+		// The context is cancelled when the user aborts the setup
+		go i.handleSetupFunction(setup.ctx, i.GetSetupData())
+	}
+
+	return nil
+}
+
+// Return the running setup, nil if no setup is running
+func (i *Integration) activeSetup() *driverSetup {
+	i.setupMutex.Lock()
+	defer i.setupMutex.Unlock()
+
+	return i.setup
+}
+
+// Remove the setup if it is still the running setup
+func (i *Integration) endSetup(setup *driverSetup) bool {
+	i.setupMutex.Lock()
+	defer i.setupMutex.Unlock()
+
+	if i.setup != setup {
+		return false
+	}
+
+	setup.cancel()
+	i.setup = nil
+
+	return true
+}
+
+// Cancel the running setup and restore the previous setup data
+// Called when the Remote Two sends abort_driver_setup
+func (i *Integration) abortSetup() {
+	if len(i.getBackends()) > 0 {
+		i.abortBackendSetups()
+	}
+
+	setup := i.activeSetup()
+	if setup == nil {
+		return
+	}
+
+	log.Info("Cancel running driver setup")
+
+	if i.endSetup(setup) {
+		i.rollbackSetup(setup)
+	}
+}
+
+// Restore and persist the setup data from before the setup started
+func (i *Integration) rollbackSetup(setup *driverSetup) {
+	log.Info("Restore previous setup data")
+
+	i.endSetup(setup)
+
+	i.SetSetupData(setup.previous)
+
+	if err := i.PersistSetupData(); err != nil {
+		log.WithError(err).Error("Cannot restore previous setup data")
+	}
+}
+
+// Track the end of the running setup when the driver reports the final setup state
+// A failed setup is rolled back, a successful reconfigure reconnects the client
+func (i *Integration) handleSetupStateChange(eventType DriverSetupEventType, state DriverSetupState) {
+	if eventType != StopEvent {
+		return
+	}
+
+	setup := i.activeSetup()
+	if setup == nil {
+		return
+	}
+
+	switch state {
+	case OkState:
+		if !i.endSetup(setup) {
+			return
+		}
+
+		if setup.reconfigure && i.handleReconfigureFunction != nil {
+			go i.handleReconfigureFunction()
+		}
+
+	case ErrorState:
+		if i.endSetup(setup) {
+			i.rollbackSetup(setup)
+		}
+	}
+}
+
+// Set the function which is called after a successful reconfigure, e.g. to reconnect with the new setup data
+func (i *Integration) SetHandleReconfigureFunction(f func()) {
+	i.handleReconfigureFunction = f
+}
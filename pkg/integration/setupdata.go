@@ -0,0 +1,246 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of the first versioned setup data file
+// Files written before versioning contain the plain SetupData and have version 0
+const baseSetupDataVersion = 1
+
+// Setup data file as persisted in the ConfigHome
+type persistedSetupData struct {
+	Version   int       `json:"version"`
+	SetupData SetupData `json:"setup_data"`
+}
+
+// Migrates setup data persisted with an older version to the next version, e.g. to rename keys
+type SetupDataMigration func(SetupData) error
+
+// Register the migration of setup data from version to version+1
+// The current setup data version is the highest registered version+1
+// Migrations must be registered before SetMetadata loads the setup data
+func (i *Integration) AddSetupDataMigration(version int, migration SetupDataMigration) {
+	if i.setupDataMigrations == nil {
+		i.setupDataMigrations = make(map[int]SetupDataMigration)
+	}
+
+	i.setupDataMigrations[version] = migration
+}
+
+// Return the version setup data is persisted with
+func (i *Integration) setupDataVersion() int {
+	version := baseSetupDataVersion
+	for from := range i.setupDataMigrations {
+		if from+1 > version {
+			version = from + 1
+		}
+	}
+
+	return version
+}
+
+// Return a copy of the setup data
+func (i *Integration) GetSetupData() SetupData {
+	i.setupDataMutex.RLock()
+	defer i.setupDataMutex.RUnlock()
+
+	return copySetupData(i.setupData)
+}
+
+// Replace the setup data with a copy of data, it is not persisted
+func (i *Integration) SetSetupData(data SetupData) {
+	i.setupDataMutex.Lock()
+	defer i.setupDataMutex.Unlock()
+
+	i.setupData = copySetupData(data)
+}
+
+// Return a value of the setup data, empty if not set
+func (i *Integration) GetSetupDataValue(key string) string {
+	i.setupDataMutex.RLock()
+	defer i.setupDataMutex.RUnlock()
+
+	return i.setupData[key]
+}
+
+// Set a value of the setup data, it is not persisted
+func (i *Integration) SetSetupDataValue(key string, value string) {
+	i.setupDataMutex.Lock()
+	defer i.setupDataMutex.Unlock()
+
+	if i.setupData == nil {
+		i.setupData = make(SetupData)
+	}
+	i.setupData[key] = value
+}
+
+func (i *Integration) setupDataFile() string {
+	return filepath.Join(i.Config.ConfigHome, i.Metadata.DriverId+".json")
+}
+
+// Load the persisted setup data and migrate it to the current version
+// A missing file results in empty setup data, a corrupt file is moved aside and reported
+// Any other error keeps the file, PersistSetupData refuses to overwrite it until a load succeeds
+func (i *Integration) LoadSetupData() error {
+	i.SetSetupData(make(SetupData))
+	i.setSetupDataLoadErr(nil)
+
+	path := i.setupDataFile()
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.WithField("file", path).Info("No persisted setup data")
+			return nil
+		}
+		return i.setSetupDataLoadErr(fmt.Errorf("cannot read setup data: %w", err))
+	}
+
+	persisted, err := decodeSetupData(file)
+	if err != nil {
+		// Keep the corrupt file for inspection, it would be overwritten on the next persist
+		if renameErr := os.Rename(path, path+".corrupt"); renameErr != nil {
+			log.WithError(renameErr).Error("Cannot move corrupt setup data aside")
+		}
+		return fmt.Errorf("corrupt setup data in %s: %w", path, err)
+	}
+
+	cleartext, err := i.decryptSecrets(persisted.SetupData)
+	if err != nil {
+		return i.setSetupDataLoadErr(fmt.Errorf("cannot decrypt setup data: %w", err))
+	}
+
+	version := i.setupDataVersion()
+	if persisted.Version > version {
+		return i.setSetupDataLoadErr(fmt.Errorf("setup data version %d is newer than the supported version %d", persisted.Version, version))
+	}
+
+	migrated := persisted.Version < version
+	for from := persisted.Version; from < version; from++ {
+		migration, ok := i.setupDataMigrations[from]
+		if !ok {
+			continue
+		}
+
+		log.WithFields(log.Fields{"from": from, "to": from + 1}).Info("Migrate setup data")
+		if err := migration(persisted.SetupData); err != nil {
+			return i.setSetupDataLoadErr(fmt.Errorf("cannot migrate setup data from version %d: %w", from, err))
+		}
+	}
+
+	i.SetSetupData(persisted.SetupData)
+
+	log.WithField("SetupData", i.RedactedSetupData()).Info("Read persisted setup data")
+
+	// Encrypt secrets persisted before a secrets key was configured
+	if migrated || (cleartext && i.secretsKey != nil) {
+		return i.PersistSetupData()
+	}
+
+	return nil
+}
+
+// Remember why the setup data file could not be loaded and return the error
+func (i *Integration) setSetupDataLoadErr(err error) error {
+	i.setupDataMutex.Lock()
+	defer i.setupDataMutex.Unlock()
+
+	i.setupDataLoadErr = err
+
+	return err
+}
+
+// Decode a versioned setup data file or a plain SetupData file written before versioning
+func decodeSetupData(file []byte) (*persistedSetupData, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(file, &fields); err != nil {
+		return nil, err
+	}
+
+	persisted := persistedSetupData{}
+
+	if raw, ok := fields["setup_data"]; ok && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		if err := json.Unmarshal(file, &persisted); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(file, &persisted.SetupData); err != nil {
+		return nil, err
+	}
+
+	if persisted.SetupData == nil {
+		persisted.SetupData = make(SetupData)
+	}
+
+	return &persisted, nil
+}
+
+// Persist the setup data with the current version
+// The file is written to a temporary file first and then renamed into place
+func (i *Integration) PersistSetupData() error {
+
+	i.setupDataMutex.RLock()
+	loadErr := i.setupDataLoadErr
+	i.setupDataMutex.RUnlock()
+
+	if loadErr != nil {
+		return fmt.Errorf("not overwriting setup data that could not be loaded: %w", loadErr)
+	}
+
+	log.WithField("SetupData", i.RedactedSetupData()).Info("Persist setup data")
+
+	setupData, err := i.encryptSecrets(i.GetSetupData())
+	if err != nil {
+		return err
+	}
+
+	file, err := json.MarshalIndent(persistedSetupData{Version: i.setupDataVersion(), SetupData: setupData}, "", " ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal setup data: %w", err)
+	}
+
+	if err := writeFileAtomic(i.setupDataFile(), file, 0600); err != nil {
+		return fmt.Errorf("cannot persist setup data: %w", err)
+	}
+
+	return nil
+}
+
+// Write a file so that it either contains the old or the new content, even on a crash
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	// Cleanup if anything fails before the rename
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
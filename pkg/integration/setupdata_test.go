@@ -0,0 +1,23 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetupDataFileWithoutTrailingSlash(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+
+	dir := t.TempDir()
+	i.Config.ConfigHome = dir
+
+	i.SetSetupData(SetupData{"ipaddr": "10.0.0.1"})
+	if err := i.PersistSetupData(); err != nil {
+		t.Fatalf("Cannot persist setup data: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "test.json")); err != nil {
+		t.Errorf("Setup data not persisted in the configuration directory: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default interval of SETUP progress events while a validation step runs
+const defaultSetupProgressInterval = 5 * time.Second
+
+// Declarative driver setup
+// The steps are run in order after the Remote Two sent setup_driver, the integration sends the
+// driver_setup_change events and collects the values entered by the user
+type SetupFlow struct {
+	Steps []SetupStep
+
+	// Called with all collected values after the last step
+	// The values are already merged into the SetupData and persisted
+	OnComplete func(SetupData) error
+
+	// Interval of SETUP progress events while a validation step runs
+	// The Remote Two aborts the setup if it does not hear from the integration
+	ProgressInterval time.Duration
+}
+
+// A step of a SetupFlow, exactly one of the fields is set
+// Use SettingsStep, ConfirmationStep or ValidationStep to create a step
+type SetupStep struct {
+	Settings     *SettigsPage
+	Confirmation *ConfirmationPage
+	Validate     func(ctx context.Context, values SetupData) error
+}
+
+// A page with settings, the entered values are collected by setting id
+func SettingsStep(page SettigsPage) SetupStep {
+	return SetupStep{Settings: &page}
+}
+
+// A page the user has to confirm, e.g. to press a button on the device
+func ConfirmationStep(page ConfirmationPage) SetupStep {
+	return SetupStep{Confirmation: &page}
+}
+
+// Asynchronous work, e.g. connecting to the device with the entered values
+// The function can add values, e.g. a token fetched from the device
+// Return a SetupError to report a specific DriverSetupError
+func ValidationStep(f func(ctx context.Context, values SetupData) error) SetupStep {
+	return SetupStep{Validate: f}
+}
+
+// Error of a setup step with the DriverSetupError reported to the Remote Two
+type SetupError struct {
+	Code DriverSetupError
+	Err  error
+}
+
+func (e *SetupError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Code, e.Err)
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// Return the DriverSetupError reported for the error of a setup step
+func setupErrorCode(err error) DriverSetupError {
+	var setupErr *SetupError
+	if errors.As(err, &setupErr) {
+		return setupErr.Code
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return TimeoutError
+	}
+
+	return OtherError
+}
+
+// A running SetupFlow
+type setupRun struct {
+	flow   *SetupFlow
+	values SetupData
+	ctx    context.Context
+
+	// Values of set_driver_user_data requests, buffered as the Remote Two may answer
+	// before the flow waits for the input
+	input chan map[string]string
+}
+
+// Use a declarative SetupFlow instead of the setup function for the driver setup
+func (i *Integration) SetSetupFlow(flow *SetupFlow) {
+	i.setupFlow = flow
+}
+
+// Start the setup flow of a driver setup
+func (i *Integration) startSetupFlow(setup *driverSetup) {
+	setup.run = i.newSetupRun(setup)
+
+	go i.runSetupFlow(setup.run)
+}
+
+func (i *Integration) newSetupRun(setup *driverSetup) *setupRun {
+	return &setupRun{
+		flow:   i.setupFlow,
+		values: i.GetSetupData(),
+		ctx:    setup.ctx,
+		input:  make(chan map[string]string, 1),
+	}
+}
+
+// Pass the values of a set_driver_user_data request to the running setup flow
+// Return false if no setup flow is running
+func (i *Integration) handleSetupFlowInput(values map[string]string) bool {
+	setup := i.activeSetup()
+	if setup == nil || setup.run == nil {
+		return false
+	}
+
+	select {
+	case setup.run.input <- values:
+	default:
+		log.Info("Setup flow is not waiting for user input, ignore driver user data")
+	}
+
+	return true
+}
+
+func (i *Integration) runSetupFlow(run *setupRun) {
+	i.setSetupState(run, SetupEvent, SetupState, "", nil)
+
+	for ix, step := range run.flow.Steps {
+		log.WithField("step", ix).Debug("Run setup step")
+
+		if err := i.runSetupStep(run, step); err != nil {
+			if run.ctx.Err() != nil {
+				log.Info("Setup flow cancelled")
+				return
+			}
+
+			log.WithError(err).WithField("step", ix).Error("Setup step failed")
+			i.setSetupState(run, StopEvent, ErrorState, setupErrorCode(err), nil)
+			return
+		}
+	}
+
+	committed, err := i.commitSetupFlow(run)
+	if !committed {
+		log.Info("Setup flow cancelled")
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Cannot persist setup data")
+		i.setSetupState(run, StopEvent, ErrorState, OtherError, nil)
+		return
+	}
+
+	if run.flow.OnComplete != nil {
+		if err := run.flow.OnComplete(run.values); err != nil {
+			log.WithError(err).Error("Cannot complete setup")
+			i.setSetupState(run, StopEvent, ErrorState, setupErrorCode(err), nil)
+			return
+		}
+	}
+
+	i.setSetupState(run, StopEvent, OkState, "", nil)
+}
+
+// Apply and persist the collected values, unless the setup flow was cancelled
+// An abort cancels the setup under the setupMutex before it restores the previous setup data,
+// so the values are either dropped or rolled back by the abort
+func (i *Integration) commitSetupFlow(run *setupRun) (bool, error) {
+	i.setupMutex.Lock()
+	defer i.setupMutex.Unlock()
+
+	if run.ctx.Err() != nil {
+		return false, nil
+	}
+
+	i.SetSetupData(run.values)
+
+	return true, i.PersistSetupData()
+}
+
+func (i *Integration) runSetupStep(run *setupRun, step SetupStep) error {
+	switch {
+	case step.Settings != nil:
+		values, err := i.waitForUserAction(run, &RequireUserAction{Input: *step.Settings})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range values {
+			run.values[k] = v
+		}
+
+	case step.Confirmation != nil:
+		// Any set_driver_user_data confirms the page
+		if _, err := i.waitForUserAction(run, &RequireUserAction{Confirmation: *step.Confirmation}); err != nil {
+			return err
+		}
+
+	case step.Validate != nil:
+		return i.runValidation(run, step.Validate)
+	}
+
+	return nil
+}
+
+// Ask the user for input and wait for the set_driver_user_data request
+func (i *Integration) waitForUserAction(run *setupRun, action *RequireUserAction) (map[string]string, error) {
+	i.setSetupState(run, SetupEvent, WaitUserActionState, "", action)
+
+	select {
+	case values := <-run.input:
+		return values, nil
+	case <-run.ctx.Done():
+		return nil, run.ctx.Err()
+	}
+}
+
+// Run a validation step and send progress events until it returns
+func (i *Integration) runValidation(run *setupRun, validate func(context.Context, SetupData) error) error {
+	interval := run.flow.ProgressInterval
+	if interval <= 0 {
+		interval = defaultSetupProgressInterval
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				i.setSetupState(run, SetupEvent, SetupState, "", nil)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := validate(run.ctx, run.values)
+
+	close(done)
+	wg.Wait()
+
+	return err
+}
+
+// Send a driver_setup_change event unless the setup flow was cancelled
+func (i *Integration) setSetupState(run *setupRun, eventType DriverSetupEventType, state DriverSetupState, err DriverSetupError, action *RequireUserAction) {
+	if run.ctx.Err() != nil {
+		return
+	}
+
+	i.SetDriverSetupState(eventType, state, err, action)
+}
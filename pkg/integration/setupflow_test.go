@@ -0,0 +1,187 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// Start a setup with the flow and return the run and a channel closed when the flow returned
+// The port 80 is set up before, the setup changes it to 8080
+func startTestSetupFlow(t *testing.T, i *Integration, flow *SetupFlow) (*setupRun, chan struct{}) {
+	t.Helper()
+
+	i.SetSetupData(SetupData{"port": "80"})
+	if err := i.PersistSetupData(); err != nil {
+		t.Fatalf("Cannot persist setup data: %v", err)
+	}
+
+	i.SetSetupFlow(flow)
+
+	setup, err := i.beginSetup(SetupDataValue{Value: SetupData{"port": "8080"}})
+	if err != nil {
+		t.Fatalf("Cannot begin setup: %v", err)
+	}
+
+	setup.run = i.newSetupRun(setup)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i.runSetupFlow(setup.run)
+	}()
+
+	return setup.run, done
+}
+
+// Return the setup data persisted in the configuration directory
+func readPersistedSetupData(t *testing.T, i *Integration) SetupData {
+	t.Helper()
+
+	raw, err := os.ReadFile(i.setupDataFile())
+	if err != nil {
+		t.Fatalf("Cannot read setup data: %v", err)
+	}
+
+	persisted := persistedSetupData{}
+	if err := json.Unmarshal(raw, &persisted); err != nil {
+		t.Fatalf("Cannot unmarshal setup data: %v", err)
+	}
+
+	return persisted.SetupData
+}
+
+// Return the setup states of the queued driver_setup_change events
+func setupStates(t *testing.T, s *session) []string {
+	t.Helper()
+
+	var states []string
+	for _, m := range s.queue.popAll() {
+		data, err := m.bytes()
+		if err != nil {
+			t.Fatalf("Cannot marshal message: %v", err)
+		}
+
+		event := DriverSetupChangeEvent{}
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatalf("Cannot unmarshal message: %v", err)
+		}
+
+		if event.Msg == "driver_setup_change" {
+			states = append(states, string(event.MsgData.State))
+		}
+	}
+
+	return states
+}
+
+func TestSetupFlowCommitsCollectedValues(t *testing.T) {
+	i, s := newSetupTestIntegration(t)
+
+	var completed SetupData
+	run, done := startTestSetupFlow(t, i, &SetupFlow{
+		Steps: []SetupStep{
+			SettingsStep(SettigsPage{Title: LanguageText{En: "Host"}}),
+			ValidationStep(func(ctx context.Context, values SetupData) error {
+				values["token"] = "secret"
+				return nil
+			}),
+		},
+		OnComplete: func(values SetupData) error {
+			completed = values
+			return nil
+		},
+	})
+
+	run.input <- map[string]string{"host": "10.0.0.1"}
+	<-done
+
+	expected := SetupData{"port": "8080", "host": "10.0.0.1", "token": "secret"}
+	if fmt.Sprint(readPersistedSetupData(t, i)) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v persisted, got %v", expected, readPersistedSetupData(t, i))
+	}
+	if fmt.Sprint(completed) != fmt.Sprint(expected) {
+		t.Errorf("Expected OnComplete with %v, got %v", expected, completed)
+	}
+
+	if state := i.GetSetupState(); state != OkState {
+		t.Errorf("Expected setup state OK, got %s", state)
+	}
+	if states := setupStates(t, s); fmt.Sprint(states) != "[SETUP WAIT_USER_ACTION OK]" {
+		t.Errorf("Unexpected setup states %v", states)
+	}
+}
+
+func TestSetupFlowAbortedDuringValidationKeepsPreviousSetupData(t *testing.T) {
+	i, s := newSetupTestIntegration(t)
+
+	validating := make(chan struct{})
+	release := make(chan struct{})
+	completed := false
+
+	_, done := startTestSetupFlow(t, i, &SetupFlow{
+		Steps: []SetupStep{
+			// Ignores the context and succeeds after the abort
+			ValidationStep(func(ctx context.Context, values SetupData) error {
+				close(validating)
+				<-release
+				return nil
+			}),
+		},
+		OnComplete: func(values SetupData) error {
+			completed = true
+			return nil
+		},
+	})
+
+	<-validating
+	i.abortSetup()
+	close(release)
+	<-done
+
+	if port := i.GetSetupDataValue("port"); port != "80" {
+		t.Errorf("Expected the previous port 80 after the abort, got %s", port)
+	}
+	if port := readPersistedSetupData(t, i)["port"]; port != "80" {
+		t.Errorf("Expected the previous port 80 persisted after the abort, got %s", port)
+	}
+	if completed {
+		t.Error("OnComplete called for an aborted setup")
+	}
+
+	if states := setupStates(t, s); fmt.Sprint(states) != "[SETUP]" {
+		t.Errorf("Expected no setup state after the abort, got %v", states)
+	}
+}
+
+func TestSetupFlowErrorRestoresPreviousSetupData(t *testing.T) {
+	i, s := newSetupTestIntegration(t)
+
+	_, done := startTestSetupFlow(t, i, &SetupFlow{
+		Steps: []SetupStep{
+			ValidationStep(func(ctx context.Context, values SetupData) error {
+				return &SetupError{Code: ConnectionRefusedError, Err: fmt.Errorf("device not reachable")}
+			}),
+		},
+	})
+	<-done
+
+	if port := i.GetSetupDataValue("port"); port != "80" {
+		t.Errorf("Expected the previous port 80 after the error, got %s", port)
+	}
+	if port := readPersistedSetupData(t, i)["port"]; port != "80" {
+		t.Errorf("Expected the previous port 80 persisted after the error, got %s", port)
+	}
+
+	if state := i.GetSetupState(); state != ErrorState {
+		t.Errorf("Expected setup state ERROR, got %s", state)
+	}
+	if i.activeSetup() != nil {
+		t.Error("Setup still running after the error")
+	}
+	if states := setupStates(t, s); fmt.Sprint(states) != "[SETUP ERROR]" {
+		t.Errorf("Unexpected setup states %v", states)
+	}
+}
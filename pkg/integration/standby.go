@@ -0,0 +1,166 @@
+package integration
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Latest entity_change per entity, collected while a Remote Two is in standby
+// Safe for concurrent use
+type pendingChanges struct {
+	mu     sync.Mutex
+	events map[string]*EntityChangeEvent
+	// Entity ids in the order of their first change
+	order []string
+}
+
+func newPendingChanges() *pendingChanges {
+	return &pendingChanges{
+		events: make(map[string]*EntityChangeEvent),
+	}
+}
+
+// Merge an entity_change event with the already collected changes of the entity
+func (p *pendingChanges) add(event *EntityChangeEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entity_id := event.MsgData.EntityId
+
+	attributes := make(map[string]interface{})
+	if pending, ok := p.events[entity_id]; ok {
+		for k, v := range pending.MsgData.Attributes {
+			attributes[k] = v
+		}
+	} else {
+		p.order = append(p.order, entity_id)
+	}
+
+	for k, v := range event.MsgData.Attributes {
+		attributes[k] = v
+	}
+
+	merged := *event
+	merged.MsgData.Attributes = attributes
+	p.events[entity_id] = &merged
+}
+
+// Merge all changes of other into this changes
+func (p *pendingChanges) merge(other *pendingChanges) {
+	for _, event := range other.take() {
+		p.add(event)
+	}
+}
+
+// Remove and return all collected changes in order
+func (p *pendingChanges) take() []*EntityChangeEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	events := make([]*EntityChangeEvent, 0, len(p.order))
+	for _, entity_id := range p.order {
+		events = append(events, p.events[entity_id])
+	}
+
+	p.events = make(map[string]*EntityChangeEvent)
+	p.order = nil
+
+	return events
+}
+
+func (p *pendingChanges) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.order)
+}
+
+// Changes of a Remote Two that disconnected while in standby
+type detachedChanges struct {
+	pending       *pendingChanges
+	subscriptions *EntitySubscriptions
+}
+
+// Keep the collected changes of a session that closed while in standby
+// They are replayed when the Remote Two connects again
+func (i *Integration) detachPendingChanges(s *session, subscriptions []string) {
+	if !s.InStandBy() {
+		return
+	}
+
+	i.detachedChangesMutex.Lock()
+	defer i.detachedChangesMutex.Unlock()
+
+	log.WithFields(s.logFields()).WithField("Changes", s.pending.len()).Debug("Keep entity changes of disconnected Remote in standby")
+
+	detached, ok := i.detachedChanges[s.host]
+	if !ok {
+		detached = &detachedChanges{pending: newPendingChanges(), subscriptions: NewEntitySubscriptions()}
+		i.detachedChanges[s.host] = detached
+	}
+
+	detached.pending.merge(s.pending)
+	for _, entity_id := range subscriptions {
+		detached.subscriptions.Add(entity_id)
+	}
+}
+
+// Hand over the changes collected for a Remote Two while it was disconnected to its new session
+func (i *Integration) attachPendingChanges(s *session) {
+	i.detachedChangesMutex.Lock()
+	defer i.detachedChangesMutex.Unlock()
+
+	detached, ok := i.detachedChanges[s.host]
+	if !ok {
+		return
+	}
+
+	delete(i.detachedChanges, s.host)
+
+	s.pending.merge(detached.pending)
+}
+
+// Collect an entity change for all Remote Twos that disconnected while in standby
+func (i *Integration) addDetachedChange(event *EntityChangeEvent) {
+	if i.parent != nil {
+		i.parent.addDetachedChange(event)
+		return
+	}
+
+	i.detachedChangesMutex.Lock()
+	defer i.detachedChangesMutex.Unlock()
+
+	for _, detached := range i.detachedChanges {
+		if i.Config.IgnoreEntitySubscription || detached.subscriptions.Contains(event.MsgData.EntityId) {
+			detached.pending.add(event)
+		}
+	}
+}
+
+// Send one merged entity_change per entity that changed while the Remote Two was in standby or disconnected
+func (i *Integration) replayPendingChanges(s *session) {
+	if s.InStandBy() || s.pending.len() == 0 {
+		return
+	}
+
+	// UTC time for event timestamp
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.999999999Z")
+
+	events := s.pending.take()
+
+	log.WithFields(s.logFields()).WithField("Changes", len(events)).Info("Replay entity changes")
+
+	for _, event := range events {
+		if !i.Config.IgnoreEntitySubscription && !s.subscriptions.Contains(event.MsgData.EntityId) {
+			continue
+		}
+
+		event.Ts = now
+
+		if err := s.sendEntityChange(event); err != nil {
+			log.WithError(err).Debug("Message not sent")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/splattner/goucrt/pkg/entities"
+)
+
+// Delay before changed entity states are written, merges writes of chatty devices
+const entityStateSaveDelay = 2 * time.Second
+
+// Last known attributes per entity id, persisted as json file
+// Safe for concurrent use
+type entityStateStore struct {
+	mu     sync.Mutex
+	path   string
+	states map[string]map[string]interface{}
+	timer  *time.Timer
+}
+
+func newEntityStateStore(path string) *entityStateStore {
+	return &entityStateStore{
+		path:   path,
+		states: make(map[string]map[string]interface{}),
+	}
+}
+
+// Read the persisted states, a missing file is not an error
+func (s *entityStateStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(file, &s.states)
+}
+
+// Return the persisted attributes of an entity
+func (s *entityStateStore) get(entity_id string) (map[string]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attributes, ok := s.states[entity_id]
+
+	return attributes, ok
+}
+
+// Replace the attributes of an entity and write them after entityStateSaveDelay
+func (s *entityStateStore) set(entity_id string, attributes map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[entity_id] = attributes
+	s.scheduleSave()
+}
+
+// Forget the attributes of an entity
+func (s *entityStateStore) remove(entity_id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.states[entity_id]; !ok {
+		return
+	}
+
+	delete(s.states, entity_id)
+	s.scheduleSave()
+}
+
+func (s *entityStateStore) scheduleSave() {
+	if s.timer != nil {
+		return
+	}
+
+	s.timer = time.AfterFunc(entityStateSaveDelay, func() {
+		if err := s.flush(); err != nil {
+			log.WithError(err).Error("Cannot persist entity states")
+		}
+	})
+}
+
+// Write pending changes now
+func (s *entityStateStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer == nil {
+		return nil
+	}
+
+	s.timer.Stop()
+	s.timer = nil
+
+	data, err := json.MarshalIndent(s.states, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data, 0644)
+}
+
+// Enable the entity state store under the ConfigHome and read the persisted states
+func (i *Integration) loadEntityStates() {
+	store := newEntityStateStore(filepath.Join(i.Config.ConfigHome, fmt.Sprintf("%s_entity_states.json", i.Metadata.DriverId)))
+
+	if err := store.load(); err != nil {
+		log.WithError(err).Error("Cannot read persisted entity states")
+	}
+
+	i.entityStates = store
+}
+
+// Restore the persisted attributes of a newly added entity
+func (i *Integration) restoreEntityState(e entities.EntityInterface) {
+	if i.entityStates == nil {
+		return
+	}
+
+	attributes, ok := i.entityStates.get(e.GetId())
+	if !ok {
+		return
+	}
+
+	e.RestoreAttributes(attributes)
+
+	log.WithFields(log.Fields{
+		"entity_id":  e.GetId(),
+		"attributes": e.StaleAttributes()}).Debug("Restored persisted entity state")
+}
+
+// Remember the current attributes of an entity
+func (i *Integration) saveEntityState(e entities.EntityInterface) {
+	if i.entityStates == nil {
+		return
+	}
+
+	i.entityStates.set(e.GetId(), e.GetAttribute())
+}
+
+// Write pending entity state changes
+func (i *Integration) flushEntityStates() {
+	if i.entityStates == nil {
+		return
+	}
+
+	if err := i.entityStates.flush(); err != nil {
+		log.WithError(err).Error("Cannot persist entity states")
+	}
+}
@@ -0,0 +1,57 @@
+package integration
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/splattner/goucrt/pkg/entities"
+)
+
+// Return a light with the features the deconz client sets for a dimmable color light
+func newStateTestLight() *entities.LightEntity {
+	light := entities.NewLightEntity("light", entities.LanguageText{En: "Light"}, "")
+	light.AddFeature(entities.OnOffLightEntityFeatures)
+	light.AddFeature(entities.DimLightEntityFeatures)
+	light.AddFeature(entities.ColorLightEntityFeatures)
+
+	return light
+}
+
+func TestRestoreEntityStateKeepsValuesSetByTheDriver(t *testing.T) {
+	i := newTestIntegration(t, Config{})
+	i.entityStates = newEntityStateStore(filepath.Join(i.Config.ConfigHome, "states.json"))
+	i.entityStates.set("light", map[string]interface{}{"state": "ON", "brightness": 200.0, "hue": 120.0})
+	t.Cleanup(func() {
+		if err := i.entityStates.flush(); err != nil {
+			t.Errorf("Cannot persist entity states: %v", err)
+		}
+	})
+
+	// The driver sets the current values before it adds the entity
+	light := newStateTestLight()
+	light.UpdateAttribute(entities.BrightnessLightEntityAttribute, 50)
+	light.SetAttributes(map[string]interface{}{"hue": 10})
+
+	if err := i.AddEntity(light); err != nil {
+		t.Fatalf("Cannot add entity: %v", err)
+	}
+
+	attributes := light.GetAttribute()
+	if attributes["brightness"] != 50 || attributes["hue"] != 10 {
+		t.Errorf("Values set by the driver were overwritten: %v", attributes)
+	}
+	if attributes["state"] != entities.LightEntityState("ON") {
+		t.Errorf("Expected the restored state ON, got %v", attributes["state"])
+	}
+
+	if stale := fmt.Sprint(light.StaleAttributes()); stale != "[state]" {
+		t.Errorf("Expected only state to be stale, got %s", stale)
+	}
+
+	// The device confirms the state
+	light.SetAttributes(map[string]interface{}{"state": entities.OnLightEntityState})
+	if stale := light.StaleAttributes(); len(stale) != 0 {
+		t.Errorf("Expected no stale attributes, got %v", stale)
+	}
+}
@@ -129,6 +129,12 @@ type AuthRequestData struct {
 	Token string `json:"token"`
 }
 
+// Sent by the integration when message based authentication is required
+type AuthRequiredEvent struct {
+	CommonEvent
+	MsgData DriverVersionData `json:"msg_data"`
+}
+
 type DriverVersionReq struct {
 	CommonReq
 }
@@ -153,7 +159,7 @@ type AvailableEntityMessageData struct {
 
 type DeviceStateMessageReq struct {
 	CommonReq
-	MsgData DeviceId
+	MsgData DeviceId `json:"msg_data"`
 }
 
 type SubscribeEventMessageReq struct {
@@ -163,7 +169,7 @@ type SubscribeEventMessageReq struct {
 
 type SubscribeEventMessageData struct {
 	DeviceId  string   `json:"device_id"`
-	EntityIds []string `json:"entity_ids"`
+	EntityIds []string `json:"entity_ids,omitempty"`
 }
 
 type UnubscribeEventMessageReq struct {
@@ -293,6 +299,22 @@ type GetEntityStatesMessage struct {
 
 type EntityCommandResponse struct {
 	CommonResp
+	MsgData *ErrorResponseData `json:"msg_data,omitempty"`
+}
+
+// Details of a failed request
+type ErrorResponseData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes of the ErrorResponseData by response code
+var errorResponseCodes = map[int]string{
+	400: "BAD_REQUEST",
+	404: "NOT_FOUND",
+	408: "TIMEOUT",
+	500: "INTERNAL_ERROR",
+	503: "SERVICE_UNAVAILABLE",
 }
 
 // Events
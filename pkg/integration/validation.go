@@ -0,0 +1,210 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Invalid value of a setup setting
+// The value itself is not part of the message as it may be a secret
+type SetupValidationError struct {
+	Id     string
+	Reason string
+}
+
+func (e *SetupValidationError) Error() string {
+	return fmt.Sprintf("invalid value for %s: %s", e.Id, e.Reason)
+}
+
+// Field of a setting, decoded from the typed SettingType structs or from json
+type settingField struct {
+	Number   *SettingTypeNumberDefinition   `json:"number,omitempty"`
+	Text     *SettingTypeTextDefinition     `json:"text,omitempty"`
+	Password *SettingTypePasswordDefinition `json:"password,omitempty"`
+	Checkbox *SettingTypeCheckboxDefinition `json:"checkbox,omitempty"`
+	Dropdown *SettingTypeDropdowDefinition  `json:"dropdown,omitempty"`
+}
+
+func decodeSettingField(field interface{}) (*settingField, error) {
+	raw, err := json.Marshal(field)
+	if err != nil {
+		return nil, err
+	}
+
+	f := settingField{}
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// Validate setup values against the setup data schema
+// Values without a setting in the schema, e.g. an api key fetched during setup, are not checked
+func (s SetupDataSchema) Validate(values map[string]string) error {
+	fields := make(map[string]interface{}, len(s.Settings))
+	for _, setting := range s.Settings {
+		fields[setting.Id] = setting.Field
+	}
+
+	return validateSettings(fields, values)
+}
+
+// Validate user input against the settings of a settings page
+func (p SettigsPage) Validate(values map[string]string) error {
+	fields := make(map[string]interface{}, len(p.Settings))
+	for _, setting := range p.Settings {
+		fields[setting.Id] = setting.Field
+	}
+
+	return validateSettings(fields, values)
+}
+
+func validateSettings(fields map[string]interface{}, values map[string]string) error {
+	for id, value := range values {
+		field, ok := fields[id]
+		if !ok {
+			continue
+		}
+
+		if err := validateSettingValue(id, field, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateSettingValue(id string, field interface{}, value string) error {
+	f, err := decodeSettingField(field)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Warn("Cannot decode setting field, skip validation")
+		return nil
+	}
+
+	switch {
+	case f.Number != nil:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return &SetupValidationError{Id: id, Reason: "not a number"}
+		}
+
+		// Min and Max are omitted when 0, a Max declares a range starting at Min
+		if (f.Number.Min != 0 || f.Number.Max != 0) && number < f.Number.Min {
+			return &SetupValidationError{Id: id, Reason: fmt.Sprintf("must be at least %v", f.Number.Min)}
+		}
+		if f.Number.Max != 0 && number > f.Number.Max {
+			return &SetupValidationError{Id: id, Reason: fmt.Sprintf("must be at most %v", f.Number.Max)}
+		}
+
+	case f.Text != nil:
+		return validateRegex(id, f.Text.Regex, value)
+
+	case f.Password != nil:
+		return validateRegex(id, f.Password.Regex, value)
+
+	case f.Checkbox != nil:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return &SetupValidationError{Id: id, Reason: "not a boolean"}
+		}
+
+	case f.Dropdown != nil:
+		for _, item := range f.Dropdown.Items {
+			if item.Id == value {
+				return nil
+			}
+		}
+		return &SetupValidationError{Id: id, Reason: "not one of the dropdown items"}
+	}
+
+	return nil
+}
+
+func validateRegex(id string, expr string, value string) error {
+	if expr == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Warn("Invalid regex in setting, skip validation")
+		return nil
+	}
+
+	if !re.MatchString(value) {
+		return &SetupValidationError{Id: id, Reason: fmt.Sprintf("does not match %s", expr)}
+	}
+
+	return nil
+}
+
+// Return the settings page of a user action, nil if the action is not a settings page
+func userActionSettingsPage(action *RequireUserAction) *SettigsPage {
+	if action == nil {
+		return nil
+	}
+
+	switch page := action.Input.(type) {
+	case SettigsPage:
+		return &page
+	case *SettigsPage:
+		return page
+	}
+
+	return nil
+}
+
+// Return the value of a setup data key as int
+func (d SetupData) Int(key string) (int, error) {
+	value, ok := d[key]
+	if !ok || value == "" {
+		return 0, fmt.Errorf("%s is not set", key)
+	}
+
+	if i, err := strconv.Atoi(value); err == nil {
+		return i, nil
+	}
+
+	// Number settings may be sent as float, e.g. 8080.0
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f != math.Trunc(f) {
+		return 0, fmt.Errorf("%s is not an integer", key)
+	}
+
+	return int(f), nil
+}
+
+// Return the value of a setup data key as float
+func (d SetupData) Float(key string) (float64, error) {
+	value, ok := d[key]
+	if !ok || value == "" {
+		return 0, fmt.Errorf("%s is not set", key)
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number", key)
+	}
+
+	return f, nil
+}
+
+// Return the value of a setup data key as bool, a missing key is false
+func (d SetupData) Bool(key string) (bool, error) {
+	value, ok := d[key]
+	if !ok || value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s is not a boolean", key)
+	}
+
+	return b, nil
+}
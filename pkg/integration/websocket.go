@@ -28,30 +28,43 @@ const (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// The Remote Two is not a browser, access is controlled with the configured auth method
+	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
 func (i *Integration) wsEndpoint(w http.ResponseWriter, r *http.Request) {
 
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.WithError(err).Fatal("Cannot upgrade connection")
+		// The upgrader already replied with an HTTP error
+		log.WithError(err).Error("Cannot upgrade connection")
+		return
 	}
 
 	log.WithField("RemoteAddr", ws.RemoteAddr().String()).Info("Unfolded Circle Remote connected")
-	i.Remote.ExitStandBy()
 
-	// Start reading those messages
-	go i.wsReader(ws)
-	go i.wsWriter(ws)
+	s := newSession(ws, i.Config.QueueSize, QueuePolicy(i.Config.QueuePolicy), &i.eventMetrics)
+	s.validateMessages = i.Config.ValidateMessages
+	s.recorder = i.recorder
+	s.isSecret = i.isSecretSetupDataKey
+
+	// Send the authentication response or close the connection if not authenticated
+	if !i.authenticate(s, r) {
+		return
+	}
+
+	i.addSession(s)
 
-	i.SendAuthenticationResponse()
+	// Start reading those messages
+	go i.wsReader(s)
+	go i.wsWriter(s)
 
 }
 
-func (i *Integration) wsReader(ws *websocket.Conn) {
-	log.WithField("RemoteAddr", ws.RemoteAddr().String()).Debug("Start Websocket read loop")
+func (i *Integration) wsReader(s *session) {
+	ws := s.ws
+
+	log.WithFields(s.logFields()).Debug("Start Websocket read loop")
 	ws.SetReadLimit(maxMessageSize)
 	if err := ws.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 		log.WithError(err).Error("Cannot set readdeadline")
@@ -64,11 +77,12 @@ func (i *Integration) wsReader(ws *websocket.Conn) {
 	})
 
 	defer func() {
-		log.WithField("RemoteAddr", ws.RemoteAddr().String()).Info("Closing Websocket, not able to read message anymore")
+		log.WithFields(s.logFields()).Info("Closing Websocket, not able to read message anymore")
 		ws.Close()
 
 		// Close Write loop also
-		i.Remote.controlChannel <- ws.RemoteAddr().String()
+		s.close()
+		i.removeSession(s)
 	}()
 
 	for {
@@ -79,6 +93,8 @@ func (i *Integration) wsReader(ws *websocket.Conn) {
 			return
 		}
 
+		s.received(p)
+
 		req := RequestMessage{}
 
 		if json.Unmarshal(p, &req) != nil {
@@ -86,63 +102,56 @@ func (i *Integration) wsReader(ws *websocket.Conn) {
 			continue
 		}
 
-		log.WithFields(log.Fields{
-			"RemoteAddr": ws.RemoteAddr().String(),
-			"Message":    req.Msg,
-			"Kind":       req.Kind,
-			"Id":         req.Id,
+		log.WithFields(s.logFields()).WithFields(log.Fields{
+			"Message": req.Msg,
+			"Kind":    req.Kind,
+			"Id":      req.Id,
 		}).Info("Message received")
 
 		// Event Message
 		if req.Kind == "event" {
-			i.handleEvent(&req, p)
+			i.handleEvent(s, &req, p)
 		}
 
 		// Request Message
 		if req.Kind == "req" {
-			i.handleRequest(&req, p)
+			i.handleRequest(s, &req, p)
 		}
 
 	}
 }
 
-func (i *Integration) wsWriter(ws *websocket.Conn) {
-	log.WithField("RemoteAddr", ws.RemoteAddr().String()).Debug("Start Websocket write loop")
+func (i *Integration) wsWriter(s *session) {
+	ws := s.ws
+
+	log.WithFields(s.logFields()).Debug("Start Websocket write loop")
 	ticker := time.NewTicker(pingPeriod)
 
 	defer func() {
-		log.WithField("RemoteAddr", ws.RemoteAddr().String()).Info("Closing Websocket")
+		log.WithFields(s.logFields()).Info("Closing Websocket")
 		ws.Close()
 		ticker.Stop()
 		// Close Read loop
-		i.Remote.controlChannel <- ws.RemoteAddr().String()
+		s.close()
+		close(s.writerDone)
 	}()
 
 	for {
 		select {
 
-		case msg := <-i.Remote.controlChannel:
-			// Close the writer if message was for this websocket. Closed by reader
-			if ws.RemoteAddr().String() == msg {
-				log.Debug("Closing write loop as read loop closed")
-				return
-			}
-
-		case msg := <-i.Remote.messageChannel:
+		case <-s.done:
+			// Closed by reader
+			log.Debug("Closing write loop as read loop closed")
+			return
 
-			// Remote should not be in standby as this is a response to a request
-			// or if sent from sendEventMessage the sendEventMessage function makes sure the remote is not in standby
-			log.WithFields(log.Fields{
-				"RawMessage": string(msg),
-				"RemoteAddr": ws.RemoteAddr().String()}).Debug("Send message to websocket")
+		case <-s.closing:
+			// Send all queued messages and a close message
+			s.flush()
+			return
 
-			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.WithError(err).Error("Faled to set WriteDeatLine")
-				return
-			}
+		case <-s.queue.ready:
 
-			if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-				log.WithError(err).Error("Failed to send message")
+			if err := s.writeQueued(); err != nil {
 				return
 			}
 
@@ -152,11 +161,72 @@ func (i *Integration) wsWriter(ws *websocket.Conn) {
 				log.WithError(err).Error("Cannot set writedealine")
 				return
 			}
-			log.WithField("RemoteAddr", ws.RemoteAddr().String()).Debug("Send Ping Message")
+			log.WithFields(s.logFields()).Debug("Send Ping Message")
 			if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.WithField("RemoteAddr", ws.RemoteAddr().String()).Info("Could not send Ping message")
+				log.WithFields(s.logFields()).Info("Could not send Ping message")
 				return
 			}
 		}
 	}
 }
+
+// Write a message to the websocket of the session
+func (s *session) write(msg []byte) error {
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.WithFields(s.logFields()).WithField("RawMessage", redactMessage(msg, s.isSecretKey)).Debug("Send message to websocket")
+	}
+
+	s.recorder.record(s.id, RecordOutbound, msg, s.isSecretKey)
+	s.validateMessage("sent", msg)
+
+	if err := s.ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		log.WithError(err).Error("Faled to set WriteDeatLine")
+		return err
+	}
+
+	if err := s.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		log.WithError(err).Error("Failed to send message")
+		return err
+	}
+
+	return nil
+}
+
+// Handle a message received on the websocket of the session before it is processed
+func (s *session) received(p []byte) {
+	s.recorder.record(s.id, RecordInbound, p, s.isSecretKey)
+	s.validateMessage("received", p)
+}
+
+// Write all queued messages to the websocket of the session
+func (s *session) writeQueued() error {
+	for _, m := range s.queue.popAll() {
+		msg, err := m.bytes()
+		if err != nil {
+			log.WithError(err).Error("Cannot marshal message")
+			continue
+		}
+
+		if err := s.write(msg); err != nil {
+			return err
+		}
+
+		if !m.response {
+			s.metrics.sent.Add(1)
+		}
+	}
+
+	return nil
+}
+
+// Write all queued messages and a close message to the websocket of the session
+func (s *session) flush() {
+	if err := s.writeQueued(); err != nil {
+		return
+	}
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "integration shutting down")
+	if err := s.ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait)); err != nil {
+		log.WithFields(s.logFields()).WithError(err).Debug("Cannot send close message")
+	}
+}
@@ -82,7 +82,7 @@ func (s *Shelly) mqttDiscoverCallback() mqtt.MessageHandler {
 
 			err := json.Unmarshal(msg.Payload(), &shellyDevice)
 			if err != nil {
-				log.WithError(err).Fatal("Unmarshal to Shelly Device failed")
+				log.WithError(err).Error("Unmarshal to Shelly Device failed")
 				return
 			}
 
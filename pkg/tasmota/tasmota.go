@@ -78,7 +78,7 @@ func (s *Tasmota) mqttDiscoverCallback() mqtt.MessageHandler {
 
 			err := json.Unmarshal(msg.Payload(), &tasmotaDevice)
 			if err != nil {
-				log.WithError(err).Fatal("Unmarshal to Tasmota Device failed")
+				log.WithError(err).Error("Unmarshal to Tasmota Device failed")
 				return
 			}
 